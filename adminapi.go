@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+)
+
+// Time to finish running requests when the bridge shuts down
+const adminAPIShutdownTimeout = 5 * time.Second
+
+type apiChannel struct {
+	Name  string                  `json:"name"`
+	Type  vdcdapi.ChannelTypeType `json:"type"`
+	Value *float32                `json:"value"`
+	Min   float32                 `json:"min,omitempty"`
+	Max   float32                 `json:"max,omitempty"`
+	Unit  string                  `json:"unit,omitempty"`
+}
+
+type apiSensor struct {
+	ID    string             `json:"id"`
+	Type  vdcdapi.SensorType `json:"type"`
+	Value *float32           `json:"value"`
+}
+
+type apiInput struct {
+	ID    string   `json:"id"`
+	Type  int      `json:"type"`
+	Value *float32 `json:"value"`
+}
+
+type apiButton struct {
+	Index int    `json:"index"`
+	ID    string `json:"id"`
+}
+
+type apiDevice struct {
+	Tag            string                 `json:"tag"`
+	UniqueID       string                 `json:"uniqueid"`
+	SubDeviceIndex string                 `json:"subdeviceindex,omitempty"`
+	Name           string                 `json:"name"`
+	Backend        string                 `json:"backend,omitempty"`
+	SourceID       string                 `json:"source,omitempty"`
+	Output         vdcdapi.OutputType     `json:"output,omitempty"`
+	Group          vdcdapi.GroupType      `json:"group,omitempty"`
+	ColorClass     vdcdapi.ColorClassType `json:"colorclass,omitempty"`
+	InitDone       bool                   `json:"initdone"`
+	InitFailed     bool                   `json:"initfailed"`
+	InitError      string                 `json:"initerror,omitempty"`
+	Restored       bool                   `json:"restored"`
+	LastUpdate     *time.Time             `json:"lastupdate"`
+	Channels       []apiChannel           `json:"channels"`
+	Sensors        []apiSensor            `json:"sensors,omitempty"`
+	Inputs         []apiInput             `json:"inputs,omitempty"`
+	Buttons        []apiButton            `json:"buttons,omitempty"`
+}
+
+type apiValue struct {
+	Value *float32 `json:"value"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func newAPIDevice(device *vdcdapi.Device) apiDevice {
+	// the values are changed by the backends and the vdcd concurrently
+	snapshot := device.Snapshot()
+
+	result := apiDevice{
+		Tag:            device.Tag,
+		UniqueID:       device.UniqueID,
+		SubDeviceIndex: device.SubDeviceIndex,
+		Name:           device.Name,
+		Backend:        device.Backend,
+		SourceID:       device.SourceID,
+		Output:         device.Output,
+		Group:          device.Group,
+		ColorClass:     device.ColorClass,
+		InitDone:       snapshot.InitDone,
+		InitFailed:     snapshot.InitFailed,
+		Restored:       snapshot.Restored,
+		Channels:       []apiChannel{},
+	}
+
+	if snapshot.InitFailed && snapshot.InitError != nil {
+		result.InitError = snapshot.InitError.Error()
+	}
+
+	if !snapshot.LastUpdate.IsZero() {
+		lastUpdate := snapshot.LastUpdate
+		result.LastUpdate = &lastUpdate
+	}
+
+	for i := range snapshot.Channels {
+		channel := &snapshot.Channels[i]
+		apiChannel := apiChannel{Name: channel.ChannelName, Type: channel.ChannelType, Min: channel.Min, Max: channel.Max, Unit: channel.Unit}
+		if channel.HasValue() {
+			value := channel.Value
+			apiChannel.Value = &value
+		}
+		result.Channels = append(result.Channels, apiChannel)
+	}
+
+	for i := range snapshot.Sensors {
+		sensor := &snapshot.Sensors[i]
+		apiSensor := apiSensor{ID: sensor.Id, Type: sensor.SensorType}
+		if sensor.HasValue() {
+			value := sensor.Value
+			apiSensor.Value = &value
+		}
+		result.Sensors = append(result.Sensors, apiSensor)
+	}
+
+	for i := range snapshot.Inputs {
+		input := &snapshot.Inputs[i]
+		apiInput := apiInput{ID: input.Id, Type: input.InputType}
+		if input.HasValue() {
+			value := input.Value
+			apiInput.Value = &value
+		}
+		result.Inputs = append(result.Inputs, apiInput)
+	}
+
+	for i, button := range device.Buttons {
+		result.Buttons = append(result.Buttons, apiButton{Index: i, ID: button.Id})
+	}
+
+	return result
+}
+
+// adminAPI is the REST API to inspect and control the bridged devices
+type adminAPI struct {
+	bridge *VcdcBridge
+	client *vdcdapi.Client
+}
+
+func (a *adminAPI) routes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/devices", a.listDevices)
+	mux.HandleFunc("GET /api/devices/{tag}", a.getDevice)
+	mux.Handle("DELETE /api/devices/{tag}", sameOrigin(a.removeDevice))
+	mux.Handle("POST /api/devices/{tag}/channels/{channel}", sameOrigin(requireJSON(a.setChannel)))
+	mux.Handle("POST /api/devices/{tag}/buttons/{index}", sameOrigin(requireJSON(a.pressButton)))
+	mux.Handle("POST /api/discovery/{backend}", sameOrigin(requireJSON(a.triggerDiscovery)))
+}
+
+// sameOrigin rejects requests of web pages from other origins, the API is not
+// authenticated and any page opened by the operator could send them otherwise.
+// Requests without Origin and Sec-Fetch-Site, e.g. from curl, are allowed.
+func sameOrigin(handler http.HandlerFunc) http.Handler {
+	protection := http.NewCrossOriginProtection()
+	protection.SetDenyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.WithFields(log.Fields{
+			"Origin": r.Header.Get("Origin"),
+			"Path":   r.URL.Path,
+		}).Warn("Admin API rejected cross-origin request")
+		writeError(w, http.StatusForbidden, errors.New("cross-origin request rejected"))
+	}))
+	return protection.Handler(handler)
+}
+
+// requireJSON rejects POST requests without a JSON body type. Browsers send
+// form and text bodies cross-origin without asking first, a JSON body needs a
+// preflight the admin API never allows.
+func requireJSON(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, errors.New("request content type must be application/json"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// serveAdminAPI serves the admin API and the dashboard on the listen address
+// until the bridge shuts down
+func (e *VcdcBridge) serveAdminAPI(listen string) {
+	listen = adminAPIListenAddress(listen)
+
+	api := &adminAPI{bridge: e, client: e.vdcdClient}
+	mux := http.NewServeMux()
+	api.routes(mux)
+	e.dashboard.routes(mux)
+
+	server := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-e.ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), adminAPIShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.WithError(err).Warn("Failed to shut down admin API")
+		}
+	}()
+
+	log.WithField("Listen", listen).Info("Starting admin API and dashboard")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.WithError(err).Error("Admin API failed")
+	}
+}
+
+// adminAPIListenAddress binds a listen address without host, e.g. ":8080", to
+// localhost. The admin API is not authenticated, it is only reachable from
+// other hosts when a host is given, e.g. "0.0.0.0:8080".
+func adminAPIListenAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil || host != "" {
+		return listen
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func (a *adminAPI) listDevices(w http.ResponseWriter, r *http.Request) {
+	devices := []apiDevice{}
+	for _, device := range a.client.GetDevices() {
+		devices = append(devices, newAPIDevice(device))
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (a *adminAPI) getDevice(w http.ResponseWriter, r *http.Request) {
+	device, ok := a.lookupDevice(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIDevice(device))
+}
+
+func (a *adminAPI) removeDevice(w http.ResponseWriter, r *http.Request) {
+	if err := a.client.RemoveDevice(r.PathValue("tag")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setChannel sets the channel value as if it came from the vdcd, the backend applies it
+func (a *adminAPI) setChannel(w http.ResponseWriter, r *http.Request) {
+	device, ok := a.lookupDevice(w, r)
+	if !ok {
+		return
+	}
+
+	value, ok := readValue(w, r)
+	if !ok {
+		return
+	}
+
+	channelName := r.PathValue("channel")
+	for i := range device.Channels {
+		// only the announced name and type, the value is read under the device lock
+		channel := &device.Channels[i]
+		if channel.ChannelName != channelName {
+			continue
+		}
+
+		message := new(vdcdapi.GenericVDCDMessage)
+		message.MessageType = "channel"
+		message.Tag = device.Tag
+		message.Index = i
+		message.ChannelName = channel.ChannelName
+		message.ChannelType = channel.ChannelType
+		message.Value = value
+
+		log.WithFields(log.Fields{
+			"UniqueID":    device.UniqueID,
+			"ChannelName": channelName,
+			"Value":       value,
+		}).Info("Admin API sets channel value")
+
+		a.client.InjectMessage(message)
+		writeJSON(w, http.StatusOK, newAPIDevice(device))
+		return
+	}
+
+	writeError(w, http.StatusNotFound, vdcdapi.ErrChannelNotFound)
+}
+
+// pressButton sends a button event of the device to the vdcd, the value is the
+// click type (see vdcdapi.ClickType) or 1/0 for pressed/released
+func (a *adminAPI) pressButton(w http.ResponseWriter, r *http.Request) {
+	device, ok := a.lookupDevice(w, r)
+	if !ok {
+		return
+	}
+
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index < 0 || index >= len(device.Buttons) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("button %q not found", r.PathValue("index")))
+		return
+	}
+
+	value, ok := readValue(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.client.SendButtonMessage(value, device.Tag, index); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) triggerDiscovery(w http.ResponseWriter, r *http.Request) {
+	backend := r.PathValue("backend")
+	if err := a.bridge.runDiscovery(backend); err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s: %w", backend, err))
+		return
+	}
+
+	log.WithField("Backend", backend).Info("Admin API triggered discovery")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *adminAPI) lookupDevice(w http.ResponseWriter, r *http.Request) (*vdcdapi.Device, bool) {
+	device, err := a.client.GetDeviceByTag(r.PathValue("tag"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return nil, false
+	}
+	return device, true
+}
+
+// readValue reads a {"value": 42} request body
+func readValue(w http.ResponseWriter, r *http.Request) (float32, bool) {
+	var body apiValue
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Value == nil {
+		writeError(w, http.StatusBadRequest, errors.New(`request body must be {"value": <number>}`))
+		return 0, false
+	}
+	return *body.Value, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		log.WithError(err).Debug("Failed to write admin API response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+)
+
+func TestAdminAPIRejectsCrossOriginChanges(t *testing.T) {
+	client := new(vdcdapi.Client)
+	client.NewCient("localhost", 8999, "test", "test", true)
+
+	mux := http.NewServeMux()
+	(&adminAPI{client: client}).routes(mux)
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		{"json from curl", http.MethodPost, map[string]string{"Content-Type": "application/json"}, http.StatusNotFound},
+		{"json from the dashboard", http.MethodPost, map[string]string{"Content-Type": "application/json; charset=utf-8", "Origin": "http://localhost:8080", "Sec-Fetch-Site": "same-origin"}, http.StatusNotFound},
+		{"form post", http.MethodPost, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, http.StatusUnsupportedMediaType},
+		{"text post", http.MethodPost, map[string]string{"Content-Type": "text/plain"}, http.StatusUnsupportedMediaType},
+		{"no content type", http.MethodPost, nil, http.StatusUnsupportedMediaType},
+		{"other origin", http.MethodPost, map[string]string{"Content-Type": "application/json", "Origin": "http://evil.example"}, http.StatusForbidden},
+		{"other site", http.MethodPost, map[string]string{"Content-Type": "application/json", "Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"delete from other origin", http.MethodDelete, map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"delete from curl", http.MethodDelete, nil, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/api/devices/unknown/channels/brightness"
+			if tt.method == http.MethodDelete {
+				path = "/api/devices/unknown"
+			}
+
+			request := httptest.NewRequest(tt.method, "http://localhost:8080"+path, strings.NewReader(`{"value": 50}`))
+			for key, value := range tt.headers {
+				request.Header.Set(key, value)
+			}
+
+			response := httptest.NewRecorder()
+			mux.ServeHTTP(response, request)
+
+			// not found means the request passed the checks and reached the handler
+			if response.Code != tt.status {
+				t.Errorf("expected status %d, got %d: %s", tt.status, response.Code, response.Body.String())
+			}
+		})
+	}
+}
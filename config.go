@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akamensky/argparse"
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables overriding config keys, e.g. VDCD_BRIDGE_DECONZ_HOST for deconz.host
+const envConfigPrefix = "VDCD_BRIDGE_"
+
+type configKind int
+
+const (
+	configString configKind = iota
+	configInt
+	configBool
+	configList // comma separated in flags and environment, a list in the config file
+)
+
+// configKey is a setting of the bridge, which can be set in the config file,
+// with a flag and with an environment variable
+type configKey struct {
+	key          string // path in the config file, e.g. deconz.host
+	short        string
+	flag         string
+	kind         configKind
+	inverted     bool // the flag disables what the key enables, e.g. --wledDisabled for wled.enabled
+	defaultValue string
+	help         string
+}
+
+var configKeys = []configKey{
+	{key: "vdcd.host", short: "H", flag: "host", help: "vdcd Host to connect to"},
+	{key: "vdcd.port", short: "p", flag: "port", kind: configInt, defaultValue: "8999", help: "Port of your vdcd host"},
+	{key: "vdcd.modelname", flag: "modelname", defaultValue: "go-client", help: "modelName to Announce"},
+	{key: "vdcd.vendorname", flag: "vendorName", defaultValue: "go-client", help: "vendorName to Announce"},
+	{key: "vdcd.iconname", flag: "iconname", defaultValue: "vdc_ext", help: "Icon of the vdc in the dSS"},
+	{key: "vdcd.configurl", flag: "configurl", help: "URL of the bridge configuration, shown for the vdc in the dSS"},
+
+	{key: "drymode", flag: "dryMode", kind: configBool, defaultValue: "false", help: "only Discover, no adding"},
+	{key: "scenemappings", flag: "scenemappings", help: "JSON file mapping dS scene commands to backend scenes/presets per device uniqueid"},
+	{key: "overrides", flag: "overrides", help: "YAML file with device overrides (name, group, color class, output, icon, ignore) by uniqueid, glob or backend and source id"},
+	{key: "store", flag: "store", help: "JSON file persisting the known devices, their last values and the overrides across restarts"},
+	{key: "http.listen", flag: "http-listen", help: "Listen address of the admin API and the dashboard, e.g. :8080 (localhost only, not authenticated) or 0.0.0.0:8080 for all interfaces"},
+	{key: "record", flag: "record", help: "Record all messages exchanged with the vdcd to this JSONL file, see 'replay'"},
+
+	{key: "mqtt.host", flag: "mqtthost", help: "MQTT Host to connect to"},
+	{key: "mqtt.username", flag: "mqttusername", help: "MQTT Username"},
+	{key: "mqtt.password", flag: "mqttpassword", help: "MQTT Password"},
+
+	{key: "tasmota.enabled", flag: "tasmotaDisabled", kind: configBool, inverted: true, defaultValue: "true", help: "disable Tasmota discovery"},
+
+	{key: "shelly.enabled", flag: "shellyDisabled", kind: configBool, inverted: true, defaultValue: "true", help: "disable Shelly discovery"},
+
+	{key: "zigbee2mqtt.enabled", flag: "zigbee2mqtt", kind: configBool, inverted: true, defaultValue: "true", help: "disable zigbee2mqtt discovery"},
+	{key: "zigbee2mqtt.basetopic", flag: "zigbee2mqtt-basetopic", defaultValue: "zigbee2mqtt", help: "zigbee2mqtt base topic"},
+
+	{key: "deconz.enabled", flag: "deconzDisabled", kind: configBool, inverted: true, defaultValue: "true", help: "disable Deconz discovery"},
+	{key: "deconz.host", flag: "deconzhost", help: "Deconz Host IP"},
+	{key: "deconz.port", flag: "deconzport", kind: configInt, help: "Deconz Port"},
+	{key: "deconz.websocketport", flag: "deconzwebsocketport", kind: configInt, help: "Deconz Websocket Port"},
+	{key: "deconz.api", flag: "deconzapi", help: "Deconz API"},
+	{key: "deconz.groups", flag: "deconz-groupEnabled", kind: configBool, defaultValue: "false", help: "Deconz, enable adding Groups"},
+
+	{key: "wled.enabled", flag: "wledDisabled", kind: configBool, inverted: true, defaultValue: "true", help: "disable WLED discovery"},
+	{key: "wled.hosts", flag: "wledhosts", kind: configList, help: "WLED hosts to add in addition to the ones found with mDNS, comma separated"},
+
+	{key: "homeassistant.enabled", flag: "homeassistantDisabled", kind: configBool, inverted: true, defaultValue: "true", help: "disable Home Assistant discovery"},
+	{key: "homeassistant.url", flag: "homeassistant-url", help: "Home Assistant base URL (e.g. http://homeassistant.local:8123)"},
+	{key: "homeassistant.token", flag: "homeassistant-token", help: "Home Assistant long-lived access token"},
+	{key: "homeassistant.label", flag: "homeassistant-label", defaultValue: "digitalstrom", help: "Label of the Home Assistant entities to bridge"},
+}
+
+// configValues are the merged settings by config key
+type configValues map[string]string
+
+// configFlags holds the registered flags of the config keys
+type configFlags struct {
+	stringValues map[string]*string
+	boolValues   map[string]*bool
+	args         map[string]argparse.Arg
+}
+
+func lookupConfigKey(key string) (configKey, bool) {
+	for _, configKey := range configKeys {
+		if configKey.key == key {
+			return configKey, true
+		}
+	}
+	return configKey{}, false
+}
+
+// envName returns the environment variable of the key, e.g. VDCD_BRIDGE_DECONZ_HOST
+func (k configKey) envName() string {
+	return envConfigPrefix + strings.ToUpper(strings.ReplaceAll(k.key, ".", "_"))
+}
+
+// describe names the key and where it can be set, for validation errors
+func (k configKey) describe() string {
+	return fmt.Sprintf("%s (--%s, %s)", k.key, k.flag, k.envName())
+}
+
+// registerConfigFlags adds a flag for every config key. Values and defaults
+// are resolved in loadConfigValues, so flags which are not set do not override the config file.
+func registerConfigFlags(p *argparse.Parser) *configFlags {
+	flags := &configFlags{
+		stringValues: make(map[string]*string),
+		boolValues:   make(map[string]*bool),
+		args:         make(map[string]argparse.Arg),
+	}
+
+	for _, key := range configKeys {
+		help := key.help
+		if key.defaultValue != "" && key.kind != configBool {
+			help = fmt.Sprintf("%s. Default: %s", help, key.defaultValue)
+		}
+
+		if key.kind == configBool {
+			flags.boolValues[key.key] = p.Flag(key.short, key.flag, &argparse.Options{Required: false, Help: help})
+		} else {
+			flags.stringValues[key.key] = p.String(key.short, key.flag, &argparse.Options{Required: false, Help: help})
+		}
+	}
+
+	for _, arg := range p.GetArgs() {
+		for _, key := range configKeys {
+			if arg.GetLname() == key.flag {
+				flags.args[key.key] = arg
+			}
+		}
+	}
+
+	return flags
+}
+
+// loadConfigValues merges the defaults, the config file, the flags and the
+// environment, the later overriding the former
+func loadConfigValues(configFile string, flags *configFlags) (configValues, error) {
+	values := make(configValues)
+
+	for _, key := range configKeys {
+		if key.defaultValue != "" {
+			values[key.key] = key.defaultValue
+		}
+	}
+
+	if configFile != "" {
+		fileValues, err := readConfigFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range fileValues {
+			values[key] = value
+		}
+	}
+
+	for _, key := range configKeys {
+		arg, ok := flags.args[key.key]
+		if !ok || !arg.GetParsed() {
+			continue
+		}
+
+		if key.kind == configBool {
+			values[key.key] = strconv.FormatBool(*flags.boolValues[key.key] != key.inverted)
+		} else {
+			values[key.key] = *flags.stringValues[key.key]
+		}
+	}
+
+	for _, key := range configKeys {
+		if value, ok := os.LookupEnv(key.envName()); ok {
+			values[key.key] = value
+		}
+	}
+
+	return values, nil
+}
+
+// readConfigFile reads a YAML config file with a section per backend, e.g.
+//
+//	deconz:
+//	  host: 192.168.1.10
+//	  port: 80
+//
+// and returns its values by config key
+func readConfigFile(path string) (configValues, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	values := make(configValues)
+	if err := flattenConfig("", document, values); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return values, nil
+}
+
+func flattenConfig(prefix string, document map[string]interface{}, values configValues) error {
+	// sorted for a stable error on several unknown keys
+	names := make([]string, 0, len(document))
+	for name := range document {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := strings.ToLower(name)
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+
+		if section, ok := document[name].(map[string]interface{}); ok {
+			if err := flattenConfig(path, section, values); err != nil {
+				return err
+			}
+			continue
+		}
+
+		key, ok := lookupConfigKey(path)
+		if !ok {
+			return fmt.Errorf("unknown key %s", path)
+		}
+
+		switch value := document[name].(type) {
+		case nil:
+			values[path] = ""
+		case []interface{}:
+			if key.kind != configList {
+				return fmt.Errorf("%s must not be a list", path)
+			}
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[path] = strings.Join(items, ",")
+		default:
+			values[path] = fmt.Sprint(value)
+		}
+	}
+
+	return nil
+}
+
+func (v configValues) string(key string) string {
+	return strings.TrimSpace(v[key])
+}
+
+func (v configValues) int(key string) (int, error) {
+	value := v.string(key)
+	if value == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		configKey, _ := lookupConfigKey(key)
+		return 0, fmt.Errorf("%s must be a number, got %q", configKey.describe(), value)
+	}
+	return i, nil
+}
+
+func (v configValues) bool(key string) (bool, error) {
+	value := v.string(key)
+	if value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		configKey, _ := lookupConfigKey(key)
+		return false, fmt.Errorf("%s must be true or false, got %q", configKey.describe(), value)
+	}
+	return b, nil
+}
+
+func (v configValues) list(key string) []string {
+	var items []string
+	for _, item := range strings.Split(v[key], ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// require returns an error naming the first of the keys without a value
+func (v configValues) require(reason string, keys ...string) error {
+	for _, key := range keys {
+		if v.string(key) == "" || v.string(key) == "0" {
+			configKey, _ := lookupConfigKey(key)
+			return errors.New(strings.TrimSpace(configKey.describe() + " is required " + reason))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/akamensky/argparse"
+	"gopkg.in/yaml.v3"
+)
+
+func TestLoadConfigValuesPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		args     []string
+		env      map[string]string
+		key      string
+		expected string
+	}{
+		{"default", "", nil, nil, "vdcd.port", "8999"},
+		{"file over default", "vdcd:\n  port: 9000\n", nil, nil, "vdcd.port", "9000"},
+		{"flag over file", "vdcd:\n  port: 9000\n", []string{"--port", "9001"}, nil, "vdcd.port", "9001"},
+		{"env over flag", "vdcd:\n  port: 9000\n", []string{"--port", "9001"}, map[string]string{"VDCD_BRIDGE_VDCD_PORT": "9002"}, "vdcd.port", "9002"},
+		{"env over file", "vdcd:\n  port: 9000\n", nil, map[string]string{"VDCD_BRIDGE_VDCD_PORT": "9002"}, "vdcd.port", "9002"},
+		{"unset flag keeps the file", "deconz:\n  host: 192.168.1.10\n", []string{"--port", "9001"}, nil, "deconz.host", "192.168.1.10"},
+		{"unset bool flag keeps the file", "wled:\n  enabled: false\n", nil, nil, "wled.enabled", "false"},
+		{"inverted flag", "wled:\n  enabled: true\n", []string{"--wledDisabled"}, nil, "wled.enabled", "false"},
+		{"bool flag", "", []string{"--dryMode"}, nil, "drymode", "true"},
+		{"list from the file", "wled:\n  hosts: [wled-1, wled-2]\n", nil, nil, "wled.hosts", "wled-1,wled-2"},
+		{"list from env", "", nil, map[string]string{"VDCD_BRIDGE_WLED_HOSTS": "wled-3"}, "wled.hosts", "wled-3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			configFile := ""
+			if tt.file != "" {
+				configFile = filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(configFile, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p := argparse.NewParser("vdcd", "test")
+			flags := registerConfigFlags(p)
+			if err := p.Parse(append([]string{"vdcd"}, tt.args...)); err != nil {
+				t.Fatalf("invalid flags: %s", err)
+			}
+
+			values, err := loadConfigValues(configFile, flags)
+			if err != nil {
+				t.Fatalf("load failed: %s", err)
+			}
+			if values[tt.key] != tt.expected {
+				t.Errorf("expected %s=%q, got %q", tt.key, tt.expected, values[tt.key])
+			}
+		})
+	}
+}
+
+func TestFlattenConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		expected configValues
+		err      string
+	}{
+		{"sections", "vdcd:\n  host: localhost\n  port: 8999\n", configValues{"vdcd.host": "localhost", "vdcd.port": "8999"}, ""},
+		{"keys are case insensitive", "Deconz:\n  WebsocketPort: 443\n", configValues{"deconz.websocketport": "443"}, ""},
+		{"top level key", "drymode: true\n", configValues{"drymode": "true"}, ""},
+		{"empty value", "vdcd:\n  configurl:\n", configValues{"vdcd.configurl": ""}, ""},
+		{"list", "wled:\n  hosts:\n    - wled-1\n    - 10.0.0.2\n", configValues{"wled.hosts": "wled-1,10.0.0.2"}, ""},
+		{"unknown key", "deconz:\n  hots: 192.168.1.10\n", nil, "unknown key deconz.hots"},
+		{"unknown section", "hue:\n  host: 192.168.1.10\n", nil, "unknown key hue.host"},
+		{"first unknown key", "zzz: 1\naaa: 1\n", nil, "unknown key aaa"},
+		{"list of a string key", "vdcd:\n  host: [a, b]\n", nil, "vdcd.host must not be a list"},
+		{"list of a bool key", "wled:\n  enabled:\n    - true\n", nil, "wled.enabled must not be a list"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var document map[string]interface{}
+			if err := yaml.Unmarshal([]byte(tt.document), &document); err != nil {
+				t.Fatal(err)
+			}
+
+			values := make(configValues)
+			err := flattenConfig("", document, values)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if len(values) != len(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, values)
+			}
+			for key, value := range tt.expected {
+				if values[key] != value {
+					t.Errorf("expected %s=%q, got %q", key, value, values[key])
+				}
+			}
+		})
+	}
+}
+
+func TestConfigValidationErrors(t *testing.T) {
+	values := configValues{"vdcd.port": "abc", "drymode": "maybe", "deconz.host": "192.168.1.10", "deconz.port": "0"}
+
+	tests := []struct {
+		name     string
+		validate func() error
+		expected string
+	}{
+		{"number", func() error { _, err := values.int("vdcd.port"); return err }, `vdcd.port (--port, VDCD_BRIDGE_VDCD_PORT) must be a number, got "abc"`},
+		{"bool", func() error { _, err := values.bool("drymode"); return err }, `drymode (--dryMode, VDCD_BRIDGE_DRYMODE) must be true or false, got "maybe"`},
+		{"required", func() error { return values.require("", "vdcd.host") }, "vdcd.host (--host, VDCD_BRIDGE_VDCD_HOST) is required"},
+		{"required with reason", func() error {
+			return values.require("when deconz discovery is enabled", "deconz.host", "deconz.port", "deconz.api")
+		}, "deconz.port (--deconzport, VDCD_BRIDGE_DECONZ_PORT) is required when deconz discovery is enabled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.validate()
+			if err == nil || err.Error() != tt.expected {
+				t.Fatalf("expected %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// Number of messages exchanged with the vdcd the dashboard keeps
+const protocolLogSize = 200
+
+// How often the backend status is pushed to the dashboard
+const dashboardStatusInterval = 5 * time.Second
+
+// Events queued for a dashboard before further events are dropped
+const dashboardEventBuffer = 256
+
+type dashboardEvent struct {
+	name string
+	data []byte
+}
+
+type apiRemovedDevice struct {
+	Tag string `json:"tag"`
+}
+
+type apiBackendStatus struct {
+	Backend string `json:"backend"`
+	// nil for backends without a persistent connection
+	Connected     *bool      `json:"connected,omitempty"`
+	LastDiscovery *time.Time `json:"lastdiscovery,omitempty"`
+}
+
+// dashboard serves the embedded web UI and pushes device changes, the messages
+// exchanged with the vdcd and the backend status as server-sent events
+type dashboard struct {
+	bridge *VcdcBridge
+
+	mu          sync.Mutex
+	subscribers map[chan dashboardEvent]struct{}
+	protocolLog []vdcdapi.RecordedMessage
+
+	// device changes are reported concurrently, the snapshot of a device is
+	// taken and published in one step so no older state follows a newer one
+	changeMu sync.Mutex
+}
+
+func newDashboard(bridge *VcdcBridge) *dashboard {
+	return &dashboard{
+		bridge:      bridge,
+		subscribers: make(map[chan dashboardEvent]struct{}),
+	}
+}
+
+func (d *dashboard) routes(mux *http.ServeMux) {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		log.WithError(err).Error("Failed to load dashboard files")
+		return
+	}
+
+	mux.Handle("GET /", http.FileServerFS(files))
+	mux.HandleFunc("GET /api/events", d.events)
+	mux.HandleFunc("GET /api/status", d.getStatus)
+	mux.HandleFunc("GET /api/log", d.getLog)
+}
+
+// Write keeps a message recorded by the vdcd client, see vdcdapi.Client.SetRecorder
+func (d *dashboard) Write(p []byte) (int, error) {
+	line := bytes.TrimSpace(p)
+
+	var message vdcdapi.RecordedMessage
+	if err := json.Unmarshal(line, &message); err != nil {
+		// not shown, but the recording to a file goes on
+		log.WithError(err).Debug("Failed to Unmarshall recorded message for the dashboard")
+		return len(p), nil
+	}
+
+	d.mu.Lock()
+	if len(d.protocolLog) >= protocolLogSize {
+		d.protocolLog = append(d.protocolLog[:0], d.protocolLog[1:]...)
+	}
+	d.protocolLog = append(d.protocolLog, message)
+	d.mu.Unlock()
+
+	d.publish("log", append([]byte(nil), line...))
+
+	return len(p), nil
+}
+
+// deviceChanged pushes a snapshot of the device, or its removal, to the dashboards
+func (d *dashboard) deviceChanged(device *vdcdapi.Device) {
+	if !d.hasSubscribers() {
+		return
+	}
+
+	d.changeMu.Lock()
+	defer d.changeMu.Unlock()
+
+	registered, err := d.bridge.vdcdClient.GetDeviceByTag(device.Tag)
+	if err != nil {
+		d.publishJSON("removed", apiRemovedDevice{Tag: device.Tag})
+		return
+	}
+
+	// a device replaced by a newer announcement of its backend
+	if registered != device {
+		return
+	}
+
+	// newAPIDevice reads the values through device.Snapshot, under the device lock
+	d.publishJSON("device", newAPIDevice(device))
+}
+
+func (d *dashboard) hasSubscribers() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.subscribers) > 0
+}
+
+func (d *dashboard) subscribe() chan dashboardEvent {
+	events := make(chan dashboardEvent, dashboardEventBuffer)
+
+	d.mu.Lock()
+	d.subscribers[events] = struct{}{}
+	d.mu.Unlock()
+
+	return events
+}
+
+func (d *dashboard) unsubscribe(events chan dashboardEvent) {
+	d.mu.Lock()
+	delete(d.subscribers, events)
+	d.mu.Unlock()
+}
+
+// publish sends the event to all dashboards, a dashboard not keeping up misses it
+func (d *dashboard) publish(name string, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for events := range d.subscribers {
+		select {
+		case events <- dashboardEvent{name: name, data: data}:
+		default:
+			log.WithField("Event", name).Debug("Dashboard too slow, dropping event")
+		}
+	}
+}
+
+func (d *dashboard) publishJSON(name string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.WithError(err).WithField("Event", name).Error("Failed to Marshall dashboard event")
+		return
+	}
+	d.publish(name, data)
+}
+
+// events streams the device changes, the protocol log and the backend status
+// as server-sent events until the dashboard disconnects
+func (d *dashboard) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	events := d.subscribe()
+	defer d.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	status, _ := json.Marshal(d.bridge.backendStatus())
+	writeEvent(w, dashboardEvent{name: "status", data: status})
+	flusher.Flush()
+
+	ticker := time.NewTicker(dashboardStatusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-d.bridge.ctx.Done():
+			return
+		case event := <-events:
+			writeEvent(w, event)
+		case <-ticker.C:
+			status, _ := json.Marshal(d.bridge.backendStatus())
+			writeEvent(w, dashboardEvent{name: "status", data: status})
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event dashboardEvent) {
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.name, event.data); err != nil {
+		log.WithError(err).Debug("Failed to write dashboard event")
+	}
+}
+
+func (d *dashboard) getStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.bridge.backendStatus())
+}
+
+func (d *dashboard) getLog(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	messages := append([]vdcdapi.RecordedMessage{}, d.protocolLog...)
+	d.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, messages)
+}
+
+// backendStatus returns the connection state of the vdcd, the MQTT broker and
+// the backends and when their discovery ran last
+func (e *VcdcBridge) backendStatus() []apiBackendStatus {
+	vdcdConnected := e.vdcdClient.IsConnected()
+	status := []apiBackendStatus{{Backend: "vdcd", Connected: &vdcdConnected}}
+
+	if e.config.mqttDiscoveryEnabled && e.mqttClient != nil {
+		mqttConnected := e.mqttClient.IsConnected()
+		status = append(status, apiBackendStatus{Backend: "mqtt", Connected: &mqttConnected})
+	}
+
+	e.discoveriesMu.Lock()
+	defer e.discoveriesMu.Unlock()
+
+	for _, entry := range e.discoveries {
+		backend := apiBackendStatus{Backend: entry.backend}
+		if entry.connected != nil {
+			connected := entry.connected()
+			backend.Connected = &connected
+		}
+		if !entry.lastRun.IsZero() {
+			lastRun := entry.lastRun
+			backend.LastDiscovery = &lastRun
+		}
+		status = append(status, backend)
+	}
+
+	return status
+}
@@ -0,0 +1,231 @@
+"use strict";
+
+// Messages of the protocol log shown, the bridge keeps the same number
+const maxLogEntries = 200;
+
+const devices = new Map();
+let logPaused = false;
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [name, value] of Object.entries(attrs || {})) {
+    if (name.startsWith("on")) {
+      node.addEventListener(name.slice(2), value);
+    } else if (value !== undefined && value !== null && value !== false) {
+      node.setAttribute(name, value === true ? "" : value);
+    }
+  }
+  for (const child of children) {
+    if (child !== undefined && child !== null) {
+      node.append(child);
+    }
+  }
+  return node;
+}
+
+function formatTime(value) {
+  return value ? new Date(value).toLocaleTimeString() : "";
+}
+
+function formatValue(value, unit) {
+  if (value === null || value === undefined) {
+    return "-";
+  }
+  const rounded = Math.round(value * 100) / 100;
+  return unit === "percent" ? rounded + "%" : unit ? rounded + " " + unit : String(rounded);
+}
+
+async function setChannel(device, channel, value) {
+  const response = await fetch(
+    "api/devices/" + encodeURIComponent(device.tag) + "/channels/" + encodeURIComponent(channel.name),
+    {method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify({value: value})},
+  );
+  if (!response.ok) {
+    const body = await response.json().catch(() => ({}));
+    alert("Setting " + channel.name + " of " + device.name + " failed: " + (body.error || response.status));
+  }
+}
+
+// channelControl is a toggle for the on/off channel, a slider for everything else
+function channelControl(device, channel) {
+  const min = channel.min || 0;
+  const max = channel.max || 100;
+  const value = channel.value === null ? min : channel.value;
+
+  if (channel.name === "basic_switch") {
+    return el("input", {
+      type: "checkbox",
+      checked: value > min,
+      disabled: device.restored,
+      onchange: (event) => setChannel(device, channel, event.target.checked ? max : min),
+    });
+  }
+
+  const output = el("span", {class: "small"}, formatValue(channel.value, channel.unit));
+  const slider = el("input", {
+    type: "range",
+    min: min,
+    max: max,
+    step: max - min <= 2 ? "any" : 1,
+    value: value,
+    disabled: device.restored,
+    oninput: (event) => { output.textContent = formatValue(Number(event.target.value), channel.unit); },
+    onchange: (event) => setChannel(device, channel, Number(event.target.value)),
+  });
+  return el("span", {}, slider, " ", output);
+}
+
+function deviceState(device) {
+  if (device.restored) {
+    return el("span", {class: "restored", title: "Restored from the store, not yet announced by its backend"}, "restored");
+  }
+  if (device.initfailed) {
+    return el("span", {class: "failed", title: device.initerror || ""}, "init failed");
+  }
+  return device.initdone ? "ok" : "pending";
+}
+
+function deviceRow(device) {
+  const channels = el("td");
+  for (const channel of device.channels) {
+    channels.append(el("div", {class: "channel"}, el("label", {}, channel.name), channelControl(device, channel)));
+  }
+
+  const values = el("td");
+  for (const sensor of device.sensors || []) {
+    values.append(el("div", {}, sensor.id + ": " + formatValue(sensor.value)));
+  }
+  for (const input of device.inputs || []) {
+    values.append(el("div", {}, input.id + ": " + (input.value === null ? "-" : input.value ? "active" : "inactive")));
+  }
+
+  return el("tr", {id: "device-" + device.tag},
+    el("td", {}, device.name, el("div", {class: "small"}, device.uniqueid)),
+    el("td", {}, device.source || "", el("div", {class: "small"}, device.output || "")),
+    el("td", {}, deviceState(device)),
+    channels,
+    values,
+    el("td", {class: "small"}, formatTime(device.lastupdate)),
+  );
+}
+
+function renderDevices() {
+  const container = document.getElementById("devices");
+  container.replaceChildren();
+
+  if (devices.size === 0) {
+    container.append(el("p", {class: "empty"}, "No devices"));
+    return;
+  }
+
+  const backends = new Map();
+  for (const device of devices.values()) {
+    const backend = device.backend || "unknown";
+    if (!backends.has(backend)) {
+      backends.set(backend, []);
+    }
+    backends.get(backend).push(device);
+  }
+
+  for (const backend of [...backends.keys()].sort()) {
+    const rows = backends.get(backend).sort((a, b) => a.name.localeCompare(b.name));
+    container.append(el("table", {},
+      el("caption", {}, backend + " (" + rows.length + ")"),
+      el("thead", {}, el("tr", {},
+        el("th", {}, "Name"), el("th", {}, "Source"), el("th", {}, "State"),
+        el("th", {}, "Channels"), el("th", {}, "Sensors / Inputs"), el("th", {}, "Last update"))),
+      el("tbody", {}, ...rows.map(deviceRow)),
+    ));
+  }
+}
+
+function updateDevice(device) {
+  const previous = devices.get(device.tag);
+  devices.set(device.tag, device);
+
+  const row = document.getElementById("device-" + device.tag);
+  if (!row || !previous || previous.backend !== device.backend || previous.name !== device.name) {
+    renderDevices();
+    return;
+  }
+
+  // do not move a slider away while it is dragged
+  if (row.contains(document.activeElement) && document.activeElement.type === "range") {
+    return;
+  }
+
+  const updated = deviceRow(device);
+  updated.classList.add("flash");
+  row.replaceWith(updated);
+  setTimeout(() => updated.classList.remove("flash"), 500);
+}
+
+function renderStatus(status) {
+  const list = document.getElementById("status");
+  list.replaceChildren();
+  for (const backend of status) {
+    const state = backend.connected === undefined ? "" : backend.connected ? "up" : "down";
+    const title = backend.connected === undefined ? "no persistent connection" : backend.connected ? "connected" : "disconnected";
+    list.append(el("li", {class: state, title: title},
+      backend.backend,
+      backend.lastdiscovery ? el("span", {class: "when"}, " discovery " + formatTime(backend.lastdiscovery)) : null,
+    ));
+  }
+}
+
+function appendLog(message) {
+  if (logPaused) {
+    return;
+  }
+
+  const log = document.getElementById("log");
+  const atBottom = log.scrollTop + log.clientHeight >= log.scrollHeight - 5;
+
+  log.append(el("li", {class: message.direction},
+    formatTime(message.time) + " " + (message.direction === "in" ? "<- " : "-> ") + JSON.stringify(message.message)));
+  while (log.childElementCount > maxLogEntries) {
+    log.firstElementChild.remove();
+  }
+
+  if (atBottom) {
+    log.scrollTop = log.scrollHeight;
+  }
+}
+
+async function load() {
+  const [deviceList, messages, status] = await Promise.all([
+    fetch("api/devices").then((response) => response.json()),
+    fetch("api/log").then((response) => response.json()),
+    fetch("api/status").then((response) => response.json()),
+  ]);
+
+  devices.clear();
+  for (const device of deviceList) {
+    devices.set(device.tag, device);
+  }
+  renderDevices();
+
+  document.getElementById("log").replaceChildren();
+  messages.forEach(appendLog);
+  renderStatus(status);
+}
+
+function listen() {
+  const events = new EventSource("api/events");
+  events.addEventListener("device", (event) => updateDevice(JSON.parse(event.data)));
+  events.addEventListener("removed", (event) => {
+    devices.delete(JSON.parse(event.data).tag);
+    renderDevices();
+  });
+  events.addEventListener("log", (event) => appendLog(JSON.parse(event.data)));
+  events.addEventListener("status", (event) => renderStatus(JSON.parse(event.data)));
+  // changes missed while disconnected
+  events.addEventListener("open", () => load().catch(console.error));
+}
+
+document.getElementById("log-pause").addEventListener("click", (event) => {
+  logPaused = !logPaused;
+  event.target.textContent = logPaused ? "Resume" : "Pause";
+});
+
+listen();
@@ -9,6 +9,7 @@ require (
 	github.com/hashicorp/mdns v1.0.6
 	github.com/jurgen-kluft/go-conbee v0.0.0-20211124004556-1d2ff903ea59
 	github.com/sirupsen/logrus v1.9.4
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
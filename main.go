@@ -17,35 +17,16 @@ func main() {
 	logLevel := getLogLevel()
 	log.SetLevel(logLevel)
 
-	p := argparse.NewParser("vdcd", "Use Tasmota/Shelly as exernal device for a plan44.ch vdcd")
-
-	host := p.String("H", "host", &argparse.Options{Required: true, Help: "vdcd Host to connect to"})
-	port := p.Int("p", "port", &argparse.Options{Required: false, Help: "Port of your vdcd host", Default: 8999})
-
-	modelName := p.String("", "modelname", &argparse.Options{Required: false, Help: "modelName to Announce", Default: "go-client"})
-	vendorName := p.String("", "vendorName", &argparse.Options{Required: false, Help: "vendorName to Announce", Default: "go-client"})
-
-	dryMode := p.Flag("", "dryMode", &argparse.Options{Required: false, Help: "only Discover, no adding"})
-
-	mqttHost := p.String("", "mqtthost", &argparse.Options{Required: false, Help: "MQTT Host to connect to"})
-	mqttUsername := p.String("", "mqttusername", &argparse.Options{Required: false, Help: "MQTT Username"})
-	mqttPassword := p.String("", "mqttpassword", &argparse.Options{Required: false, Help: "MQTT Password"})
-
-	homeassistantURL := p.String("", "homeassistant-url", &argparse.Options{Required: false, Help: "Home Assistant base URL (e.g. http://homeassistant.local:8123)"})
-	homeassistantToken := p.String("", "homeassistant-token", &argparse.Options{Required: false, Help: "Home Assistant long-lived access token"})
+	// vdcd-bridge replay -f session.jsonl
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[1:])
+		return
+	}
 
-	deconzHost := p.String("", "deconzhost", &argparse.Options{Required: false, Help: "Deconz Host IP"})
-	deconzPort := p.Int("", "deconzport", &argparse.Options{Required: false, Help: "Deconz Port"})
-	deconzWebSocketPort := p.Int("", "deconzwebsocketport", &argparse.Options{Required: false, Help: "Deconz Websocket Port"})
-	deconzAPI := p.String("", "deconzapi", &argparse.Options{Required: false, Help: "Deconz API"})
-	deconzEnableGroups := p.Flag("", "deconz-groupEnabled", &argparse.Options{Required: false, Help: "Deconz, enable adding Groups"})
+	p := argparse.NewParser("vdcd", "Use Tasmota/Shelly as exernal device for a plan44.ch vdcd")
 
-	tasmotaDisabled := p.Flag("", "tasmotaDisabled", &argparse.Options{Required: false, Help: "disable Tasmota discovery"})
-	shellyDisabled := p.Flag("", "shellyDisabled", &argparse.Options{Required: false, Help: "disable Shelly discovery"})
-	deconzDisabled := p.Flag("", "deconzDisabled", &argparse.Options{Required: false, Help: "disable Deconz discovery"})
-	zigbee2mqttDisabled := p.Flag("", "zigbee2mqtt", &argparse.Options{Required: false, Help: "disable zigbee2mqtt discovery"})
-	wledDisabled := p.Flag("", "wledDisabled", &argparse.Options{Required: false, Help: "disable WLED discovery"})
-	homeassistantDisabled := p.Flag("", "homeassistantDisabled", &argparse.Options{Required: false, Help: "disable Home Assistant discovery"})
+	configFile := p.String("c", "config", &argparse.Options{Required: false, Help: "YAML config file, flags and " + envConfigPrefix + "* environment variables take precedence"})
+	flags := registerConfigFlags(p)
 
 	err := p.Parse(os.Args)
 	if err != nil {
@@ -55,29 +36,13 @@ func main() {
 		os.Exit(1)
 	}
 
-	config, err := buildConfig(
-		*host,
-		*port,
-		*modelName,
-		*vendorName,
-		*dryMode,
-		*mqttHost,
-		*mqttUsername,
-		*mqttPassword,
-		*homeassistantURL,
-		*homeassistantToken,
-		*deconzHost,
-		*deconzPort,
-		*deconzWebSocketPort,
-		*deconzAPI,
-		*deconzEnableGroups,
-		*tasmotaDisabled,
-		*shellyDisabled,
-		*deconzDisabled,
-		*zigbee2mqttDisabled,
-		*wledDisabled,
-		*homeassistantDisabled,
-	)
+	values, err := loadConfigValues(strings.TrimSpace(*configFile), flags)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	config, err := buildConfig(values)
 	if err != nil {
 		log.Error(err)
 		os.Exit(1)
@@ -103,73 +68,88 @@ func getLogLevel() log.Level {
 	return level
 }
 
-func buildConfig(
-	host string,
-	port int,
-	modelName string,
-	vendorName string,
-	dryMode bool,
-	mqttHost string,
-	mqttUsername string,
-	mqttPassword string,
-	homeassistantURL string,
-	homeassistantToken string,
-	deconzHost string,
-	deconzPort int,
-	deconzWebSocketPort int,
-	deconzAPI string,
-	deconzEnableGroups bool,
-	tasmotaDisabled bool,
-	shellyDisabled bool,
-	deconzDisabled bool,
-	zigbee2mqttDisabled bool,
-	wledDisabled bool,
-	homeassistantDisabled bool,
-) (*VcdcBridgeConfig, error) {
+// buildConfig maps the merged config values onto the bridge config and
+// validates them, errors name the offending config key
+func buildConfig(values configValues) (*VcdcBridgeConfig, error) {
+	var err error
+
 	config := new(VcdcBridgeConfig)
-	config.host = strings.TrimSpace(host)
-	config.port = port
-	config.modelName = strings.TrimSpace(modelName)
-	config.vendorName = strings.TrimSpace(vendorName)
-	config.dryMode = dryMode
-
-	config.mqttHost = strings.TrimSpace(mqttHost)
-	config.mqttUsername = strings.TrimSpace(mqttUsername)
-	config.mqttPassword = mqttPassword
-
-	config.homeassistantURL = strings.TrimSpace(homeassistantURL)
-	config.homeassistantToken = strings.TrimSpace(homeassistantToken)
-
-	config.deconzHost = strings.TrimSpace(deconzHost)
-	config.deconzPort = deconzPort
-	config.deconcWebSockerPort = deconzWebSocketPort
-	config.deconzApi = strings.TrimSpace(deconzAPI)
-	config.deconzEnableGroups = deconzEnableGroups
-
-	config.tasmotaDisabled = tasmotaDisabled
-	config.shellyDisabled = shellyDisabled
-	config.deconzDisabled = deconzDisabled
-	config.zigbee2mqttDisabled = zigbee2mqttDisabled
-	config.wledDisabled = wledDisabled
-	config.homeassistantDisabled = homeassistantDisabled
+	config.host = values.string("vdcd.host")
+	if config.port, err = values.int("vdcd.port"); err != nil {
+		return nil, err
+	}
+	config.modelName = values.string("vdcd.modelname")
+	config.vendorName = values.string("vdcd.vendorname")
+	config.vdcIconName = values.string("vdcd.iconname")
+	config.vdcConfigURL = values.string("vdcd.configurl")
+	if config.dryMode, err = values.bool("drymode"); err != nil {
+		return nil, err
+	}
+	config.sceneMappingsFile = values.string("scenemappings")
+	config.overridesFile = values.string("overrides")
+	config.storeFile = values.string("store")
+	config.httpListen = values.string("http.listen")
+	config.recordFile = values.string("record")
+
+	config.mqttHost = values.string("mqtt.host")
+	config.mqttUsername = values.string("mqtt.username")
+	config.mqttPassword = values["mqtt.password"]
+
+	config.homeassistantURL = values.string("homeassistant.url")
+	config.homeassistantToken = values.string("homeassistant.token")
+	config.homeassistantLabel = values.string("homeassistant.label")
+
+	config.deconzHost = values.string("deconz.host")
+	if config.deconzPort, err = values.int("deconz.port"); err != nil {
+		return nil, err
+	}
+	if config.deconcWebSockerPort, err = values.int("deconz.websocketport"); err != nil {
+		return nil, err
+	}
+	config.deconzApi = values.string("deconz.api")
+	if config.deconzEnableGroups, err = values.bool("deconz.groups"); err != nil {
+		return nil, err
+	}
+
+	config.zigbee2mqttBaseTopic = values.string("zigbee2mqtt.basetopic")
+	config.wledHosts = values.list("wled.hosts")
+
+	enabled := make(map[string]bool)
+	for _, backend := range []string{"tasmota", "shelly", "zigbee2mqtt", "deconz", "wled", "homeassistant"} {
+		if enabled[backend], err = values.bool(backend + ".enabled"); err != nil {
+			return nil, err
+		}
+	}
+	config.tasmotaDisabled = !enabled["tasmota"]
+	config.shellyDisabled = !enabled["shelly"]
+	config.zigbee2mqttDisabled = !enabled["zigbee2mqtt"]
+	config.deconzDisabled = !enabled["deconz"]
+	config.wledDisabled = !enabled["wled"]
+	config.homeassistantDisabled = !enabled["homeassistant"]
 
 	if config.mqttHost != "" {
 		config.mqttDiscoveryEnabled = true
 	}
 
-	if config.mqttHost == "" && (!config.tasmotaDisabled || !config.shellyDisabled || !config.zigbee2mqttDisabled) {
-		return nil, fmt.Errorf("mqtt host is required when MQTT-based discovery is enabled")
+	if err := values.require("", "vdcd.host"); err != nil {
+		return nil, err
+	}
+
+	if !config.tasmotaDisabled || !config.shellyDisabled || !config.zigbee2mqttDisabled {
+		if err := values.require("when Tasmota, Shelly or zigbee2mqtt discovery is enabled", "mqtt.host"); err != nil {
+			return nil, err
+		}
 	}
 
 	if !config.deconzDisabled {
-		if config.deconzHost == "" || config.deconzApi == "" || config.deconzPort == 0 {
-			return nil, fmt.Errorf("deconz discovery requires --deconzhost, --deconzport, and --deconzapi")
+		if err := values.require("when deconz discovery is enabled", "deconz.host", "deconz.port", "deconz.api"); err != nil {
+			return nil, err
 		}
 	}
 
 	if !config.homeassistantDisabled {
-		if config.homeassistantURL == "" || config.homeassistantToken == "" {
-			return nil, fmt.Errorf("home assistant discovery requires --homeassistant-url and --homeassistant-token")
+		if err := values.require("when Home Assistant discovery is enabled", "homeassistant.url", "homeassistant.token"); err != nil {
+			return nil, err
 		}
 	}
 
@@ -1,11 +1,17 @@
 package discovery
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -18,6 +24,9 @@ import (
 	deconzsensor "github.com/jurgen-kluft/go-conbee/sensors"
 )
 
+// Transition time in 1/10 seconds for a full range dimming move
+const deconzMoveTransitionTime = 40
+
 type DeconzDevice struct {
 	GenericDevice
 
@@ -39,8 +48,12 @@ type DeconzDevice struct {
 	sensorButtonId int
 
 	// Array with all lights, groups, sensors
-	allDeconzDevices []DeconzDevice
+	allDeconzDevices []*DeconzDevice
+	devicesMu        sync.Mutex
 	websocketStarted bool
+	// the websocket connection is up, see WebsocketConnected
+	websocketConnected atomic.Bool
+	reaper             deviceReaper
 
 	done      chan interface{}
 	interrupt chan os.Signal
@@ -61,24 +74,108 @@ type DeconzWebSocketMessage struct {
 
 func (e *DeconzDevice) hasDeconzDevice(resource string, id int) bool {
 	for _, device := range e.allDeconzDevices {
-		switch resource {
-		case "lights":
-			if device.IsLight && device.light.ID == id {
-				return true
-			}
-		case "groups":
-			if device.IsGroup && device.group.ID == id {
-				return true
-			}
-		case "sensors":
-			if device.IsSensor && device.sensor.ID == id {
-				return true
-			}
+		if deviceResource, deviceID := device.resourceID(); deviceResource == resource && deviceID == id {
+			return true
 		}
 	}
 	return false
 }
 
+// resourceID returns the REST resource (lights, groups or sensors) and the id of the device
+func (e *DeconzDevice) resourceID() (string, int) {
+	switch {
+	case e.IsLight:
+		return "lights", e.light.ID
+	case e.IsGroup:
+		return "groups", e.group.ID
+	case e.IsSensor:
+		return "sensors", e.sensor.ID
+	}
+	return "", 0
+}
+
+// addDeconzDevice keeps the device for the websocket events, unless already known
+func (e *DeconzDevice) addDeconzDevice(device *DeconzDevice) {
+	e.devicesMu.Lock()
+	defer e.devicesMu.Unlock()
+
+	if resource, id := device.resourceID(); !e.hasDeconzDevice(resource, id) {
+		e.allDeconzDevices = append(e.allDeconzDevices, device)
+	}
+}
+
+// deconzDevices returns the known devices, safe to iterate while devices are added or removed
+func (e *DeconzDevice) deconzDevices() []*DeconzDevice {
+	e.devicesMu.Lock()
+	defer e.devicesMu.Unlock()
+
+	devices := make([]*DeconzDevice, len(e.allDeconzDevices))
+	copy(devices, e.allDeconzDevices)
+	return devices
+}
+
+// forgetDeconzDevice drops the device of a resource, it is added again by the next discovery
+func (e *DeconzDevice) forgetDeconzDevice(resource string, id int) {
+	e.devicesMu.Lock()
+	defer e.devicesMu.Unlock()
+
+	var remaining []*DeconzDevice
+	for _, device := range e.allDeconzDevices {
+		if deviceResource, deviceID := device.resourceID(); deviceResource != resource || deviceID != id {
+			remaining = append(remaining, device)
+		}
+	}
+	e.allDeconzDevices = remaining
+}
+
+// reapDevices schedules the removal of the devices of the resource not known
+// to deconz anymore and cancels it for devices which are known again
+func (e *DeconzDevice) reapDevices(resource string, ids map[int]bool) {
+	for _, device := range e.vdcdClient.GetDevices() {
+		deconzDevice, ok := device.SourceDevice.(*DeconzDevice)
+		if !ok {
+			continue
+		}
+
+		deviceResource, deviceID := deconzDevice.resourceID()
+		if deviceResource != resource {
+			continue
+		}
+
+		if ids[deviceID] {
+			e.reaper.seen(device.Tag)
+		} else {
+			e.reaper.gone(e.vdcdClient, device.Tag)
+		}
+	}
+}
+
+// deviceDeleted schedules the removal of all devices of a deleted resource
+func (e *DeconzDevice) deviceDeleted(resource string, id string) {
+	for _, device := range e.vdcdClient.GetDevices() {
+		deconzDevice, ok := device.SourceDevice.(*DeconzDevice)
+		if !ok {
+			continue
+		}
+
+		if deviceResource, deviceID := deconzDevice.resourceID(); deviceResource == resource && fmt.Sprint(deviceID) == id {
+			e.reaper.gone(e.vdcdClient, device.Tag)
+		}
+	}
+}
+
+func (e *DeconzDevice) vcdcRemoveCallback() func(device *vdcdapi.Device) {
+
+	f := func(device *vdcdapi.Device) {
+		log.Debugf("Deconz, vcdcRemoveCallBack called for Device %s\n", device.UniqueID)
+		if deconzDevice, ok := device.SourceDevice.(*DeconzDevice); ok {
+			e.forgetDeconzDevice(deconzDevice.resourceID())
+		}
+	}
+
+	return f
+}
+
 type DeconzLightAttribute struct {
 	Id                string `json:"id,omitempty"`
 	LastAnnounced     string `json:"lastannounced,omitempty"`
@@ -117,7 +214,9 @@ type DeconzState struct {
 	AnyOn bool `json:"any_on,omitempty"`
 
 	// Sensor
-	ButtonEvent int `json:"buttonevent,omitempty"`
+	ButtonEvent int   `json:"buttonevent,omitempty"`
+	Presence    *bool `json:"presence,omitempty"`
+	Open        *bool `json:"open,omitempty"`
 }
 
 func (e *DeconzDevice) NewDeconzDevice(vdcdClient *vdcdapi.Client, deconzHost string, deconzPort int, deconzWebSocketPort int, deconzAPI string) *vdcdapi.Device {
@@ -159,26 +258,41 @@ func (e *DeconzDevice) StartDiscovery(vdcdClient *vdcdapi.Client, deconzHost str
 
 	// Lights
 	dl := deconzlight.New(host, e.deconzAPI)
-	allLights, _ := dl.GetAllLights()
+	allLights, err := dl.GetAllLights()
+	lightIDs := make(map[int]bool)
 	for _, light := range allLights {
+		lightIDs[light.ID] = true
 		e.lightsDiscovery(light)
 	}
+	if err == nil {
+		e.reapDevices("lights", lightIDs)
+	}
 
 	// Groups
 	if enableGroups {
 		dg := deconzgroup.New(host, e.deconzAPI)
-		allGroups, _ := dg.GetAllGroups()
+		allGroups, err := dg.GetAllGroups()
+		groupIDs := make(map[int]bool)
 		for _, group := range allGroups {
+			groupIDs[group.ID] = true
 			e.groupsDiscovery(group)
 		}
+		if err == nil {
+			e.reapDevices("groups", groupIDs)
+		}
 	}
 
 	// Sensors
 	ds := deconzsensor.New(host, e.deconzAPI)
-	allSensors, _ := ds.GetAllSensors()
+	allSensors, err := ds.GetAllSensors()
+	sensorIDs := make(map[int]bool)
 	for _, sensor := range allSensors {
+		sensorIDs[sensor.ID] = true
 		e.sensorDiscovery(sensor)
 	}
+	if err == nil {
+		e.reapDevices("sensors", sensorIDs)
+	}
 
 	// WebSocket Handling for all Devices
 	// no need for every device to open its own websocket connection
@@ -190,6 +304,11 @@ func (e *DeconzDevice) StartDiscovery(vdcdClient *vdcdapi.Client, deconzHost str
 	log.Debugf("Deconz, Device Discovery finished\n")
 }
 
+// WebsocketConnected reports whether the websocket for the deconz events is connected
+func (e *DeconzDevice) WebsocketConnected() bool {
+	return e.websocketConnected.Load()
+}
+
 func (e *DeconzDevice) websocketLoop() {
 
 	log.Debugln("Deconz, Starting Deconz Websocket Loop")
@@ -205,6 +324,7 @@ func (e *DeconzDevice) websocketLoop() {
 		log.Fatal("Deconz, Error connecting to Websocket Server:", err)
 	}
 	log.Debugln("Deconz, Connected to Deconz websocket")
+	e.websocketConnected.Store(true)
 
 	defer func() {
 		if err := conn.Close(); err != nil {
@@ -246,10 +366,12 @@ func (e *DeconzDevice) websocketReceiveHandler(connection *websocket.Conn) {
 	log.Debugln("Deconz, Starting Deconz Websocket receive handler")
 
 	defer close(e.done)
+	defer e.websocketConnected.Store(false)
 	for {
 		_, msg, err := connection.ReadMessage()
 		if err != nil {
 			log.Println("Deconz, Error in Deconz Websocket Message receive:", err)
+			e.vdcdClient.Log(vdcdapi.LogWarning, fmt.Sprintf("Deconz websocket disconnected: %s", err))
 			return
 		}
 
@@ -263,6 +385,12 @@ func (e *DeconzDevice) websocketReceiveHandler(connection *websocket.Conn) {
 			return
 		}
 
+		// Removed lights, groups and sensors
+		if message.Type == "event" && message.Event == "deleted" {
+			log.Infof("Deconz, Websocket deleted event for %s %s\n", message.Resource, message.ID)
+			e.deviceDeleted(message.Resource, message.ID)
+		}
+
 		// Handling light Resources
 		if message.Type == "event" && message.Resource == "lights" && message.Event == "changed" {
 			if message.State.On != nil ||
@@ -275,7 +403,7 @@ func (e *DeconzDevice) websocketReceiveHandler(connection *websocket.Conn) {
 				message.State.ColorMode != "" ||
 				message.State.ColorLoopSpeed != nil {
 
-				for _, l := range e.allDeconzDevices {
+				for _, l := range e.deconzDevices() {
 					if l.IsLight {
 						if fmt.Sprint(l.light.ID) == message.ID {
 							log.Infof("Deconz Websocket changed event for light %s\n", l.light.Name)
@@ -292,7 +420,7 @@ func (e *DeconzDevice) websocketReceiveHandler(connection *websocket.Conn) {
 		// Handling group Resources
 		if message.Type == "event" && message.Resource == "groups" && message.Event == "changed" {
 
-			for _, l := range e.allDeconzDevices {
+			for _, l := range e.deconzDevices() {
 				if l.IsGroup {
 					if fmt.Sprint(l.group.ID) == message.ID {
 						log.Infof("Deconz Websocket changed event for group %s\n", l.group.Name)
@@ -309,7 +437,7 @@ func (e *DeconzDevice) websocketReceiveHandler(connection *websocket.Conn) {
 		// Handling sensor Resources
 		if message.Type == "event" && message.Resource == "sensors" && message.Event == "changed" {
 
-			for _, l := range e.allDeconzDevices {
+			for _, l := range e.deconzDevices() {
 				if l.IsSensor {
 					if fmt.Sprint(l.sensor.ID) == message.ID {
 						// Send to all devices which handles this sensor
@@ -328,7 +456,7 @@ func (e *DeconzDevice) SetValue(value float32, channelName string, channelType v
 	log.Infof("Deconz, Set Value for Deconz Device %s to %f on Channel '%s' \n", e.light.Name, value, channelName)
 
 	// Also sync the state with originDevice
-	e.originDevice.SetValue(value, channelName)
+	value = e.originDevice.SetValue(value, channelName)
 
 	switch channelName {
 
@@ -354,6 +482,98 @@ func (e *DeconzDevice) vcdcChannelCallback() func(message *vdcdapi.GenericVDCDMe
 	return f
 }
 
+func (e *DeconzDevice) vcdcMoveCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.Debugf("Deconz, vcdcMoveCallBack called for Device %s\n", device.UniqueID)
+		e.Move(message.Direction)
+	}
+
+	return f
+}
+
+// Move dims with bri_inc over the transition time, direction 0 stops the running transition
+func (e *DeconzDevice) Move(direction int) {
+
+	state := map[string]interface{}{"bri_inc": 0}
+
+	switch {
+	case direction > 0:
+		state = map[string]interface{}{"bri_inc": 254, "transitiontime": deconzMoveTransitionTime}
+	case direction < 0:
+		state = map[string]interface{}{"bri_inc": -254, "transitiontime": deconzMoveTransitionTime}
+	}
+
+	if err := e.putState(state); err != nil {
+		log.WithError(err).Error("Deconz, move failed")
+	}
+}
+
+// putState sends a raw state change to the light state or group action endpoint
+func (e *DeconzDevice) putState(state map[string]interface{}) error {
+
+	switch {
+	case e.IsLight:
+		return e.put(fmt.Sprintf("lights/%d/state", e.light.ID), state)
+	case e.IsGroup:
+		return e.put(fmt.Sprintf("groups/%d/action", e.group.ID), state)
+	default:
+		return fmt.Errorf("deconz device has no state")
+	}
+}
+
+// RecallScene recalls the mapped deconz scene. Group devices map to the scene id,
+// lights to "<group id>/<scene id>" as scenes belong to a group.
+func (e *DeconzDevice) RecallScene(scene string) {
+
+	groupID, sceneID, found := strings.Cut(scene, "/")
+	if !found {
+		if !e.IsGroup {
+			log.WithField("Scene", scene).Error("Deconz, scene for a light must be given as <group id>/<scene id>")
+			return
+		}
+		groupID, sceneID = fmt.Sprint(e.group.ID), scene
+	}
+
+	if err := e.put(fmt.Sprintf("groups/%s/scenes/%s/recall", groupID, sceneID), map[string]interface{}{}); err != nil {
+		log.WithError(err).Error("Deconz, scene recall failed")
+	}
+}
+
+// put sends a PUT request with a JSON body to the given path of the deconz REST API
+func (e *DeconzDevice) put(path string, body interface{}) error {
+
+	url := fmt.Sprintf("http://%s:%d/api/%s/%s", e.deconzHost, e.deconzPort, e.deconzAPI, path)
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("PUT", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.WithError(err).Warn("Deconz, response close failed")
+		}
+	}()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("deconz error: %s", string(body))
+	}
+
+	return nil
+}
+
 func (e *DeconzDevice) TurnOn() {
 
 	if e.IsLight {
@@ -389,7 +609,7 @@ func (e *DeconzDevice) SetBrightness(brightness float32) {
 			e.light.State.SetOn(true)
 		}
 
-		bri_converted := uint8(math.Round(float64(brightness) / 100 * 255))
+		bri_converted := uint8(vdcdapi.PercentToScale(brightness, 254))
 		e.light.State.Bri = &bri_converted
 
 	}
@@ -401,13 +621,14 @@ func (e *DeconzDevice) SetBrightness(brightness float32) {
 			e.group.Action.SetOn(true)
 		}
 
-		bri_converted := uint8(math.Round(float64(brightness) / 100 * 255))
+		bri_converted := uint8(vdcdapi.PercentToScale(brightness, 254))
 		e.group.Action.Bri = &bri_converted
 	}
 
 	e.setState()
 }
 
+// SetColorTemp sets the color temperature, deconz uses mired as the vdcd does
 func (e *DeconzDevice) SetColorTemp(ct float32) {
 
 	converted := uint16(ct)
@@ -423,9 +644,10 @@ func (e *DeconzDevice) SetColorTemp(ct float32) {
 	e.setState()
 }
 
+// SetHue sets the hue, deconz uses 0-65535 for 0-360 degree
 func (e *DeconzDevice) SetHue(hue float32) {
 
-	converted := uint16(hue)
+	converted := uint16(vdcdapi.PercentToScale(hue/360*100, 65535))
 	if e.IsLight {
 		e.light.State.Hue = &converted
 	}
@@ -437,9 +659,10 @@ func (e *DeconzDevice) SetHue(hue float32) {
 	e.setState()
 }
 
+// SetSaturation sets the saturation, deconz uses 0-254 for 0-100%
 func (e *DeconzDevice) SetSaturation(saturation float32) {
 
-	converted := uint8(saturation)
+	converted := uint8(vdcdapi.PercentToScale(saturation, 254))
 
 	if e.IsLight {
 		e.light.State.Sat = &converted
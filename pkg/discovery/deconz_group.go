@@ -13,6 +13,8 @@ func (e *DeconzDevice) NewDeconzGroupDevice() *vdcdapi.Device {
 	device := new(vdcdapi.Device)
 
 	device.SetChannelMessageCB(e.vcdcChannelCallback())
+	device.SetSceneCommandCB(sceneCommandCallback(e.RecallScene))
+	device.SceneCommands = true
 
 	// Group only allows for on/off -> basic switch, no dimming
 	device.NewLightDevice(e.vdcdClient, fmt.Sprintf("%d", e.group.ID), false)
@@ -22,6 +24,7 @@ func (e *DeconzDevice) NewDeconzGroupDevice() *vdcdapi.Device {
 
 	device.ConfigUrl = fmt.Sprintf("http://%s:%d", e.deconzHost, e.deconzPort)
 	device.SourceDevice = e
+	device.SetSource("deconz", fmt.Sprintf("groups/%d", e.group.ID))
 
 	e.originDevice = device
 	e.vdcdClient.AddDevice(device)
@@ -42,12 +45,11 @@ func (e *DeconzDevice) groupsDiscovery(group deconzgroup.Group) {
 		_, notfounderr := e.vdcdClient.GetDeviceByUniqueId(fmt.Sprint(group.ID))
 		if notfounderr != nil {
 			log.Debugf("Deconz, Device not found in vcdc -> Adding \n")
-			deconzDeviceGroup.NewDeconzDevice(e.vdcdClient, e.deconzHost, e.deconzPort, e.deconzWebSocketPort, e.deconzAPI)
+			device := deconzDeviceGroup.NewDeconzDevice(e.vdcdClient, e.deconzHost, e.deconzPort, e.deconzWebSocketPort, e.deconzAPI)
+			device.SetRemoveCB(e.vcdcRemoveCallback())
 		}
 
-		if !e.hasDeconzDevice("groups", deconzDeviceGroup.group.ID) {
-			e.allDeconzDevices = append(e.allDeconzDevices, *deconzDeviceGroup)
-		}
+		e.addDeconzDevice(deconzDeviceGroup)
 
 	}
 
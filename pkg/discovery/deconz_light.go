@@ -2,7 +2,6 @@ package discovery
 
 import (
 	"fmt"
-	"math"
 
 	deconzlight "github.com/jurgen-kluft/go-conbee/lights"
 	log "github.com/sirupsen/logrus"
@@ -14,6 +13,14 @@ func (e *DeconzDevice) NewDeconzLightDevice() *vdcdapi.Device {
 	device := new(vdcdapi.Device)
 
 	device.SetChannelMessageCB(e.vcdcChannelCallback())
+	device.SetMoveMessageCB(e.vcdcMoveCallback())
+	device.SetSyncMessageCB(e.vcdcSyncCallback())
+	device.SetSceneCommandCB(sceneCommandCallback(e.RecallScene))
+	device.SceneCommands = true
+
+	// All lights handled here have a brightness channel
+	device.Move = true
+	device.Sync = true
 
 	if e.light.HasColor {
 		if e.light.State.ColorMode == "ct" {
@@ -33,6 +40,7 @@ func (e *DeconzDevice) NewDeconzLightDevice() *vdcdapi.Device {
 
 	device.ConfigUrl = fmt.Sprintf("http://%s:%d", e.deconzHost, e.deconzPort)
 	device.SourceDevice = e
+	device.SetSource("deconz", fmt.Sprintf("lights/%d", e.light.ID))
 
 	e.originDevice = device
 	e.vdcdClient.AddDevice(device)
@@ -54,12 +62,11 @@ func (e *DeconzDevice) lightsDiscovery(light deconzlight.Light) {
 			_, notfounderr := e.vdcdClient.GetDeviceByUniqueId(light.UniqueID)
 			if notfounderr != nil {
 				log.Debugf("Deconz, Device not found in vcdc -> Adding \n")
-				deconzDevice.NewDeconzDevice(e.vdcdClient, e.deconzHost, e.deconzPort, e.deconzWebSocketPort, e.deconzAPI)
+				device := deconzDevice.NewDeconzDevice(e.vdcdClient, e.deconzHost, e.deconzPort, e.deconzWebSocketPort, e.deconzAPI)
+				device.SetRemoveCB(e.vcdcRemoveCallback())
 			}
 
-			if !e.hasDeconzDevice("lights", deconzDevice.light.ID) {
-				e.allDeconzDevices = append(e.allDeconzDevices, *deconzDevice)
-			}
+			e.addDeconzDevice(deconzDevice)
 		}
 	}
 
@@ -71,8 +78,7 @@ func (e *DeconzDevice) lightStateChangedCallback(state *DeconzState) {
 
 	if state.Bri != nil {
 		log.Debugf("Deconz, lightStateChangedCallback: set Brightness to %d\n", *state.Bri)
-		bri_converted := float32(math.Round(float64(*state.Bri) / 255 * 100))
-		e.originDevice.UpdateValue(float32(bri_converted), "brightness", vdcdapi.BrightnessType)
+		e.originDevice.UpdateValue(vdcdapi.ScaleToPercent(float32(*state.Bri), 254), "brightness", vdcdapi.BrightnessType)
 	}
 
 	if state.CT != nil {
@@ -97,6 +103,43 @@ func (e *DeconzDevice) lightStateChangedCallback(state *DeconzState) {
 
 }
 
+func (e *DeconzDevice) vcdcSyncCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.Debugf("Deconz, vcdcSyncCallBack called for Device %s\n", device.UniqueID)
+		e.Sync()
+	}
+
+	return f
+}
+
+// Sync reads the current light state from the REST API and applies it to the channels
+func (e *DeconzDevice) Sync() {
+
+	conbeehost := fmt.Sprintf("%s:%d", e.deconzHost, e.deconzPort)
+	light, err := deconzlight.New(conbeehost, e.deconzAPI).GetLightState(e.light.ID)
+	if err != nil {
+		log.WithError(err).Errorf("Deconz, GetLightState failed for light %s\n", e.light.Name)
+		return
+	}
+
+	if light.State.On != nil {
+		if *light.State.On {
+			e.originDevice.UpdateValue(100, "basic_switch", vdcdapi.UndefinedType)
+		} else {
+			e.originDevice.UpdateValue(0, "basic_switch", vdcdapi.UndefinedType)
+		}
+	}
+
+	e.lightStateChangedCallback(&DeconzState{
+		On:  light.State.On,
+		Hue: light.State.Hue,
+		Bri: light.State.Bri,
+		Sat: light.State.Sat,
+		CT:  light.State.CT,
+	})
+}
+
 // func (e *DeconzDevice) setLightState() {
 
 // 	state := strings.Replace(e.light.State.String(), "\n", ",", -1)
@@ -31,7 +31,22 @@ func (e *DeconzDevice) NewDeconzSensorDevice() *vdcdapi.Device {
 	log.Debugf("Deconz, Adding sensor %s for Button %d", e.sensor.Name, e.sensorButtonId)
 
 	device := new(vdcdapi.Device)
-	device.NewButtonDevice(e.vdcdClient, e.getUniqueId())
+
+	switch e.sensor.Type {
+	case "ZHAPresence":
+		device.NewInputDevice(e.vdcdClient, e.getUniqueId())
+		device.AddInput(newBinaryInput("presence", vdcdapi.PresenceInput, "presence"))
+		device.UpdateInputValue(boolToInputValue(e.sensor.State.Presence), "presence")
+
+	case "ZHAOpenClose":
+		// dS reports closed, deconz reports open
+		device.NewInputDevice(e.vdcdClient, e.getUniqueId())
+		device.AddInput(newBinaryInput("open", vdcdapi.WindowClosedInput, "open"))
+		device.UpdateInputValue(boolToInputValue(!e.sensor.State.Open), "open")
+
+	default:
+		device.NewButtonDevice(e.vdcdClient, e.getUniqueId())
+	}
 
 	device.SetChannelMessageCB(e.vcdcChannelCallback())
 
@@ -60,6 +75,7 @@ func (e *DeconzDevice) NewDeconzSensorDevice() *vdcdapi.Device {
 
 	device.ConfigUrl = fmt.Sprintf("http://%s:%d", e.deconzHost, e.deconzPort)
 	device.SourceDevice = e
+	device.SetSource("deconz", fmt.Sprintf("sensors/%d", e.sensor.ID))
 
 	e.originDevice = device
 	e.vdcdClient.AddDevice(device)
@@ -73,6 +89,10 @@ func (e *DeconzDevice) getUniqueId() string {
 }
 
 func (e *DeconzDevice) getName() string {
+	if e.sensor.Type != "ZHASwitch" {
+		return e.sensor.Name
+	}
+
 	name := fmt.Sprintf("%s Button %d", e.sensor.Name, e.sensorButtonId+1)
 	return name
 }
@@ -85,6 +105,9 @@ func (e *DeconzDevice) sensorDiscovery(sensor deconzsensor.Sensor) {
 	switch sensor.Type {
 	case "ZHASwitch":
 		e.ZHASwitchSensorDiscovery(sensor)
+	case "ZHAPresence", "ZHAOpenClose":
+		log.Infof("Deconz, %s discovered: Name: %s Model: %s\n", sensor.Type, sensor.Name, sensor.ModelID)
+		e.CreateInputDevice(sensor)
 	}
 
 }
@@ -129,19 +152,44 @@ func (e *DeconzDevice) CreateButtonDevice(sensor deconzsensor.Sensor, buttonId i
 	_, notfounderr := e.vdcdClient.GetDeviceByUniqueId(e.getUniqueId())
 	if notfounderr != nil {
 		log.Debugf("Deconz, Device not found in vcdc -> Adding \n")
-		deconzDeviceSensor.NewDeconzDevice(e.vdcdClient, e.deconzHost, e.deconzPort, e.deconzWebSocketPort, e.deconzAPI)
+		device := deconzDeviceSensor.NewDeconzDevice(e.vdcdClient, e.deconzHost, e.deconzPort, e.deconzWebSocketPort, e.deconzAPI)
+		device.SetRemoveCB(e.vcdcRemoveCallback())
 	}
 
-	if !e.hasDeconzDevice("sensors", deconzDeviceSensor.sensor.ID) {
-		e.allDeconzDevices = append(e.allDeconzDevices, *deconzDeviceSensor)
+	e.addDeconzDevice(deconzDeviceSensor)
+
+}
+
+func (e *DeconzDevice) CreateInputDevice(sensor deconzsensor.Sensor) {
+	log.Infof("Deconz, Create InputDevice for %s\n", sensor.Name)
+
+	deconzDeviceSensor := new(DeconzDevice)
+	deconzDeviceSensor.IsSensor = true
+	deconzDeviceSensor.sensor = sensor
+
+	_, notfounderr := e.vdcdClient.GetDeviceByUniqueId(deconzDeviceSensor.getUniqueId())
+	if notfounderr != nil {
+		log.Debugf("Deconz, Device not found in vcdc -> Adding \n")
+		device := deconzDeviceSensor.NewDeconzDevice(e.vdcdClient, e.deconzHost, e.deconzPort, e.deconzWebSocketPort, e.deconzAPI)
+		device.SetRemoveCB(e.vcdcRemoveCallback())
 	}
 
+	e.addDeconzDevice(deconzDeviceSensor)
+
 }
 
 func (e *DeconzDevice) sensorWebsocketCallback(state *DeconzState) {
 
 	log.Debugf("Deconz, sensorStateChangedCallback called for Device '%s'. State: '%+v'\n", e.getName(), state)
 
+	if state.Presence != nil {
+		e.originDevice.UpdateInputValue(boolToInputValue(*state.Presence), "presence")
+	}
+
+	if state.Open != nil {
+		e.originDevice.UpdateInputValue(boolToInputValue(!*state.Open), "open")
+	}
+
 	// Only when there is a ButtonEvent
 	if state.ButtonEvent > 0 {
 		// Get Button for which the event is for
@@ -168,24 +216,24 @@ func (e *DeconzDevice) sensorWebsocketCallback(state *DeconzState) {
 			switch event {
 			case Hold:
 				log.Debugf("Deconz, Event Hold for Device '%s' on Button %d\n", e.sensor.Name, button)
-				e.vdcdClient.SendButtonMessage(1, e.originDevice.Tag, 0)
+				e.sendButtonEvent(1)
 
 			case ShortRelease:
 				log.Debugf("Deconz, Event ShortRelease for Device '%s' on Button %d\n", e.sensor.Name, button)
 				//e.vdcdClient.SendButtonRawMessage(vdcdapi.CT_TIP_1X, e.originDevice.Tag, 0)
-				e.vdcdClient.SendButtonMessage(float32(-vdcdapi.CT_DC_TIP_1X), e.originDevice.Tag, 0)
+				e.sendButtonEvent(float32(-vdcdapi.CT_DC_TIP_1X))
 
 			case DoublePress:
 				log.Debugf("Deconz, Event DoublePress for Device '%s' on Button %d\n", e.sensor.Name, button)
-				e.vdcdClient.SendButtonMessage(float32(-vdcdapi.CT_DC_TIP_2X), e.originDevice.Tag, 0)
+				e.sendButtonEvent(float32(-vdcdapi.CT_DC_TIP_2X))
 
 			case TreeplePress:
 				log.Debugf("Deconz, Event TreeplePress for Device '%s' on Button %d\n", e.sensor.Name, button)
-				e.vdcdClient.SendButtonMessage(float32(-vdcdapi.CT_DC_TIP_3X), e.originDevice.Tag, 0)
+				e.sendButtonEvent(float32(-vdcdapi.CT_DC_TIP_3X))
 
 			case LongRelease:
 				log.Debugf("Deconz, Event LongRelease for Device '%s' on Button %d\n", e.sensor.Name, button)
-				e.vdcdClient.SendButtonMessage(0, e.originDevice.Tag, 0)
+				e.sendButtonEvent(0)
 
 			}
 		}
@@ -2,21 +2,188 @@ package discovery
 
 import (
 	"fmt"
+	"math"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
 	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
 )
 
+const (
+	// Interval between two dimming steps for backends without a native move command
+	moveStepInterval = 300 * time.Millisecond
+	// Safety net, stop moving when the stop message from the vdcd got lost
+	moveMaxDuration = 15 * time.Second
+	// Maximum time to wait for a backend to report its state on a sync request
+	syncTimeout = 3 * time.Second
+)
+
+// Time a device has to be gone before it is removed, longer than the
+// periodic discovery so flapping devices are not removed and added again.
+// A variable so the tests do not have to wait as long.
+var removalGracePeriod = 10 * time.Minute
+
+// Pending sync requests for backends which report their state asynchronously,
+// a device can be synced again while a sync is still waiting
+var (
+	stateWaitersMu sync.Mutex
+	stateWaiters   = make(map[*vdcdapi.Device][]chan struct{})
+)
+
 type GenericDevice struct {
 	vdcdClient   *vdcdapi.Client
 	mqttClient   mqtt.Client
 	originDevice *vdcdapi.Device
+
+	// moves are started by the vdcd receive loop and stopped by the remove
+	// callback as well, which runs on the reaper or the admin API
+	moveMu   sync.Mutex
+	moveStop chan struct{}
+}
+
+// sceneCommandCallback returns a scene command callback calling recall with the
+// backend scene or preset mapped to the received scene command
+func sceneCommandCallback(recall func(target string)) func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		target, ok := device.GetSceneMapping(message.Cmd)
+		if !ok {
+			log.WithFields(log.Fields{
+				"UniqueID": device.UniqueID,
+				"Cmd":      message.Cmd,
+			}).Debug("No scene mapping for scene command")
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"UniqueID": device.UniqueID,
+			"Cmd":      message.Cmd,
+			"Target":   target,
+		}).Info("Recall scene for scene command")
+		recall(target)
+	}
+
+	return f
+}
+
+// newBinaryInput returns a binary input of the given type, reported on state change only
+func newBinaryInput(id string, inputType vdcdapi.InputType, hardwareName string) vdcdapi.Input {
+	input := new(vdcdapi.Input)
+	input.Id = id
+	input.InputType = int(inputType)
+	input.Usage = int(vdcdapi.RoomUsage)
+	input.Group = int(vdcdapi.BlackVariableGroup)
+	input.UpdateInterval = 0 // no fixed interval
+	input.HardwareName = hardwareName
+
+	return *input
+}
+
+// boolToInputValue converts a binary state to the input value, 1 = active
+func boolToInputValue(active bool) float32 {
+	if active {
+		return 1
+	}
+	return 0
+}
+
+// heatingLevelToValve converts the heatingLevel control value (-100 to 100%,
+// negative values request cooling) to a valve position (0-100%)
+func heatingLevelToValve(level float32) float32 {
+	return float32(math.Max(0, math.Min(100, float64(level))))
+}
+
+// heatingLevelToSetpoint maps the heatingLevel to a setpoint between minTemp and
+// maxTemp for backends without direct valve control, in steps of 0.5 degree
+func heatingLevelToSetpoint(level float32, minTemp float32, maxTemp float32) float32 {
+	setpoint := minTemp + heatingLevelToValve(level)/100*(maxTemp-minTemp)
+	return float32(math.Round(float64(setpoint)*2) / 2)
+}
+
+// intensityToSpeed converts the airflow intensity (0-100%) to a fan speed level
+// between 0 (off) and speeds, any intensity above 0 runs at least at level 1
+func intensityToSpeed(intensity float32, speeds int) int {
+	if intensity <= 0 || speeds <= 0 {
+		return 0
+	}
+	return int(math.Min(float64(speeds), math.Ceil(float64(intensity)/100*float64(speeds))))
+}
+
+// speedToIntensity converts a fan speed level between 0 (off) and speeds to the airflow intensity
+func speedToIntensity(speed int, speeds int) float32 {
+	if speeds <= 0 {
+		return 0
+	}
+	return float32(speed) * 100 / float32(speeds)
+}
+
+// deviceReaper removes devices reported gone by a backend after the grace
+// period, unless the device is seen again in the meantime
+type deviceReaper struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+// gone schedules the removal of the device with the given tag
+func (r *deviceReaper) gone(vdcdClient *vdcdapi.Client, tag string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.timers == nil {
+		r.timers = make(map[string]*time.Timer)
+	}
+	if _, scheduled := r.timers[tag]; scheduled {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"Tag":         tag,
+		"GracePeriod": removalGracePeriod,
+	}).Info("Device gone, scheduling removal")
+
+	r.timers[tag] = time.AfterFunc(removalGracePeriod, func() {
+		r.mu.Lock()
+		delete(r.timers, tag)
+		r.mu.Unlock()
+
+		if err := vdcdClient.RemoveDevice(tag); err != nil {
+			log.WithError(err).WithField("Tag", tag).Debug("Failed to remove device")
+		}
+	})
+}
+
+// seen cancels a scheduled removal of the device with the given tag
+func (r *deviceReaper) seen(tag string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if timer, scheduled := r.timers[tag]; scheduled {
+		timer.Stop()
+		delete(r.timers, tag)
+		log.WithField("Tag", tag).Info("Device is back, removal canceled")
+	}
 }
 
 func (e *GenericDevice) publishMqttCommand(topic string, value interface{}) {
+	if err := e.publishMqtt(topic, value); err != nil {
+		log.Errorln("MQTT publish failed", err)
+	}
+}
+
+// publishMqtt publishes the value and returns the error of the publish, used by actions to report the result
+func (e *GenericDevice) publishMqtt(topic string, value interface{}) error {
 	if token := e.mqttClient.Publish(topic, 0, false, fmt.Sprintf("%v", value)); token.Wait() && token.Error() != nil {
-		log.Errorln("MQTT publish failed", token.Error())
+		return token.Error()
+	}
+	return nil
+}
+
+// sendButtonEvent forwards a button event of the origin device to the vdcd
+func (e *GenericDevice) sendButtonEvent(value float32) {
+	if err := e.vdcdClient.SendButtonMessage(value, e.originDevice.Tag, 0); err != nil {
+		log.WithError(err).WithField("UniqueID", e.originDevice.UniqueID).Warn("Failed to send button event")
 	}
 }
 
@@ -27,3 +194,106 @@ func (e *GenericDevice) subscribeMqttTopic(topic string, callback mqtt.MessageHa
 		log.Error("MQTT subscribe failed: ", token.Error())
 	}
 }
+
+// unsubscribeMqttTopics removes the subscriptions of a removed device
+func (e *GenericDevice) unsubscribeMqttTopics(topics ...string) {
+
+	log.Debugf("MQTT Unsubscribe from topics %v\n", topics)
+	if token := e.mqttClient.Unsubscribe(topics...); token.Wait() && token.Error() != nil {
+		log.Error("MQTT unsubscribe failed: ", token.Error())
+	}
+}
+
+// startMove emulates a continuous move by calling step repeatedly until stopMove is called
+func (e *GenericDevice) startMove(step func()) {
+	stop := make(chan struct{})
+
+	e.moveMu.Lock()
+	previous := e.moveStop
+	e.moveStop = stop
+	e.moveMu.Unlock()
+
+	if previous != nil {
+		close(previous)
+	}
+
+	go func() {
+		ticker := time.NewTicker(moveStepInterval)
+		defer ticker.Stop()
+		timeout := time.After(moveMaxDuration)
+
+		step()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-timeout:
+				log.Debug("Move not stopped by vdcd, stopping")
+				return
+			case <-ticker.C:
+				step()
+			}
+		}
+	}()
+}
+
+func (e *GenericDevice) stopMove() {
+	e.moveMu.Lock()
+	stop := e.moveStop
+	e.moveStop = nil
+	e.moveMu.Unlock()
+
+	if stop != nil {
+		close(stop)
+	}
+}
+
+// awaitState sends a state request to the backend and waits until the state
+// has been reported with notifyState, or the sync timeout is reached
+func (e *GenericDevice) awaitState(request func()) bool {
+	wait := make(chan struct{})
+
+	stateWaitersMu.Lock()
+	stateWaiters[e.originDevice] = append(stateWaiters[e.originDevice], wait)
+	stateWaitersMu.Unlock()
+
+	// only the own waiter is removed, a state reported in the meantime removed it already
+	defer func() {
+		stateWaitersMu.Lock()
+		defer stateWaitersMu.Unlock()
+
+		waiters := stateWaiters[e.originDevice]
+		for i, waiter := range waiters {
+			if waiter == wait {
+				waiters = append(waiters[:i:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(stateWaiters, e.originDevice)
+		} else {
+			stateWaiters[e.originDevice] = waiters
+		}
+	}()
+
+	request()
+
+	select {
+	case <-wait:
+		return true
+	case <-time.After(syncTimeout):
+		log.WithField("UniqueID", e.originDevice.UniqueID).Warn("No state reported by device for sync")
+		return false
+	}
+}
+
+// notifyState releases all pending awaitState calls after the backend reported its state
+func (e *GenericDevice) notifyState() {
+	stateWaitersMu.Lock()
+	defer stateWaitersMu.Unlock()
+
+	for _, wait := range stateWaiters[e.originDevice] {
+		close(wait)
+	}
+	delete(stateWaiters, e.originDevice)
+}
@@ -0,0 +1,205 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/splattner/vdcd-bridge/pkg/mqtttest"
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi/vdcdtest"
+)
+
+func TestMain(m *testing.M) {
+	// set before any backend runs, the reaper reads it from the MQTT callbacks
+	removalGracePeriod = 100 * time.Millisecond
+
+	os.Exit(m.Run())
+}
+
+// testBridge connects a vdcd client to a simulated vdcd and a MQTT client to an
+// in-process broker, the backends under test are started with both
+type testBridge struct {
+	broker     *mqtttest.Broker
+	vdcd       *vdcdtest.Server
+	vdcdClient *vdcdapi.Client
+	mqttClient mqtt.Client
+}
+
+func newTestBridge(t *testing.T) *testBridge {
+	t.Helper()
+
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("failed to start broker: %s", err)
+	}
+	t.Cleanup(broker.Close)
+
+	vdcd := vdcdtest.NewServer(t)
+
+	vdcdClient := new(vdcdapi.Client)
+	vdcdClient.NewCient(vdcd.Host(), vdcd.Port(), "test", "test", false)
+	vdcdClient.SetInitDelay(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := vdcdClient.Connect(ctx); err != nil {
+		cancel()
+		t.Fatalf("vdcd connect failed: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := vdcdClient.ListenWithContext(ctx); err != nil {
+			t.Errorf("vdcd listen failed: %s", err)
+		}
+	}()
+
+	mqttClient := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.URL()).SetClientID("vdcd_test").SetProtocolVersion(4).SetOrderMatters(false))
+	if token := mqttClient.Connect(); !token.WaitTimeout(vdcdtest.DefaultTimeout) || token.Error() != nil {
+		cancel()
+		t.Fatalf("mqtt connect failed: %v", token.Error())
+	}
+
+	// registered last, so it runs before the broker and the vdcd are closed
+	t.Cleanup(func() {
+		mqttClient.Disconnect(0)
+		cancel()
+		<-done
+	})
+
+	return &testBridge{
+		broker:     broker,
+		vdcd:       vdcd,
+		vdcdClient: vdcdClient,
+		mqttClient: mqttClient,
+	}
+}
+
+// sendChannel sends a channel value from the vdcd to the device
+func (b *testBridge) sendChannel(t *testing.T, tag string, channelName string, value float32) {
+	t.Helper()
+
+	if err := b.vdcd.SendChannel(tag, channelName, value); err != nil {
+		t.Fatalf("failed to send channel %s: %s", channelName, err)
+	}
+}
+
+// sync asks the device to read back its state and waits for the synced reply,
+// the state reported by the backend has been applied after it
+func (b *testBridge) sync(t *testing.T, tag string) {
+	t.Helper()
+
+	b.vdcd.Reset()
+	if err := b.vdcd.SendSync(tag); err != nil {
+		t.Fatalf("failed to send sync: %s", err)
+	}
+	b.vdcd.AssertMessage(t, "synced", tag)
+}
+
+// assertValue fails the test when the channel of the bridged device does not hold the value
+func (b *testBridge) assertValue(t *testing.T, tag string, channelName string, expected float32) {
+	t.Helper()
+
+	device, err := b.vdcdClient.GetDeviceByTag(tag)
+	if err != nil {
+		t.Fatalf("device %s not found: %s", tag, err)
+	}
+
+	value, err := device.GetValue(channelName)
+	if err != nil {
+		t.Fatalf("device %s: %s", tag, err)
+	}
+	if value != expected {
+		t.Fatalf("device %s: expected %s=%v, got %v", tag, channelName, expected, value)
+	}
+}
+
+// assertRemoved waits for the bye of the device after the removal grace period
+func (b *testBridge) assertRemoved(t *testing.T, tag string) {
+	t.Helper()
+
+	b.vdcd.AssertMessage(t, "bye", tag)
+	if _, err := b.vdcdClient.GetDeviceByTag(tag); err == nil {
+		t.Fatalf("device %s still registered", tag)
+	}
+}
+
+// eventually waits until the condition holds, e.g. a command reached a simulated device
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(vdcdtest.DefaultTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMoveStoppedConcurrently(t *testing.T) {
+	device := new(GenericDevice)
+
+	var steps sync.WaitGroup
+	steps.Add(1)
+	var once sync.Once
+	device.startMove(func() { once.Do(steps.Done) })
+	steps.Wait()
+
+	// the vdcd stops the move while the device is removed
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			device.stopMove()
+			device.startMove(func() {})
+			device.stopMove()
+		}()
+	}
+	wg.Wait()
+
+	device.moveMu.Lock()
+	defer device.moveMu.Unlock()
+	if device.moveStop != nil {
+		t.Error("move still running")
+	}
+}
+
+func TestConcurrentSyncsAreAllReleased(t *testing.T) {
+	device := &GenericDevice{originDevice: new(vdcdapi.Device)}
+
+	var requested sync.WaitGroup
+	requested.Add(2)
+
+	results := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- device.awaitState(requested.Done)
+		}()
+	}
+
+	requested.Wait()
+	device.notifyState()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case released := <-results:
+			if !released {
+				t.Error("sync not released by the reported state")
+			}
+		case <-time.After(syncTimeout / 2):
+			t.Fatal("sync waits for the timeout")
+		}
+	}
+
+	stateWaitersMu.Lock()
+	defer stateWaitersMu.Unlock()
+	if _, ok := stateWaiters[device.originDevice]; ok {
+		t.Error("waiters left behind")
+	}
+}
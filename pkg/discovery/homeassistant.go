@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,21 +18,39 @@ import (
 	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
 )
 
+// Default label of the entities bridged to dS
 const homeAssistantLabel = "digitalstrom"
 
+// CoverEntityFeature flag of covers supporting set_cover_tilt_position
+const haCoverSupportSetTiltPosition = 128
+
+// FanEntityFeature flag of fans supporting set_direction
+const haFanSupportDirection = 4
+
 type HomeAssistantDevice struct {
 	GenericDevice
 	baseURL  string
 	token    string
 	entityID string
+	domain   string
 	name     string
 
+	// range of the colortemp channel in mired, read from the Kelvin range of the light
 	minMireds int
 	maxMireds int
 
+	minTemp float32
+	maxTemp float32
+
 	devices         map[string]*HomeAssistantDevice
 	devicesMu       sync.RWMutex
 	listenerStarted bool
+	// the websocket for the state changes is subscribed, see WebsocketConnected
+	websocketConnected atomic.Bool
+	reaper             deviceReaper
+
+	// entities with this label are bridged, homeAssistantLabel unless configured otherwise
+	label string
 
 	supportsBrightness bool
 	supportsColorTemp  bool
@@ -56,11 +76,27 @@ type haStateAttrs struct {
 	FriendlyName       string    `json:"friendly_name"`
 	SupportedColorMode []string  `json:"supported_color_modes"`
 	Brightness         *int      `json:"brightness"`
-	ColorTemp          *int      `json:"color_temp"`
+	ColorTempKelvin    *int      `json:"color_temp_kelvin"`
 	HSColor            []float64 `json:"hs_color"`
 	ColorMode          string    `json:"color_mode"`
-	MinMireds          *int      `json:"min_mireds"`
-	MaxMireds          *int      `json:"max_mireds"`
+	MinColorTempKelvin *int      `json:"min_color_temp_kelvin"`
+	MaxColorTempKelvin *int      `json:"max_color_temp_kelvin"`
+	DeviceClass        string    `json:"device_class"`
+
+	// cover
+	SupportedFeatures   int  `json:"supported_features"`
+	CurrentPosition     *int `json:"current_position"`
+	CurrentTiltPosition *int `json:"current_tilt_position"`
+
+	// climate
+	CurrentTemperature *float32 `json:"current_temperature"`
+	Temperature        *float32 `json:"temperature"`
+	MinTemp            *float32 `json:"min_temp"`
+	MaxTemp            *float32 `json:"max_temp"`
+
+	// fan
+	Percentage *int   `json:"percentage"`
+	Direction  string `json:"direction"`
 }
 
 type haWSMessage struct {
@@ -91,6 +127,18 @@ type haEventData struct {
 	NewState haState `json:"new_state"`
 }
 
+// SetLabel sets the label of the entities to bridge, before the discovery is started
+func (e *HomeAssistantDevice) SetLabel(label string) {
+	e.label = strings.TrimSpace(label)
+}
+
+func (e *HomeAssistantDevice) bridgeLabel() string {
+	if e.label == "" {
+		return homeAssistantLabel
+	}
+	return e.label
+}
+
 func (e *HomeAssistantDevice) StartDiscovery(vdcdClient *vdcdapi.Client, baseURL string, token string) {
 	e.vdcdClient = vdcdClient
 	e.baseURL = strings.TrimRight(baseURL, "/")
@@ -101,7 +149,7 @@ func (e *HomeAssistantDevice) StartDiscovery(vdcdClient *vdcdapi.Client, baseURL
 		return
 	}
 
-	log.WithField("baseURL", e.baseURL).Info("Starting Home Assistant light discovery")
+	log.WithField("baseURL", e.baseURL).Info("Starting Home Assistant entity discovery")
 
 	if e.devices == nil {
 		e.devices = make(map[string]*HomeAssistantDevice)
@@ -132,12 +180,70 @@ func (e *HomeAssistantDevice) vcdcChannelCallback() func(message *vdcdapi.Generi
 	return f
 }
 
+func (e *HomeAssistantDevice) vcdcMoveCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.Debugf("Home Assistant vcdcMoveCallBack called for Device %s\n", device.UniqueID)
+		e.Move(message.Direction)
+	}
+
+	return f
+}
+
+func (e *HomeAssistantDevice) vcdcControlCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.Debugf("Home Assistant vcdcControlCallBack called for Device %s\n", device.UniqueID)
+		if message.Name == "heatingLevel" {
+			e.SetHeatingLevel(message.Value)
+		}
+	}
+
+	return f
+}
+
+func (e *HomeAssistantDevice) vcdcSyncCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.Debugf("Home Assistant vcdcSyncCallBack called for Device %s\n", device.UniqueID)
+		e.Sync()
+	}
+
+	return f
+}
+
+// Sync fetches the current entity state and applies it to the channels
+func (e *HomeAssistantDevice) Sync() {
+	state, err := e.fetchState(e.entityID)
+	if err != nil {
+		log.WithError(err).WithField("entity", e.entityID).Warn("Home Assistant state fetch failed")
+		return
+	}
+
+	e.applyStateUpdate(state)
+}
+
 func (e *HomeAssistantDevice) SetValue(value float32, channelName string, channelType vdcdapi.ChannelTypeType) {
 	log.Infof("Home Assistant Set Value for %s to %f on Channel '%s'", e.entityID, value, channelName)
 
-	e.originDevice.SetValue(value, channelName)
+	value = e.originDevice.SetValue(value, channelName)
 
 	switch channelName {
+	case "airflowIntensity":
+		if value <= 0 {
+			e.callFanService("turn_off", nil)
+			return
+		}
+		e.callFanService("set_percentage", map[string]interface{}{"percentage": int(math.Round(float64(value)))})
+	case "airflowDirection":
+		direction := "forward"
+		if value == 2 {
+			direction = "reverse"
+		}
+		e.callFanService("set_direction", map[string]interface{}{"direction": direction})
+	case "heatingPower":
+		e.SetHeatingLevel(value)
+	case "shadePositionOutside":
+		e.callCoverService("set_cover_position", map[string]interface{}{"position": int(math.Round(float64(value)))})
+	case "shadeOpeningAngleOutside":
+		e.callCoverService("set_cover_tilt_position", map[string]interface{}{"tilt_position": int(math.Round(float64(value)))})
 	case "basic_switch":
 		if value > 0 {
 			e.TurnOn(nil)
@@ -152,9 +258,8 @@ func (e *HomeAssistantDevice) SetValue(value float32, channelName string, channe
 		brightness := float32(value)
 		e.TurnOn(map[string]interface{}{"brightness_pct": brightness})
 	case "colortemp":
-		mireds := kelvinToMireds(int(value))
-		mireds = clampMireds(mireds, e.minMireds, e.maxMireds)
-		e.TurnOn(map[string]interface{}{"color_temp": mireds})
+		// Home Assistant deprecated the mired attributes, the vdcd uses mired
+		e.TurnOn(map[string]interface{}{"color_temp_kelvin": int(vdcdapi.MiredToKelvin(value))})
 	case "hue":
 		sat, _ := e.originDevice.GetValue("saturation")
 		e.TurnOn(map[string]interface{}{"hs_color": []float32{value, sat}})
@@ -164,6 +269,14 @@ func (e *HomeAssistantDevice) SetValue(value float32, channelName string, channe
 	}
 }
 
+// RecallScene activates the mapped Home Assistant scene entity
+func (e *HomeAssistantDevice) RecallScene(sceneEntityID string) {
+	payload := map[string]interface{}{"entity_id": sceneEntityID}
+	if err := e.callService("scene", "turn_on", payload); err != nil {
+		log.WithError(err).WithField("scene", sceneEntityID).Error("Home Assistant scene.turn_on failed")
+	}
+}
+
 func (e *HomeAssistantDevice) TurnOn(extra map[string]interface{}) {
 	payload := map[string]interface{}{"entity_id": e.entityID}
 	for k, v := range extra {
@@ -183,6 +296,21 @@ func (e *HomeAssistantDevice) TurnOff() {
 }
 
 func (e *HomeAssistantDevice) applyInitialState(state haState) {
+	switch e.domain {
+	case "binary_sensor":
+		e.applyBinarySensorState(state)
+		return
+	case "cover":
+		e.applyCoverState(state)
+		return
+	case "climate":
+		e.applyClimateState(state)
+		return
+	case "fan":
+		e.applyFanState(state)
+		return
+	}
+
 	switch state.State {
 	case "on":
 		e.originDevice.UpdateValue(100, "basic_switch", vdcdapi.UndefinedType)
@@ -191,13 +319,11 @@ func (e *HomeAssistantDevice) applyInitialState(state haState) {
 	}
 
 	if state.Attributes.Brightness != nil {
-		brightnessPct := float32(*state.Attributes.Brightness) / 255 * 100
-		e.originDevice.UpdateValue(brightnessPct, "brightness", vdcdapi.BrightnessType)
+		e.originDevice.UpdateValue(vdcdapi.ScaleToPercent(float32(*state.Attributes.Brightness), 255), "brightness", vdcdapi.BrightnessType)
 	}
 
-	if state.Attributes.ColorTemp != nil {
-		kelvin := miredsToKelvin(*state.Attributes.ColorTemp)
-		e.originDevice.UpdateValue(float32(kelvin), "colortemp", vdcdapi.ColorTemperatureType)
+	if state.Attributes.ColorTempKelvin != nil {
+		e.originDevice.UpdateValue(vdcdapi.KelvinToMired(float32(*state.Attributes.ColorTempKelvin)), "colortemp", vdcdapi.ColorTemperatureType)
 	}
 
 	if len(state.Attributes.HSColor) == 2 {
@@ -207,6 +333,21 @@ func (e *HomeAssistantDevice) applyInitialState(state haState) {
 }
 
 func (e *HomeAssistantDevice) applyStateUpdate(state haState) {
+	switch e.domain {
+	case "binary_sensor":
+		e.applyBinarySensorState(state)
+		return
+	case "cover":
+		e.applyCoverState(state)
+		return
+	case "climate":
+		e.applyClimateState(state)
+		return
+	case "fan":
+		e.applyFanState(state)
+		return
+	}
+
 	switch state.State {
 	case "on":
 		e.originDevice.UpdateValue(100, "basic_switch", vdcdapi.UndefinedType)
@@ -215,13 +356,11 @@ func (e *HomeAssistantDevice) applyStateUpdate(state haState) {
 	}
 
 	if state.Attributes.Brightness != nil {
-		brightnessPct := float32(*state.Attributes.Brightness) / 255 * 100
-		e.originDevice.UpdateValue(brightnessPct, "brightness", vdcdapi.BrightnessType)
+		e.originDevice.UpdateValue(vdcdapi.ScaleToPercent(float32(*state.Attributes.Brightness), 255), "brightness", vdcdapi.BrightnessType)
 	}
 
-	if state.Attributes.ColorTemp != nil {
-		kelvin := miredsToKelvin(*state.Attributes.ColorTemp)
-		e.originDevice.UpdateValue(float32(kelvin), "colortemp", vdcdapi.ColorTemperatureType)
+	if state.Attributes.ColorTempKelvin != nil {
+		e.originDevice.UpdateValue(vdcdapi.KelvinToMired(float32(*state.Attributes.ColorTempKelvin)), "colortemp", vdcdapi.ColorTemperatureType)
 	}
 
 	if len(state.Attributes.HSColor) == 2 {
@@ -236,14 +375,22 @@ func (e *HomeAssistantDevice) discoverAndRegister() error {
 		return err
 	}
 
+	labeled := make(map[string]bool)
+	defer e.reapDevices(labeled)
+
 	for _, entry := range entityEntries {
-		if !strings.HasPrefix(entry.EntityID, "light.") {
+		// Only entity domains with a matching dS device are bridged
+		domain, _, _ := strings.Cut(entry.EntityID, ".")
+		switch domain {
+		case "light", "binary_sensor", "cover", "climate", "fan":
+		default:
 			continue
 		}
 
-		if !hasLabel(entry.Labels, homeAssistantLabel) {
+		if !hasLabel(entry.Labels, e.bridgeLabel()) {
 			continue
 		}
+		labeled[entry.EntityID] = true
 
 		e.devicesMu.RLock()
 		_, exists := e.devices[entry.EntityID]
@@ -263,41 +410,40 @@ func (e *HomeAssistantDevice) discoverAndRegister() error {
 		haDevice.baseURL = e.baseURL
 		haDevice.token = e.token
 		haDevice.entityID = entry.EntityID
+		haDevice.domain = domain
 		haDevice.name = resolveHAName(entry, state)
-		haDevice.supportsBrightness, haDevice.supportsColorTemp, haDevice.supportsColor = detectLightCapabilities(state.Attributes.SupportedColorMode)
-		haDevice.minMireds = normalizeMireds(state.Attributes.MinMireds, 153)
-		haDevice.maxMireds = normalizeMireds(state.Attributes.MaxMireds, 500)
-
-		device := new(vdcdapi.Device)
-		device.SetChannelMessageCB(haDevice.vcdcChannelCallback())
-		device.SourceDevice = haDevice
 
-		uniqueID := haDevice.entityID
-		switch {
-		case haDevice.supportsColor:
-			device.NewColorLightDevice(e.vdcdClient, uniqueID)
-		case haDevice.supportsColorTemp:
-			device.NewCTLightDevice(e.vdcdClient, uniqueID)
-		case haDevice.supportsBrightness:
-			device.NewLightDevice(e.vdcdClient, uniqueID, true)
-		default:
-			device.NewLightDevice(e.vdcdClient, uniqueID, false)
+		var device *vdcdapi.Device
+		switch domain {
+		case "light":
+			device = haDevice.newLightDevice(state)
+		case "binary_sensor":
+			device = haDevice.newBinarySensorDevice(state)
+		case "cover":
+			device = haDevice.newCoverDevice(state)
+		case "climate":
+			device = haDevice.newClimateDevice(state)
+		case "fan":
+			device = haDevice.newFanDevice(state)
 		}
 
 		device.SetName(haDevice.name)
 		device.ModelName = "Home Assistant"
 		device.ConfigUrl = haDevice.baseURL
+		device.SourceDevice = haDevice
+		device.SetSource("homeassistant", haDevice.entityID)
+		device.SetRemoveCB(e.vcdcRemoveCallback(haDevice.entityID))
 
 		haDevice.originDevice = device
 
-		_, notfounderr := e.vdcdClient.GetDeviceByUniqueId(uniqueID)
-		if notfounderr != nil {
-			log.WithFields(log.Fields{
-				"entity": haDevice.entityID,
-				"name":   haDevice.name,
-			}).Info("Home Assistant light discovered")
-			e.vdcdClient.AddDevice(device)
+		// ignored by an override or already bridged, the entity is not tracked
+		if !e.vdcdClient.AddDevice(device) {
+			continue
 		}
+		log.WithFields(log.Fields{
+			"entity": haDevice.entityID,
+			"name":   haDevice.name,
+		}).Infof("Home Assistant %s discovered", domain)
 
 		haDevice.applyInitialState(state)
 
@@ -309,6 +455,244 @@ func (e *HomeAssistantDevice) discoverAndRegister() error {
 	return nil
 }
 
+// reapDevices schedules the removal of bridged entities which lost the label
+// or were deleted, and cancels it for entities labeled again
+func (e *HomeAssistantDevice) reapDevices(labeled map[string]bool) {
+	e.devicesMu.RLock()
+	defer e.devicesMu.RUnlock()
+
+	for entityID, haDevice := range e.devices {
+		if labeled[entityID] {
+			e.reaper.seen(haDevice.originDevice.Tag)
+		} else {
+			e.reaper.gone(e.vdcdClient, haDevice.originDevice.Tag)
+		}
+	}
+}
+
+// vcdcRemoveCallback forgets the entity, it is added again once labeled again
+func (e *HomeAssistantDevice) vcdcRemoveCallback(entityID string) func(device *vdcdapi.Device) {
+	f := func(device *vdcdapi.Device) {
+		log.Debugf("Home Assistant vcdcRemoveCallBack called for Device %s\n", device.UniqueID)
+		e.devicesMu.Lock()
+		delete(e.devices, entityID)
+		e.devicesMu.Unlock()
+	}
+
+	return f
+}
+
+// newLightDevice creates the vdcd device for a light entity depending on the supported color modes
+func (e *HomeAssistantDevice) newLightDevice(state haState) *vdcdapi.Device {
+	e.supportsBrightness, e.supportsColorTemp, e.supportsColor = detectLightCapabilities(state.Attributes.SupportedColorMode)
+	// the warmest color has the most mired
+	e.minMireds = kelvinToMireds(state.Attributes.MaxColorTempKelvin, 153)
+	e.maxMireds = kelvinToMireds(state.Attributes.MinColorTempKelvin, 500)
+
+	device := new(vdcdapi.Device)
+	device.SetChannelMessageCB(e.vcdcChannelCallback())
+	device.SetSyncMessageCB(e.vcdcSyncCallback())
+	device.SetSceneCommandCB(sceneCommandCallback(e.RecallScene))
+
+	uniqueID := e.entityID
+	switch {
+	case e.supportsColor:
+		device.NewColorLightDevice(e.vdcdClient, uniqueID)
+	case e.supportsColorTemp:
+		device.NewCTLightDevice(e.vdcdClient, uniqueID)
+	case e.supportsBrightness:
+		device.NewLightDevice(e.vdcdClient, uniqueID, true)
+	default:
+		device.NewLightDevice(e.vdcdClient, uniqueID, false)
+	}
+
+	if e.supportsColorTemp {
+		device.SetChannelRange("colortemp", float32(e.minMireds), float32(e.maxMireds))
+	}
+
+	device.Sync = true
+	device.SceneCommands = true
+
+	return device
+}
+
+// newBinarySensorDevice creates an input device for a binary_sensor entity, the
+// input type is derived from the device class
+func (e *HomeAssistantDevice) newBinarySensorDevice(state haState) *vdcdapi.Device {
+	inputType, _ := haBinarySensorInputType(state.Attributes.DeviceClass)
+
+	device := new(vdcdapi.Device)
+	device.NewInputDevice(e.vdcdClient, e.entityID)
+	device.AddInput(newBinaryInput("state", inputType, state.Attributes.DeviceClass))
+
+	return device
+}
+
+// newCoverDevice creates a shadow device for a cover entity, with an angle
+// channel when the cover supports tilt positions
+func (e *HomeAssistantDevice) newCoverDevice(state haState) *vdcdapi.Device {
+	hasTilt := state.Attributes.SupportedFeatures&haCoverSupportSetTiltPosition != 0
+
+	device := new(vdcdapi.Device)
+	device.NewShadowDevice(e.vdcdClient, e.entityID, hasTilt)
+	device.SetChannelMessageCB(e.vcdcChannelCallback())
+	device.SetMoveMessageCB(e.vcdcMoveCallback())
+	device.SetSyncMessageCB(e.vcdcSyncCallback())
+	device.SetSceneCommandCB(sceneCommandCallback(e.RecallScene))
+	device.Sync = true
+	device.SceneCommands = true
+
+	return device
+}
+
+func (e *HomeAssistantDevice) applyCoverState(state haState) {
+	if state.Attributes.CurrentPosition != nil {
+		e.originDevice.UpdateValue(float32(*state.Attributes.CurrentPosition), "shadePositionOutside", vdcdapi.BlindsShadePositionType)
+	}
+
+	if state.Attributes.CurrentTiltPosition != nil {
+		e.originDevice.UpdateValue(float32(*state.Attributes.CurrentTiltPosition), "shadeOpeningAngleOutside", vdcdapi.BlindShadeAngleType)
+	}
+}
+
+// Move opens or closes the cover until the stop, direction 0 stops
+func (e *HomeAssistantDevice) Move(direction int) {
+	switch {
+	case direction > 0:
+		e.callCoverService("open_cover", nil)
+	case direction < 0:
+		e.callCoverService("close_cover", nil)
+	default:
+		e.callCoverService("stop_cover", nil)
+	}
+}
+
+func (e *HomeAssistantDevice) callCoverService(service string, extra map[string]interface{}) {
+	payload := map[string]interface{}{"entity_id": e.entityID}
+	for k, v := range extra {
+		payload[k] = v
+	}
+
+	if err := e.callService("cover", service, payload); err != nil {
+		log.WithError(err).WithField("entity", e.entityID).Errorf("Home Assistant cover.%s failed", service)
+	}
+}
+
+// newClimateDevice creates a heating valve for a climate entity, the heating
+// level is mapped to the target temperature within the range of the entity
+func (e *HomeAssistantDevice) newClimateDevice(state haState) *vdcdapi.Device {
+	e.minTemp = 5
+	e.maxTemp = 30
+	if state.Attributes.MinTemp != nil && state.Attributes.MaxTemp != nil && *state.Attributes.MaxTemp > *state.Attributes.MinTemp {
+		e.minTemp = *state.Attributes.MinTemp
+		e.maxTemp = *state.Attributes.MaxTemp
+	}
+
+	device := new(vdcdapi.Device)
+	device.NewHeatingValveDevice(e.vdcdClient, e.entityID)
+	device.SetChannelMessageCB(e.vcdcChannelCallback())
+	device.SetControlMessageCB(e.vcdcControlCallback())
+	device.SetSyncMessageCB(e.vcdcSyncCallback())
+	device.Sync = true
+
+	return device
+}
+
+func (e *HomeAssistantDevice) applyClimateState(state haState) {
+	if state.Attributes.CurrentTemperature != nil {
+		e.originDevice.UpdateSensorValue(*state.Attributes.CurrentTemperature, fmt.Sprintf("%s-temperature", e.originDevice.UniqueID))
+	}
+}
+
+// SetHeatingLevel maps the heating level of the dS room temperature controller to the target temperature
+func (e *HomeAssistantDevice) SetHeatingLevel(level float32) {
+	payload := map[string]interface{}{
+		"entity_id":   e.entityID,
+		"temperature": heatingLevelToSetpoint(level, e.minTemp, e.maxTemp),
+	}
+
+	if err := e.callService("climate", "set_temperature", payload); err != nil {
+		log.WithError(err).WithField("entity", e.entityID).Error("Home Assistant climate.set_temperature failed")
+	}
+}
+
+// newFanDevice creates a ventilation device for a fan entity, with an airflow
+// direction channel when the fan supports changing the direction
+func (e *HomeAssistantDevice) newFanDevice(state haState) *vdcdapi.Device {
+	hasDirection := state.Attributes.SupportedFeatures&haFanSupportDirection != 0
+
+	device := new(vdcdapi.Device)
+	device.NewVentilationDevice(e.vdcdClient, e.entityID, hasDirection)
+	device.SetChannelMessageCB(e.vcdcChannelCallback())
+	device.SetSyncMessageCB(e.vcdcSyncCallback())
+	device.Sync = true
+
+	return device
+}
+
+func (e *HomeAssistantDevice) applyFanState(state haState) {
+	switch {
+	case state.State == "off":
+		e.originDevice.UpdateValue(0, "airflowIntensity", vdcdapi.AirflowIntesityType)
+	case state.Attributes.Percentage != nil:
+		e.originDevice.UpdateValue(float32(*state.Attributes.Percentage), "airflowIntensity", vdcdapi.AirflowIntesityType)
+	}
+
+	switch state.Attributes.Direction {
+	case "forward":
+		e.originDevice.UpdateValue(1, "airflowDirection", vdcdapi.AirflowDirectionType)
+	case "reverse":
+		e.originDevice.UpdateValue(2, "airflowDirection", vdcdapi.AirflowDirectionType)
+	}
+}
+
+func (e *HomeAssistantDevice) callFanService(service string, extra map[string]interface{}) {
+	payload := map[string]interface{}{"entity_id": e.entityID}
+	for k, v := range extra {
+		payload[k] = v
+	}
+
+	if err := e.callService("fan", service, payload); err != nil {
+		log.WithError(err).WithField("entity", e.entityID).Errorf("Home Assistant fan.%s failed", service)
+	}
+}
+
+func (e *HomeAssistantDevice) applyBinarySensorState(state haState) {
+	_, inverted := haBinarySensorInputType(state.Attributes.DeviceClass)
+
+	switch state.State {
+	case "on":
+		e.originDevice.UpdateInputValue(boolToInputValue(!inverted), "state")
+	case "off":
+		e.originDevice.UpdateInputValue(boolToInputValue(inverted), "state")
+	}
+}
+
+// haBinarySensorInputType maps the device class of a binary_sensor to the dS input type.
+// inverted is set for classes where "on" means open, but dS reports closed.
+func haBinarySensorInputType(deviceClass string) (inputType vdcdapi.InputType, inverted bool) {
+	switch deviceClass {
+	case "motion":
+		return vdcdapi.MotionInput, false
+	case "occupancy", "presence":
+		return vdcdapi.PresenceInput, false
+	case "door":
+		return vdcdapi.DoorClosedInput, true
+	case "garage_door":
+		return vdcdapi.GarageDoorClosedInput, true
+	case "window", "opening":
+		return vdcdapi.WindowClosedInput, true
+	case "smoke":
+		return vdcdapi.SmokeInput, false
+	case "battery":
+		return vdcdapi.DeviceLowBatteryInput, false
+	case "problem":
+		return vdcdapi.MalfunctionInput, false
+	}
+
+	return vdcdapi.NoSystemFunctionInput, false
+}
+
 func (e *HomeAssistantDevice) fetchEntityRegistry() ([]haEntityRegistryEntry, error) {
 	resp, err := e.doRequest("GET", "/api/config/entity_registry/list", nil)
 	if err == nil {
@@ -509,6 +893,7 @@ func (e *HomeAssistantDevice) listenStateChanges() {
 	for {
 		if err := e.listenStateChangesOnce(wsURL); err != nil {
 			log.WithError(err).Warn("Home Assistant websocket disconnected, retrying")
+			e.vdcdClient.Log(vdcdapi.LogWarning, fmt.Sprintf("Home Assistant websocket disconnected: %s", err))
 			time.Sleep(backoff)
 			backoff *= 2
 			if backoff > maxBackoff {
@@ -520,6 +905,11 @@ func (e *HomeAssistantDevice) listenStateChanges() {
 	}
 }
 
+// WebsocketConnected reports whether the websocket for the state changes is connected
+func (e *HomeAssistantDevice) WebsocketConnected() bool {
+	return e.websocketConnected.Load()
+}
+
 func (e *HomeAssistantDevice) listenStateChangesOnce(wsURL string) error {
 	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
 	if err != nil {
@@ -540,6 +930,9 @@ func (e *HomeAssistantDevice) listenStateChangesOnce(wsURL string) error {
 		return err
 	}
 
+	e.websocketConnected.Store(true)
+	defer e.websocketConnected.Store(false)
+
 	for {
 		if err := conn.SetReadDeadline(time.Now().Add(90 * time.Second)); err != nil {
 			return err
@@ -667,33 +1060,10 @@ func resolveHAName(entry haEntityRegistryEntry, state haState) string {
 	return entry.EntityID
 }
 
-func miredsToKelvin(mireds int) int {
-	if mireds <= 0 {
-		return 0
-	}
-	return int(1000000 / mireds)
-}
-
-func kelvinToMireds(kelvin int) int {
-	if kelvin <= 0 {
-		return 0
-	}
-	return int(1000000 / kelvin)
-}
-
-func clampMireds(value int, min int, max int) int {
-	if min > 0 && value < min {
-		return min
-	}
-	if max > 0 && value > max {
-		return max
-	}
-	return value
-}
-
-func normalizeMireds(value *int, fallback int) int {
-	if value == nil || *value == 0 {
+// kelvinToMireds converts a color temperature limit in Kelvin to mired, the fallback is used when it is not reported
+func kelvinToMireds(kelvin *int, fallback int) int {
+	if kelvin == nil || *kelvin <= 0 {
 		return fallback
 	}
-	return *value
+	return int(vdcdapi.KelvinToMired(float32(*kelvin)))
 }
@@ -0,0 +1,170 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+)
+
+// fakeHomeAssistant serves the REST API of Home Assistant used by the discovery
+// and records the service calls
+type fakeHomeAssistant struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	entities []haEntityRegistryEntry
+	states   map[string]haState
+	calls    []haServiceCall
+}
+
+type haServiceCall struct {
+	domain  string
+	service string
+	data    map[string]interface{}
+}
+
+func newFakeHomeAssistant(t *testing.T) *fakeHomeAssistant {
+	t.Helper()
+
+	ha := &fakeHomeAssistant{states: make(map[string]haState)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/config/entity_registry/list", func(w http.ResponseWriter, r *http.Request) {
+		ha.mu.Lock()
+		defer ha.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(ha.entities)
+	})
+	mux.HandleFunc("GET /api/states/{entity}", func(w http.ResponseWriter, r *http.Request) {
+		ha.mu.Lock()
+		defer ha.mu.Unlock()
+		state, ok := ha.states[r.PathValue("entity")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(state)
+	})
+	mux.HandleFunc("POST /api/services/{domain}/{service}", func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ha.mu.Lock()
+		defer ha.mu.Unlock()
+		ha.calls = append(ha.calls, haServiceCall{domain: r.PathValue("domain"), service: r.PathValue("service"), data: data})
+		_, _ = w.Write([]byte("[]"))
+	})
+
+	ha.Server = httptest.NewServer(mux)
+	t.Cleanup(ha.Close)
+
+	return ha
+}
+
+// addEntity adds a labeled entity with its state to the registry
+func (ha *fakeHomeAssistant) addEntity(state haState) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+
+	ha.entities = append(ha.entities, haEntityRegistryEntry{EntityID: state.EntityID, Labels: []string{homeAssistantLabel}})
+	ha.states[state.EntityID] = state
+}
+
+// lastCall returns the last call of the service, ok is false when it was not called
+func (ha *fakeHomeAssistant) lastCall(domain string, service string) (call haServiceCall, ok bool) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+
+	for _, c := range ha.calls {
+		if c.domain == domain && c.service == service {
+			call, ok = c, true
+		}
+	}
+	return call, ok
+}
+
+// newHomeAssistantDiscovery returns the discovery of the fake Home Assistant, without the
+// websocket for the state changes started by StartDiscovery
+func newHomeAssistantDiscovery(bridge *testBridge, ha *fakeHomeAssistant) *HomeAssistantDevice {
+	discovery := &HomeAssistantDevice{baseURL: ha.URL, token: "test", devices: make(map[string]*HomeAssistantDevice)}
+	discovery.vdcdClient = bridge.vdcdClient
+	return discovery
+}
+
+func intPtr(value int) *int {
+	return &value
+}
+
+func TestHomeAssistantColorTemperatureInKelvin(t *testing.T) {
+	bridge := newTestBridge(t)
+
+	ha := newFakeHomeAssistant(t)
+	ha.addEntity(haState{
+		EntityID: "light.desk",
+		State:    "on",
+		Attributes: haStateAttrs{
+			FriendlyName:       "Desk",
+			SupportedColorMode: []string{"color_temp"},
+			Brightness:         intPtr(255),
+			ColorTempKelvin:    intPtr(2700),
+			MinColorTempKelvin: intPtr(2000),
+			MaxColorTempKelvin: intPtr(6535),
+		},
+	})
+
+	discovery := newHomeAssistantDiscovery(bridge, ha)
+	if err := discovery.discoverAndRegister(); err != nil {
+		t.Fatalf("discovery failed: %s", err)
+	}
+	bridge.vdcd.AssertInit(t, "light.desk")
+
+	// the range in mired from the Kelvin range of the light
+	device, err := bridge.vdcdClient.GetDeviceByTag("light.desk")
+	if err != nil {
+		t.Fatalf("device not found: %s", err)
+	}
+	for _, channel := range device.Channels {
+		if channel.ChannelName == "colortemp" && (channel.Min != 153 || channel.Max != 500) {
+			t.Errorf("expected the colortemp range 153-500, got %v-%v", channel.Min, channel.Max)
+		}
+	}
+	bridge.assertValue(t, "light.desk", "colortemp", 370)
+
+	bridge.sendChannel(t, "light.desk", "colortemp", 300)
+	eventually(t, "the color temperature at 3333 K", func() bool {
+		call, ok := ha.lastCall("light", "turn_on")
+		return ok && call.data["color_temp_kelvin"] == float64(3333)
+	})
+	if call, _ := ha.lastCall("light", "turn_on"); call.data["color_temp"] != nil {
+		t.Errorf("deprecated color_temp sent: %v", call.data)
+	}
+}
+
+func TestHomeAssistantIgnoredEntityIsNotTracked(t *testing.T) {
+	bridge := newTestBridge(t)
+	bridge.vdcdClient.SetDeviceOverrides([]vdcdapi.DeviceOverride{{Backend: "homeassistant", SourceID: "light.hidden", Ignore: true}})
+
+	ha := newFakeHomeAssistant(t)
+	ha.addEntity(haState{EntityID: "light.hidden", State: "off", Attributes: haStateAttrs{SupportedColorMode: []string{"onoff"}}})
+	ha.addEntity(haState{EntityID: "light.hall", State: "off", Attributes: haStateAttrs{SupportedColorMode: []string{"onoff"}}})
+
+	discovery := newHomeAssistantDiscovery(bridge, ha)
+	if err := discovery.discoverAndRegister(); err != nil {
+		t.Fatalf("discovery failed: %s", err)
+	}
+	bridge.vdcd.AssertInit(t, "light.hall")
+
+	discovery.devicesMu.RLock()
+	defer discovery.devicesMu.RUnlock()
+	if _, ok := discovery.devices["light.hidden"]; ok {
+		t.Error("ignored entity tracked")
+	}
+	if _, ok := discovery.devices["light.hall"]; !ok {
+		t.Error("bridged entity not tracked")
+	}
+}
@@ -3,7 +3,11 @@ package discovery
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -14,12 +18,19 @@ import (
 type ShellyDevice struct {
 	GenericDevice
 	discoverySubscribed  bool
+	reaper               deviceReaper
 	Id                   string `json:"id,omitempty"`
 	Model                string `json:"model,omitempty"`
 	MACAddress           string `json:"mac,omitempty"`
 	IPAddress            string `json:"ip,omitempty"`
 	NewFirewareAvailable bool   `json:"new_fw,omitempty"`
 	FirmewareVersion     string `json:"fw_ver,omitempty"`
+	Mode                 string `json:"mode,omitempty"` // relay or roller
+
+	// pending toggle back of the "toggleFor" action, actions run concurrently
+	// and the remove callback stops it from yet another goroutine
+	toggleMu    sync.Mutex
+	toggleTimer *time.Timer
 }
 
 type ShellyInputEvent struct {
@@ -34,23 +45,45 @@ func (e *ShellyDevice) NewShellyDevice(vdcdClient *vdcdapi.Client, mqttClient mq
 	e.configureCallbacks()
 
 	device := new(vdcdapi.Device)
-	device.NewLightDevice(e.vdcdClient, e.MACAddress, false)
+	if e.isRoller() {
+		device.NewShadowDevice(e.vdcdClient, e.MACAddress, false)
+		device.SetMoveMessageCB(e.vcdcMoveCallback())
+	} else {
+		device.NewLightDevice(e.vdcdClient, e.MACAddress, false)
+	}
 	device.SetName(e.Id)
 	device.SetChannelMessageCB(e.vcdcChannelCallback())
+	device.SetSyncMessageCB(e.vcdcSyncCallback())
+	device.SetRemoveCB(e.vcdcRemoveCallback())
+	if !e.isRoller() {
+		device.AddAction("toggleFor", vdcdapi.Action{
+			Description: "Toggle for a number of seconds",
+			Params: map[string]vdcdapi.Param{
+				"duration": {Type: "numeric", SiUnit: "second", Default: 5, Min: 1, Max: 3600, Resolution: 1},
+			},
+		}, e.toggleForAction)
+	}
+	device.Sync = true
 	device.ModelName = e.Model
 	device.ModelVersion = e.FirmewareVersion
 	device.SourceDevice = e
+	device.SetSource("shelly", e.Id)
 
 	device.ConfigUrl = fmt.Sprintf("http://%s", e.IPAddress)
 
-	button := new(vdcdapi.Button)
-	button.LocalButton = true
-	button.Id = "input0"
-	button.ButtonType = vdcdapi.SingleButton
-	button.Group = vdcdapi.YellowLightGroup
-	button.HardwareName = "toggle"
+	if !e.isRoller() {
+		button := new(vdcdapi.Button)
+		button.LocalButton = true
+		button.Id = "input0"
+		button.ButtonType = vdcdapi.SingleButton
+		button.Group = vdcdapi.YellowLightGroup
+		button.HardwareName = "toggle"
+
+		device.AddButton(*button)
+	}
 
-	device.AddButton(*button)
+	device.AddProperty("newFirmware", vdcdapi.Property{Readonly: true, Type: "boolean"})
+	e.updateFirmwareProperty(device, e.NewFirewareAvailable)
 
 	e.originDevice = device
 	e.vdcdClient.AddDevice(device)
@@ -65,7 +98,7 @@ func (e *ShellyDevice) SetValue(value float32, channelName string, channelType v
 	log.Infof("Set Value for Shelly Device %s to %f\n", e.Id, value)
 
 	// Also sync the state with originDevice
-	e.originDevice.SetValue(value, channelName)
+	value = e.originDevice.SetValue(value, channelName)
 
 	switch channelName {
 	case "basic_switch":
@@ -75,6 +108,9 @@ func (e *ShellyDevice) SetValue(value float32, channelName string, channelType v
 			e.TurnOff()
 		}
 
+	case "shadePositionOutside":
+		e.SetRollerPosition(value)
+
 	}
 
 }
@@ -93,6 +129,7 @@ func (e *ShellyDevice) StartDiscovery(vdcdClient *vdcdapi.Client, mqttClient mqt
 
 	e.subscribeMqttTopic("shellies/announce", e.mqttDiscoverCallback())
 	e.subscribeMqttTopic("shellies/+/info", e.mqttDiscoverCallback())
+	e.subscribeMqttTopic("shellies/+/online", e.mqttDiscoverCallback())
 	e.TriggerDiscovery()
 }
 
@@ -122,6 +159,26 @@ func (e *ShellyDevice) mqttCallback() mqtt.MessageHandler {
 			if strings.Contains(string(msg.Payload()), "off") {
 				e.originDevice.UpdateValue(0, "basic_switch", vdcdapi.UndefinedType)
 			}
+
+			e.notifyState()
+		}
+
+		// Position in percent, -1 while the roller is not calibrated
+		if strings.HasSuffix(msg.Topic(), "roller/0/pos") {
+			if position, err := strconv.ParseFloat(string(msg.Payload()), 32); err == nil && position >= 0 {
+				e.originDevice.UpdateValue(float32(position), "shadePositionOutside", vdcdapi.BlindsShadePositionType)
+			}
+
+			e.notifyState()
+		}
+
+		if strings.HasSuffix(msg.Topic(), "/announce") {
+			var announce ShellyDevice
+			if err := json.Unmarshal(msg.Payload(), &announce); err != nil {
+				log.WithError(err).Error("Unmarshal to Shelly Device failed")
+				return
+			}
+			e.updateFirmwareProperty(e.originDevice, announce.NewFirewareAvailable)
 		}
 
 	}
@@ -129,12 +186,25 @@ func (e *ShellyDevice) mqttCallback() mqtt.MessageHandler {
 	return f
 }
 
+// updateFirmwareProperty reports whether a firmware update is available for the Shelly
+func (e *ShellyDevice) updateFirmwareProperty(device *vdcdapi.Device, available bool) {
+	if err := device.SetProperty("newFirmware", available); err != nil {
+		log.WithError(err).WithField("UniqueID", device.UniqueID).Warn("Failed to update firmware property")
+	}
+}
+
 func (e *ShellyDevice) mqttDiscoverCallback() mqtt.MessageHandler {
 
 	var f mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 
 		log.Debugf("MQTT Mesage for Shelly Device discovery: %s: %s\n", string(msg.Topic()), string(msg.Payload()))
 
+		// Last will of the device, removed when offline longer than the grace period
+		if strings.HasSuffix(msg.Topic(), "/online") {
+			e.updateOnline(strings.Split(msg.Topic(), "/")[1], string(msg.Payload()) == "true")
+			return
+		}
+
 		if strings.Contains(msg.Topic(), "announce") {
 
 			shellyDevice := new(ShellyDevice)
@@ -146,10 +216,12 @@ func (e *ShellyDevice) mqttDiscoverCallback() mqtt.MessageHandler {
 
 			log.Infof("Shelly Device discovered: Name: %s, IP: %s, Mac %s\n", shellyDevice.Id, shellyDevice.IPAddress, shellyDevice.MACAddress)
 
-			_, notfounderr := e.vdcdClient.GetDeviceByUniqueId(shellyDevice.MACAddress)
+			device, notfounderr := e.vdcdClient.GetDeviceByUniqueId(shellyDevice.MACAddress)
 			if notfounderr != nil {
 				log.Debugf("Shelly Device not found in vcdc -> Adding \n")
 				shellyDevice.NewShellyDevice(e.vdcdClient, e.mqttClient)
+			} else {
+				e.reaper.seen(device.Tag)
 			}
 
 		}
@@ -161,6 +233,22 @@ func (e *ShellyDevice) mqttDiscoverCallback() mqtt.MessageHandler {
 	return f
 }
 
+// updateOnline schedules or cancels the removal of the Shelly with the given id
+func (e *ShellyDevice) updateOnline(id string, online bool) {
+	for _, device := range e.vdcdClient.GetDevices() {
+		shellyDevice, ok := device.SourceDevice.(*ShellyDevice)
+		if !ok || shellyDevice.Id != id {
+			continue
+		}
+
+		if online {
+			e.reaper.seen(device.Tag)
+		} else {
+			e.reaper.gone(e.vdcdClient, device.Tag)
+		}
+	}
+}
+
 func (e *ShellyDevice) vcdcChannelCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
 
 	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
@@ -171,6 +259,110 @@ func (e *ShellyDevice) vcdcChannelCallback() func(message *vdcdapi.GenericVDCDMe
 	return f
 }
 
+func (e *ShellyDevice) vcdcMoveCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.Debugf("vcdcMoveCallBack called for Device %s\n", device.UniqueID)
+		e.Move(message.Direction)
+	}
+
+	return f
+}
+
+func (e *ShellyDevice) vcdcSyncCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.Debugf("vcdcSyncCallBack called for Device %s\n", device.UniqueID)
+		e.Sync()
+	}
+
+	return f
+}
+
+func (e *ShellyDevice) vcdcRemoveCallback() func(device *vdcdapi.Device) {
+
+	f := func(device *vdcdapi.Device) {
+		log.Debugf("vcdcRemoveCallBack called for Device %s\n", device.UniqueID)
+		e.toggleMu.Lock()
+		if e.toggleTimer != nil {
+			e.toggleTimer.Stop()
+			e.toggleTimer = nil
+		}
+		e.toggleMu.Unlock()
+		e.unsubscribeMqttTopics(fmt.Sprintf("shellies/%s/#", e.Id))
+	}
+
+	return f
+}
+
+// Sync asks the device to republish its status, including the relay or roller state
+func (e *ShellyDevice) Sync() {
+	e.awaitState(func() { e.publishMqttCommand("shellies/"+e.Id+"/command", "update") })
+}
+
+// toggleForAction toggles the relay and toggles it back after the "duration" param in seconds
+func (e *ShellyDevice) toggleForAction(device *vdcdapi.Device, params map[string]interface{}) error {
+	duration, err := vdcdapi.ParamFloat(params, "duration", 5)
+	if err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return fmt.Errorf("invalid duration %f", duration)
+	}
+
+	e.toggleMu.Lock()
+	defer e.toggleMu.Unlock()
+
+	// A running toggleFor is replaced, the relay is back in its original state first
+	if e.toggleTimer != nil {
+		e.toggleTimer.Stop()
+		e.toggleTimer = nil
+		e.publishMqttCommand("shellies/"+e.Id+"/relay/0/command", "toggle")
+	}
+
+	if err := e.publishMqtt("shellies/"+e.Id+"/relay/0/command", "toggle"); err != nil {
+		return err
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(duration*float32(time.Second)), func() {
+		e.toggleMu.Lock()
+		defer e.toggleMu.Unlock()
+
+		// replaced by a later toggleFor, which already toggled back
+		if e.toggleTimer != timer {
+			return
+		}
+		e.toggleTimer = nil
+		e.publishMqttCommand("shellies/"+e.Id+"/relay/0/command", "toggle")
+	})
+	e.toggleTimer = timer
+
+	return nil
+}
+
+// isRoller checks if the Shelly runs in roller shutter mode
+func (e *ShellyDevice) isRoller() bool {
+	return e.Mode == "roller"
+}
+
+// Move opens or closes the roller until the stop, direction 0 stops
+func (e *ShellyDevice) Move(direction int) {
+	switch {
+	case direction > 0:
+		e.publishMqttCommand("shellies/"+e.Id+"/roller/0/command", "open")
+	case direction < 0:
+		e.publishMqttCommand("shellies/"+e.Id+"/roller/0/command", "close")
+	default:
+		e.publishMqttCommand("shellies/"+e.Id+"/roller/0/command", "stop")
+	}
+}
+
+// SetRollerPosition moves the roller to the position, 0 = closed, 100 = open
+func (e *ShellyDevice) SetRollerPosition(position float32) {
+	e.publishMqttCommand("shellies/"+e.Id+"/roller/0/command/pos", int(math.Round(float64(position))))
+}
+
 func (e *ShellyDevice) TurnOn() {
 	e.publishMqttCommand("shellies/"+e.Id+"/relay/0/command", "on")
 }
@@ -0,0 +1,127 @@
+package discovery
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/splattner/vdcd-bridge/pkg/mqtttest"
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+)
+
+func TestShellyRelay(t *testing.T) {
+	bridge := newTestBridge(t)
+
+	// announced on the announce request of the discovery
+	shelly := mqtttest.NewShelly(bridge.broker, "shelly1-B929CC", "B4E62DB929CC")
+
+	new(ShellyDevice).StartDiscovery(bridge.vdcdClient, bridge.mqttClient)
+
+	device := bridge.vdcd.AssertInit(t, "B4E62DB929CC")
+	if device.Name != "shelly1-B929CC" || device.ModelName != "SHSW-1" {
+		t.Errorf("unexpected device %s, model %s", device.Name, device.ModelName)
+	}
+
+	bridge.sendChannel(t, "B4E62DB929CC", "basic_switch", 100)
+	eventually(t, "the relay to switch on", shelly.On)
+
+	bridge.sendChannel(t, "B4E62DB929CC", "basic_switch", 0)
+	eventually(t, "the relay to switch off", func() bool { return !shelly.On() })
+	bridge.sync(t, "B4E62DB929CC")
+	bridge.assertValue(t, "B4E62DB929CC", "basic_switch", 0)
+
+	// switched with the wall switch
+	shelly.SetRelay(true)
+	bridge.vdcd.AssertChannel(t, "B4E62DB929CC", "basic_switch", 100)
+}
+
+func TestShellyRoller(t *testing.T) {
+	bridge := newTestBridge(t)
+
+	shelly := mqtttest.NewShelly(bridge.broker, "shellyswitch25-C45BBE", "C45BBE6A1F2E")
+	shelly.Model = "SHSW-25"
+	shelly.Mode = "roller"
+
+	new(ShellyDevice).StartDiscovery(bridge.vdcdClient, bridge.mqttClient)
+
+	device := bridge.vdcd.AssertInit(t, "C45BBE6A1F2E")
+	if device.Output != vdcdapi.ShadowOutput {
+		t.Errorf("expected a shadow output, got %s", device.Output)
+	}
+
+	bridge.sendChannel(t, "C45BBE6A1F2E", "shadePositionOutside", 60)
+	eventually(t, "the roller at 60", func() bool { return shelly.Position() == 60 })
+	bridge.sync(t, "C45BBE6A1F2E")
+	bridge.assertValue(t, "C45BBE6A1F2E", "shadePositionOutside", 60)
+
+	// opened until the stop
+	if err := bridge.vdcd.SendMove("C45BBE6A1F2E", 0, 1); err != nil {
+		t.Fatalf("failed to send move: %s", err)
+	}
+	eventually(t, "the roller to open", func() bool { return shelly.Position() == 100 })
+	bridge.vdcd.AssertChannel(t, "C45BBE6A1F2E", "shadePositionOutside", 100)
+}
+
+func TestShellyRemoval(t *testing.T) {
+	bridge := newTestBridge(t)
+
+	shelly := mqtttest.NewShelly(bridge.broker, "shelly1-B929CD", "B4E62DB929CD")
+
+	new(ShellyDevice).StartDiscovery(bridge.vdcdClient, bridge.mqttClient)
+	bridge.vdcd.AssertInit(t, "B4E62DB929CD")
+
+	// the last will of the Shelly
+	shelly.SetOnline(false)
+	bridge.assertRemoved(t, "B4E62DB929CD")
+}
+
+func TestShellyOverlappingToggleFor(t *testing.T) {
+	bridge := newTestBridge(t)
+
+	shelly := mqtttest.NewShelly(bridge.broker, "shelly1-B929CE", "B4E62DB929CE")
+
+	new(ShellyDevice).StartDiscovery(bridge.vdcdClient, bridge.mqttClient)
+	bridge.vdcd.AssertInit(t, "B4E62DB929CE")
+
+	device, err := bridge.vdcdClient.GetDeviceByTag("B4E62DB929CE")
+	if err != nil {
+		t.Fatalf("device not found: %s", err)
+	}
+	shellyDevice := device.SourceDevice.(*ShellyDevice)
+
+	// actions are invoked concurrently by the vdcd client
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := shellyDevice.toggleForAction(device, map[string]interface{}{"duration": 0.1}); err != nil {
+				t.Errorf("toggleFor failed: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	toggles := func() int {
+		count := 0
+		for _, message := range bridge.broker.Messages() {
+			if message.Topic == "shellies/shelly1-B929CE/relay/0/command" {
+				count++
+			}
+		}
+		return count
+	}
+
+	// every replaced toggleFor toggles back before it toggles again
+	eventually(t, "7 toggles", func() bool { return toggles() == 7 })
+	if !shelly.On() {
+		t.Fatal("relay not toggled")
+	}
+	eventually(t, "the relay to be toggled back", func() bool { return !shelly.On() })
+
+	// no replaced timer toggles it again
+	time.Sleep(200 * time.Millisecond)
+	if count := toggles(); count != 8 || shelly.On() {
+		t.Fatalf("expected the relay off after 8 toggles, got %d toggles", count)
+	}
+}
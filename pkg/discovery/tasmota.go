@@ -3,6 +3,7 @@ package discovery
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 
@@ -11,9 +12,19 @@ import (
 	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
 )
 
+// Number of fan speeds of the Sonoff iFan modules
+const tasmotaIFANSpeeds = 3
+
+// Range of the Tasmota CT command in mired
+const (
+	tasmotaMinCT = 153
+	tasmotaMaxCT = 500
+)
+
 type TasmotaDevice struct {
 	GenericDevice
 	discoverySubscribed bool
+	reaper              deviceReaper
 	IPAddress           string         `json:"ip,omitempty"`
 	DeviceName          string         `json:"dn,omitempty"`
 	FriendlyName        []string       `json:"fn,omitempty"`
@@ -37,6 +48,7 @@ type TasmotaDevice struct {
 	LK                  int            `json:"lk,omitempty"`    // LightColor (LC) and RGB LinKed https://github.com/arendst/Tasmota/blob/development/tasmota/xdrv_04_light.ino#L689
 	LightSubtype        int            `json:"lt_st,omitempty"` // https://github.com/arendst/Tasmota/blob/development/tasmota/xdrv_04_light.ino
 	ShutterOptions      []int          `json:"sho,omitempty"`
+	ShutterTilt         [][]int        `json:"sht,omitempty"`
 	Version             int            `json:"ver,omitempty"`
 }
 
@@ -48,12 +60,25 @@ type TasmotaResultMsg struct {
 	HSBCOlor string `json:"HSBColor,omitempty"`
 	White    int    `json:"White,omitempty"`
 	Channel  []int  `json:"Channel,omitempty"`
+	FanSpeed *int   `json:"FanSpeed,omitempty"`
+	CT       *int   `json:"CT,omitempty"`
+
+	Shutter1 *TasmotaShutterMsg `json:"Shutter1,omitempty"`
+}
+
+type TasmotaShutterMsg struct {
+	Position  int `json:"Position"`
+	Direction int `json:"Direction"`
+	Target    int `json:"Target"`
+	Tilt      int `json:"Tilt"`
 }
 
 type TasmotaTeleMsg struct {
 	Time     string              `json:"time,omitempty"`
 	TempUnit string              `json:"TempUnit,omitempty"`
 	SI7021   TasmotaTeleSI721Msg `json:"SI7021,omitempty"`
+
+	Shutter1 *TasmotaShutterMsg `json:"Shutter1,omitempty"`
 }
 
 type TasmotaTeleSI721Msg struct {
@@ -69,22 +94,37 @@ func (e *TasmotaDevice) NewTasmotaDevice(vdcdClient *vdcdapi.Client, mqttClient
 
 	device := new(vdcdapi.Device)
 
-	switch e.LightSubtype {
-	case 0:
+	switch {
+	case e.IFAN == 1:
+		// Sonoff iFan, the light relay is not bridged
+		device.NewVentilationDevice(e.vdcdClient, e.MACAddress, false)
+	case e.isShutter():
+		device.NewShadowDevice(e.vdcdClient, e.MACAddress, e.hasShutterTilt())
+	case e.LightSubtype == 0:
 		// Sonoff Basic
 		device.NewLightDevice(e.vdcdClient, e.MACAddress, false)
-	case 4:
+	case e.LightSubtype == 4:
 		// RGBW
 		device.NewColorLightDevice(e.vdcdClient, e.MACAddress)
+		device.SetChannelRange("colortemp", tasmotaMinCT, tasmotaMaxCT)
+		device.Move = true
 	default:
 		device.NewLightDevice(e.vdcdClient, e.MACAddress, false)
 	}
 
 	device.SetName(e.FriendlyName[0])
 	device.SetChannelMessageCB(e.vcdcChannelCallback())
+	device.SetMoveMessageCB(e.vcdcMoveCallback())
+	device.SetSyncMessageCB(e.vcdcSyncCallback())
+	device.SetSceneCommandCB(sceneCommandCallback(e.RecallScene))
+	device.SetRemoveCB(e.vcdcRemoveCallback())
+	device.AddAction("restart", vdcdapi.Action{Description: "Restart"}, e.restartAction)
+	device.Sync = true
+	device.SceneCommands = true
 	device.ModelName = e.Module
 	device.ModelVersion = e.SoftwareVersion
 	device.SourceDevice = e
+	device.SetSource("tasmota", e.Topic)
 
 	device.ConfigUrl = fmt.Sprintf("http://%s", e.IPAddress)
 
@@ -121,7 +161,7 @@ func (e *TasmotaDevice) SetValue(value float32, channelName string, channelType
 	log.Infof("Set Value Tasmota Device %s %s to %f on Channel '%s' \n", e.DeviceName, e.FriendlyName[0], value, channelName)
 
 	// Also sync the state with originDevice
-	e.originDevice.SetValue(value, channelName)
+	value = e.originDevice.SetValue(value, channelName)
 
 	switch channelName {
 	case "basic_switch":
@@ -152,6 +192,15 @@ func (e *TasmotaDevice) SetValue(value float32, channelName string, channelType
 	case "colortemp":
 		e.SetColorTemp(value)
 
+	case "airflowIntensity":
+		e.publishMqttCommand("cmnd/"+e.Topic+"/FanSpeed", intensityToSpeed(value, tasmotaIFANSpeeds))
+
+	case "shadePositionOutside":
+		e.SetShutterPosition(value)
+
+	case "shadeOpeningAngleOutside":
+		e.SetShutterTilt(value)
+
 	}
 
 }
@@ -187,7 +236,8 @@ func (e *TasmotaDevice) mqttCallback() mqtt.MessageHandler {
 
 		log.Debugf("Tasmota MQTT Message for %s, Topic %s, Message %s", e.DeviceName, string(msg.Topic()), string(msg.Payload()))
 
-		if strings.Contains(msg.Topic(), "RESULT") {
+		// The response to the STATE command contains the same fields as a RESULT
+		if strings.Contains(msg.Topic(), "RESULT") || strings.HasSuffix(msg.Topic(), "/STATE") {
 
 			var resultMesage TasmotaResultMsg
 			err := json.Unmarshal(msg.Payload(), &resultMesage)
@@ -199,7 +249,7 @@ func (e *TasmotaDevice) mqttCallback() mqtt.MessageHandler {
 			if resultMesage.Power1 == "ON" || resultMesage.Power == "ON" {
 				e.originDevice.UpdateValue(100, "basic_switch", vdcdapi.UndefinedType)
 			}
-			if resultMesage.Power1 == "OFF" || resultMesage.Power == "ON" {
+			if resultMesage.Power1 == "OFF" || resultMesage.Power == "OFF" {
 				e.originDevice.UpdateValue(0, "basic_switch", vdcdapi.UndefinedType)
 			}
 
@@ -220,12 +270,26 @@ func (e *TasmotaDevice) mqttCallback() mqtt.MessageHandler {
 
 			}
 
+			if resultMesage.Shutter1 != nil {
+				e.updateShutter(resultMesage.Shutter1)
+			}
+
+			if resultMesage.FanSpeed != nil {
+				e.originDevice.UpdateValue(speedToIntensity(*resultMesage.FanSpeed, tasmotaIFANSpeeds), "airflowIntensity", vdcdapi.AirflowIntesityType)
+			}
+
+			if resultMesage.CT != nil {
+				e.originDevice.UpdateValue(float32(*resultMesage.CT), "colortemp", vdcdapi.ColorTemperatureType)
+			}
+
 			if resultMesage.White > 0 {
 				//e.originDevice.UpdateValue(float32(0), "hue", vdcdapi.HueType)
 				e.originDevice.UpdateValue(float32(0), "saturation", vdcdapi.SaturationType)
 				e.originDevice.UpdateValue(float32(resultMesage.White), "brightness", vdcdapi.BrightnessType)
 
 			}
+
+			e.notifyState()
 		}
 
 		if strings.Contains(msg.Topic(), "SENSOR") {
@@ -239,6 +303,10 @@ func (e *TasmotaDevice) mqttCallback() mqtt.MessageHandler {
 			e.originDevice.UpdateSensorValue(teleMsg.SI7021.Temperature, fmt.Sprintf("%s-temperature", e.originDevice.UniqueID))
 			e.originDevice.UpdateSensorValue(teleMsg.SI7021.Humidity, fmt.Sprintf("%s-humidity", e.originDevice.UniqueID))
 
+			if teleMsg.Shutter1 != nil {
+				e.updateShutter(teleMsg.Shutter1)
+			}
+
 		}
 
 	}
@@ -254,6 +322,12 @@ func (e *TasmotaDevice) mqttDiscoverCallback() mqtt.MessageHandler {
 
 		if strings.Contains(msg.Topic(), "config") {
 
+			// A cleared discovery config means the device has been removed
+			if len(msg.Payload()) == 0 {
+				e.deviceGone(msg.Topic())
+				return
+			}
+
 			tasmotaDevice := new(TasmotaDevice)
 			err := json.Unmarshal(msg.Payload(), &tasmotaDevice)
 			if err != nil {
@@ -263,10 +337,12 @@ func (e *TasmotaDevice) mqttDiscoverCallback() mqtt.MessageHandler {
 
 			log.Infof("Tasmota Device discovered: Name: %s, FriendlyName: %s, IP: %s, Mac %s\n", tasmotaDevice.DeviceName, tasmotaDevice.FriendlyName[0], tasmotaDevice.IPAddress, tasmotaDevice.MACAddress)
 
-			_, notfounderr := e.vdcdClient.GetDeviceByUniqueId(tasmotaDevice.MACAddress)
+			device, notfounderr := e.vdcdClient.GetDeviceByUniqueId(tasmotaDevice.MACAddress)
 			if notfounderr != nil {
 				log.Debugf("Tasmota Device %s not found in vcdc\n", tasmotaDevice.FriendlyName[0])
 				tasmotaDevice.NewTasmotaDevice(e.vdcdClient, e.mqttClient)
+			} else {
+				e.reaper.seen(device.Tag)
 			}
 		}
 
@@ -275,6 +351,33 @@ func (e *TasmotaDevice) mqttDiscoverCallback() mqtt.MessageHandler {
 	return f
 }
 
+// deviceGone schedules the removal of the device of the discovery topic
+// tasmota/discovery/<mac>/config
+func (e *TasmotaDevice) deviceGone(topic string) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 4 {
+		return
+	}
+
+	device, err := e.vdcdClient.GetDeviceByUniqueId(parts[2])
+	if err != nil {
+		return
+	}
+
+	e.reaper.gone(e.vdcdClient, device.Tag)
+}
+
+func (e *TasmotaDevice) vcdcRemoveCallback() func(device *vdcdapi.Device) {
+
+	f := func(device *vdcdapi.Device) {
+		log.Debugf("vcdcRemoveCallBack called for Device %s\n", device.UniqueID)
+		e.stopMove()
+		e.unsubscribeMqttTopics(fmt.Sprintf("stat/%s/#", e.Topic), fmt.Sprintf("tele/%s/#", e.Topic))
+	}
+
+	return f
+}
+
 func (e *TasmotaDevice) vcdcChannelCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
 
 	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
@@ -285,6 +388,66 @@ func (e *TasmotaDevice) vcdcChannelCallback() func(message *vdcdapi.GenericVDCDM
 	return f
 }
 
+func (e *TasmotaDevice) vcdcMoveCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.Debugf("vcdcMoveCallBack called for Device %s\n", device.UniqueID)
+		e.Move(message.Direction)
+	}
+
+	return f
+}
+
+func (e *TasmotaDevice) vcdcSyncCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.Debugf("vcdcSyncCallBack called for Device %s\n", device.UniqueID)
+		e.Sync()
+	}
+
+	return f
+}
+
+// Sync requests the current state from the device and waits for the answer
+func (e *TasmotaDevice) Sync() {
+	e.awaitState(func() { e.publishMqttCommand("cmnd/"+e.Topic+"/STATE", "") })
+}
+
+// restartAction restarts the Tasmota device
+func (e *TasmotaDevice) restartAction(device *vdcdapi.Device, params map[string]interface{}) error {
+	return e.publishMqtt("cmnd/"+e.Topic+"/Restart", 1)
+}
+
+// RecallScene runs the mapped Backlog command, e.g. "Power1 on; Dimmer 30"
+func (e *TasmotaDevice) RecallScene(backlog string) {
+	e.publishMqttCommand("cmnd/"+e.Topic+"/Backlog", backlog)
+}
+
+// Move dims the light in steps while the dS button is held, direction 0 stops.
+// Shutters are opened or closed until the stop.
+func (e *TasmotaDevice) Move(direction int) {
+	if e.isShutter() {
+		switch {
+		case direction > 0:
+			e.publishMqttCommand("cmnd/"+e.Topic+"/ShutterOpen1", "")
+		case direction < 0:
+			e.publishMqttCommand("cmnd/"+e.Topic+"/ShutterClose1", "")
+		default:
+			e.publishMqttCommand("cmnd/"+e.Topic+"/ShutterStop1", "")
+		}
+		return
+	}
+
+	switch {
+	case direction > 0:
+		e.startMove(func() { e.publishMqttCommand("cmnd/"+e.Topic+"/Dimmer", "+") })
+	case direction < 0:
+		e.startMove(func() { e.publishMqttCommand("cmnd/"+e.Topic+"/Dimmer", "-") })
+	default:
+		e.stopMove()
+	}
+}
+
 func (e *TasmotaDevice) TurnOn() {
 	e.publishMqttCommand("cmnd/"+e.Topic+"/POWER", "on")
 }
@@ -314,6 +477,47 @@ func (e *TasmotaDevice) SetWhite(white float32) {
 	e.publishMqttCommand("cmnd/"+e.Topic+"/White", white)
 }
 
+// SetColorTemp sets the color temperature in mired, the channel is limited to the range of Tasmota
 func (e *TasmotaDevice) SetColorTemp(ct float32) {
-	log.Warningln("Setting Color Temp not implemented")
+	e.publishMqttCommand("cmnd/"+e.Topic+"/CT", int(ct))
+}
+
+// isShutter checks if the first relay is configured as a shutter relay
+func (e *TasmotaDevice) isShutter() bool {
+	return len(e.Relays) > 0 && e.Relays[0] == 3
+}
+
+// hasShutterTilt checks if a tilt duration is configured for the first shutter
+func (e *TasmotaDevice) hasShutterTilt() bool {
+	return len(e.ShutterTilt) > 0 && len(e.ShutterTilt[0]) > 2 && e.ShutterTilt[0][2] > 0
+}
+
+// isShutterInverted checks the invert option of the first shutter, then 0 is open
+func (e *TasmotaDevice) isShutterInverted() bool {
+	return len(e.ShutterOptions) > 0 && e.ShutterOptions[0]&1 == 1
+}
+
+// SetShutterPosition moves the shutter to the dS position, 0 = closed, 100 = open
+func (e *TasmotaDevice) SetShutterPosition(position float32) {
+	if e.isShutterInverted() {
+		position = 100 - position
+	}
+	e.publishMqttCommand("cmnd/"+e.Topic+"/ShutterPosition1", int(math.Round(float64(position))))
+}
+
+// SetShutterTilt sets the slat angle, the dS angle 0-100 maps to the Tasmota tilt -90 to 90
+func (e *TasmotaDevice) SetShutterTilt(angle float32) {
+	e.publishMqttCommand("cmnd/"+e.Topic+"/ShutterTilt1", int(math.Round(float64(angle)*1.8-90)))
+}
+
+func (e *TasmotaDevice) updateShutter(shutter *TasmotaShutterMsg) {
+	position := float32(shutter.Position)
+	if e.isShutterInverted() {
+		position = 100 - position
+	}
+	e.originDevice.UpdateValue(position, "shadePositionOutside", vdcdapi.BlindsShadePositionType)
+
+	if e.hasShutterTilt() {
+		e.originDevice.UpdateValue(float32(shutter.Tilt+90)/1.8, "shadeOpeningAngleOutside", vdcdapi.BlindShadeAngleType)
+	}
 }
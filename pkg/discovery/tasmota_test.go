@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/splattner/vdcd-bridge/pkg/mqtttest"
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+)
+
+func TestTasmotaRelay(t *testing.T) {
+	bridge := newTestBridge(t)
+
+	sonoff := mqtttest.NewTasmota(bridge.broker, "DC4F22AABB01", "sonoff-kitchen", "Kitchen")
+	sonoff.Announce()
+
+	new(TasmotaDevice).StartDiscovery(bridge.vdcdClient, bridge.mqttClient)
+
+	device := bridge.vdcd.AssertInit(t, "DC4F22AABB01")
+	if device.Name != "Kitchen" || device.ModelName != "Sonoff Basic" {
+		t.Errorf("unexpected device %s, model %s", device.Name, device.ModelName)
+	}
+	if device.Output != vdcdapi.BasicOutput {
+		t.Errorf("expected a basic output, got %s", device.Output)
+	}
+
+	// switched by the vdcd
+	bridge.sendChannel(t, "DC4F22AABB01", "basic_switch", 100)
+	eventually(t, "the relay to switch on", sonoff.Power)
+	bridge.sync(t, "DC4F22AABB01")
+	bridge.assertValue(t, "DC4F22AABB01", "basic_switch", 100)
+
+	bridge.sendChannel(t, "DC4F22AABB01", "basic_switch", 0)
+	eventually(t, "the relay to switch off", func() bool { return !sonoff.Power() })
+	bridge.sync(t, "DC4F22AABB01")
+	bridge.assertValue(t, "DC4F22AABB01", "basic_switch", 0)
+
+	// switched at the device
+	sonoff.SetPower(true)
+	bridge.vdcd.AssertChannel(t, "DC4F22AABB01", "basic_switch", 100)
+	bridge.sync(t, "DC4F22AABB01")
+	bridge.assertValue(t, "DC4F22AABB01", "basic_switch", 100)
+
+	sonoff.SetPower(false)
+	bridge.vdcd.AssertChannel(t, "DC4F22AABB01", "basic_switch", 0)
+
+	sonoff.PublishSensor(21.5, 48)
+	bridge.vdcd.AssertSensor(t, "DC4F22AABB01", "DC4F22AABB01-temperature", 21.5)
+	bridge.vdcd.AssertSensor(t, "DC4F22AABB01", "DC4F22AABB01-humidity", 48)
+}
+
+func TestTasmotaColorLight(t *testing.T) {
+	bridge := newTestBridge(t)
+
+	bulb := mqtttest.NewTasmota(bridge.broker, "DC4F22AABB02", "bulb-living", "Living")
+	bulb.LightSubtype = 4
+	bulb.Announce()
+
+	new(TasmotaDevice).StartDiscovery(bridge.vdcdClient, bridge.mqttClient)
+
+	device := bridge.vdcd.AssertInit(t, "DC4F22AABB02")
+	if device.Output != vdcdapi.ColorLightOutput {
+		t.Errorf("expected a color light output, got %s", device.Output)
+	}
+
+	// without saturation the brightness is set as white
+	bridge.sendChannel(t, "DC4F22AABB02", "brightness", 40)
+	eventually(t, "the dimmer at 40", func() bool { return bulb.Dimmer() == 40 })
+
+	bridge.sendChannel(t, "DC4F22AABB02", "colortemp", 300)
+	eventually(t, "the color temperature at 300", func() bool { return bulb.CT() == 300 })
+
+	// out of the Tasmota range, the channel is limited to it
+	bridge.sendChannel(t, "DC4F22AABB02", "colortemp", 100)
+	eventually(t, "the color temperature at 153", func() bool { return bulb.CT() == 153 })
+
+	bridge.sync(t, "DC4F22AABB02")
+	bridge.assertValue(t, "DC4F22AABB02", "brightness", 40)
+	bridge.assertValue(t, "DC4F22AABB02", "colortemp", 153)
+}
+
+func TestTasmotaRemoval(t *testing.T) {
+	bridge := newTestBridge(t)
+
+	sonoff := mqtttest.NewTasmota(bridge.broker, "DC4F22AABB03", "sonoff-garage", "Garage")
+	sonoff.Announce()
+
+	new(TasmotaDevice).StartDiscovery(bridge.vdcdClient, bridge.mqttClient)
+	bridge.vdcd.AssertInit(t, "DC4F22AABB03")
+
+	sonoff.Remove()
+	bridge.assertRemoved(t, "DC4F22AABB03")
+
+	// the relay is no longer bridged
+	bridge.vdcd.Reset()
+	sonoff.SetPower(true)
+	bridge.vdcd.AssertNoMessage(t, "channel", "DC4F22AABB03", 100*time.Millisecond)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	mdns "github.com/hashicorp/mdns"
@@ -13,65 +14,81 @@ import (
 	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
 )
 
+// Relative brightness change per step while dimming with a held dS button (0-255 scale)
+const wledMoveStep = 15
+
 type WledDevice struct {
 	GenericDevice
+	reaper    deviceReaper
 	Id        string
 	IPAddress string
 	Name      string
 	MAC       string
 	Brand     string
 	Product   string
+
+	// hosts which are added without mDNS, e.g. in another subnet
+	staticHosts []string
 }
 
+// wledInfo is the device metadata of /json/info
+type wledInfo struct {
+	Ver     string `json:"ver"`
+	Mac     string `json:"mac"`
+	Brand   string `json:"brand"`
+	Product string `json:"product"`
+}
+
+// NewWledDevice adds the WLED at the ip, nil when its /json/info cannot be read.
+// Without the MAC the device would be added under another uniqueid.
 func (w *WledDevice) NewWledDevice(vdcdClient *vdcdapi.Client, ip string, name string) *vdcdapi.Device {
 	w.vdcdClient = vdcdClient
 	w.IPAddress = ip
 	w.Name = name
-	w.Id = ip // Use IP as unique ID for now
+	w.Id = ip // Use IP as unique ID if the MAC is not reported
+
+	// Query WLED info endpoint for version and device metadata
+	info, err := w.readInfo()
+	if err != nil {
+		log.WithError(err).WithField("Host", ip).Warn("Failed to read WLED info, device not added")
+		return nil
+	}
+
+	if info.Mac != "" {
+		w.MAC = info.Mac
+		w.Id = info.Mac // Use MAC as unique ID if available
+	}
 
 	device := new(vdcdapi.Device)
 	device.NewColorLightDevice(vdcdClient, w.Id)
 	device.SetName(w.Name)
 	device.SetChannelMessageCB(w.vcdcChannelCallback())
+	device.SetMoveMessageCB(w.vcdcMoveCallback())
+	device.SetSyncMessageCB(w.vcdcSyncCallback())
+	device.SetSceneCommandCB(sceneCommandCallback(w.RecallScene))
+	device.AddAction("playEffect", vdcdapi.Action{
+		Description: "Play effect",
+		Params: map[string]vdcdapi.Param{
+			"effect": {Type: "numeric", Min: 0, Max: 255, Resolution: 1},
+		},
+	}, w.playEffectAction)
+	device.Move = true
+	device.Sync = true
+	device.SceneCommands = true
 	device.ModelName = "WLED"
+	device.ModelVersion = info.Ver
+	device.HardwareName = info.Mac
 	device.SourceDevice = w
+	device.SetSource("wled", w.IPAddress)
 	device.ConfigUrl = fmt.Sprintf("http://%s", w.IPAddress)
 
-	// Query WLED info endpoint for version and device metadata
-	infoUrl := fmt.Sprintf("http://%s/json/info", w.IPAddress)
-	resp, err := http.Get(infoUrl)
-	if err == nil {
-		defer func() {
-			if err := resp.Body.Close(); err != nil {
-				log.WithError(err).Warn("WLED info response close failed")
-			}
-		}()
-		if resp.StatusCode == 200 {
-			var info struct {
-				Ver     string `json:"ver"`
-				Mac     string `json:"mac"`
-				Brand   string `json:"brand"`
-				Product string `json:"product"`
-			}
-			if err := json.NewDecoder(resp.Body).Decode(&info); err == nil {
-				device.ModelVersion = info.Ver
-				if info.Brand != "" {
-					w.Brand = info.Brand
-					device.VendorName = info.Brand
-				}
-				if info.Product != "" {
-					w.Product = info.Product
-					device.ModelName = info.Product
-				}
-				if info.Mac != "" {
-					w.MAC = info.Mac
-					device.HardwareName = info.Mac
-					device.UniqueID = info.Mac // Override UniqueID with MAC if available
-					device.Tag = info.Mac      // Store MAC in Tag for reference
-					w.Id = info.Mac            // Use MAC as unique ID if available
-				}
-			}
-		}
+	if info.Brand != "" {
+		w.Brand = info.Brand
+		device.VendorName = info.Brand
+	}
+	if info.Product != "" {
+		w.Product = info.Product
+		device.ModelName = info.Product
 	}
 
 	w.originDevice = device
@@ -80,9 +97,42 @@ func (w *WledDevice) NewWledDevice(vdcdClient *vdcdapi.Client, ip string, name s
 	return device
 }
 
+// readInfo reads the device metadata from /json/info
+func (w *WledDevice) readInfo() (wledInfo, error) {
+	var info wledInfo
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/json/info", w.IPAddress))
+	if err != nil {
+		return info, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.WithError(err).Warn("WLED info response close failed")
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// bridgedWledDevice returns the device announced for the WLED host. A device
+// restored from the store is not returned, it is taken over by the announcement.
+func bridgedWledDevice(vdcdClient *vdcdapi.Client, host string) (*vdcdapi.Device, bool) {
+	for _, device := range vdcdClient.GetDevices() {
+		if device.Backend == "wled" && device.SourceID == host && !device.Restored() {
+			return device, true
+		}
+	}
+	return nil, false
+}
+
 func (w *WledDevice) SetValue(value float32, channelName string, channelType vdcdapi.ChannelTypeType) {
 	log.Infof("Set Value for WLED Device %s to %f (channel: %s, type: %v)\n", w.Id, value, channelName, channelType)
-	w.originDevice.SetValue(value, channelName)
+	value = w.originDevice.SetValue(value, channelName)
 
 	switch channelName {
 	case "basic_switch":
@@ -103,7 +153,7 @@ func (w *WledDevice) SetValue(value float32, channelName string, channelType vdc
 // SetBrightness sets the brightness (0-100) for the WLED device
 func (w *WledDevice) SetBrightness(brightness float32) {
 	url := fmt.Sprintf("http://%s/json/state", w.IPAddress)
-	bri := int(brightness / 100 * 255)
+	bri := int(vdcdapi.PercentToScale(brightness, 255))
 	body := map[string]interface{}{"bri": bri}
 	jsonBody, _ := json.Marshal(body)
 	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonBody))
@@ -177,6 +227,36 @@ func hsvToRgb(h, s, v float32) (int, int, int) {
 	return int((r+m)*255 + 0.5), int((g+m)*255 + 0.5), int((b+m)*255 + 0.5)
 }
 
+// rgbToHueSat converts RGB (0-255) to hue (0-360) and saturation (0-100)
+func rgbToHueSat(r, g, b int) (float32, float32) {
+	rf, gf, bf := float32(r)/255, float32(g)/255, float32(b)/255
+	cMax := max(rf, gf, bf)
+	cMin := min(rf, gf, bf)
+	delta := cMax - cMin
+
+	var hue float32
+	switch {
+	case delta == 0:
+		hue = 0
+	case cMax == rf:
+		hue = 60 * (gf - bf) / delta
+	case cMax == gf:
+		hue = 60 * ((bf-rf)/delta + 2)
+	default:
+		hue = 60 * ((rf-gf)/delta + 4)
+	}
+	if hue < 0 {
+		hue += 360
+	}
+
+	var saturation float32
+	if cMax > 0 {
+		saturation = delta / cMax * 100
+	}
+
+	return hue, saturation
+}
+
 func absInt(x int) int {
 	if x < 0 {
 		return -x
@@ -198,20 +278,27 @@ func DiscoverWledDevices(vdcdClient *vdcdapi.Client) []*vdcdapi.Device {
 
 	var devices []*vdcdapi.Device
 	entriesCh := make(chan *mdns.ServiceEntry, 4)
-	defer close(entriesCh)
+	entriesDone := make(chan struct{})
 
 	// WLED advertises as _wled._tcp
 	go func() {
+		defer close(entriesDone)
 		for entry := range entriesCh {
 			if !containsWledService(entry.Name) {
 				continue
 			}
 			ip := entry.AddrV4.String()
 			name := strings.ReplaceAll(entry.Name, "._wled._tcp.local.", "")
+			if device, ok := bridgedWledDevice(vdcdClient, ip); ok {
+				devices = append(devices, device)
+				continue
+			}
+
 			wled := &WledDevice{}
-			device := wled.NewWledDevice(vdcdClient, ip, name)
-			devices = append(devices, device)
-			log.Infof("Discovered WLED device: %s (%s)", name, ip)
+			if device := wled.NewWledDevice(vdcdClient, ip, name); device != nil {
+				devices = append(devices, device)
+				log.Infof("Discovered WLED device: %s (%s)", name, ip)
+			}
 		}
 	}()
 
@@ -224,6 +311,11 @@ func DiscoverWledDevices(vdcdClient *vdcdapi.Client) []*vdcdapi.Device {
 		DisableIPv6: true,
 	}
 	_ = mdns.Query(params)
+
+	// All discovered devices are added before returning them
+	close(entriesCh)
+	<-entriesDone
+
 	return devices
 }
 
@@ -252,8 +344,58 @@ func (w *WledDevice) sendWledState(on bool) {
 	_, _ = io.ReadAll(resp.Body)
 }
 
+// SetStaticHosts sets WLED hosts which are added in addition to the ones found with mDNS
+func (w *WledDevice) SetStaticHosts(hosts []string) {
+	w.staticHosts = nil
+	for _, host := range hosts {
+		if host = strings.TrimSpace(host); host != "" {
+			w.staticHosts = append(w.staticHosts, host)
+		}
+	}
+}
+
 func (w *WledDevice) StartDiscovery(vdcdClient *vdcdapi.Client) {
-	DiscoverWledDevices(vdcdClient)
+	w.vdcdClient = vdcdClient
+
+	discovered := make(map[string]bool)
+	for _, device := range DiscoverWledDevices(vdcdClient) {
+		discovered[device.UniqueID] = true
+	}
+
+	w.addStaticHosts(discovered)
+	w.reapDevices(discovered)
+}
+
+// addStaticHosts adds the static hosts not bridged yet and marks them discovered
+func (w *WledDevice) addStaticHosts(discovered map[string]bool) {
+	for _, host := range w.staticHosts {
+		if device, ok := bridgedWledDevice(w.vdcdClient, host); ok {
+			discovered[device.UniqueID] = true
+			continue
+		}
+
+		wled := &WledDevice{}
+		if device := wled.NewWledDevice(w.vdcdClient, host, host); device != nil {
+			discovered[device.UniqueID] = true
+			log.Infof("Added static WLED device: %s", host)
+		}
+	}
+}
+
+// reapDevices schedules the removal of WLED devices which disappeared from
+// mDNS and cancels it for devices which are announced again
+func (w *WledDevice) reapDevices(discovered map[string]bool) {
+	for _, device := range w.vdcdClient.GetDevices() {
+		if _, ok := device.SourceDevice.(*WledDevice); !ok {
+			continue
+		}
+
+		if discovered[device.UniqueID] {
+			w.reaper.seen(device.Tag)
+		} else {
+			w.reaper.gone(w.vdcdClient, device.Tag)
+		}
+	}
 }
 
 func (w *WledDevice) vcdcChannelCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
@@ -263,6 +405,126 @@ func (w *WledDevice) vcdcChannelCallback() func(message *vdcdapi.GenericVDCDMess
 	}
 }
 
+func (w *WledDevice) vcdcMoveCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+	return func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.Debugf("WLED vcdcMoveCallback called for Device %s", device.UniqueID)
+		w.Move(message.Direction)
+	}
+}
+
+func (w *WledDevice) vcdcSyncCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+	return func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.Debugf("WLED vcdcSyncCallback called for Device %s", device.UniqueID)
+		w.Sync()
+	}
+}
+
+// Sync reads the live state from /json/state and applies it to the channels
+func (w *WledDevice) Sync() {
+	url := fmt.Sprintf("http://%s/json/state", w.IPAddress)
+	resp, err := http.Get(url)
+	if err != nil {
+		log.WithError(err).Error("Failed to get WLED state")
+		return
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.WithError(err).Warn("WLED state response close failed")
+		}
+	}()
+
+	var state struct {
+		On  bool `json:"on"`
+		Bri int  `json:"bri"`
+		Seg []struct {
+			Col [][]int `json:"col"`
+		} `json:"seg"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		log.WithError(err).Error("Failed to decode WLED state")
+		return
+	}
+
+	if state.On {
+		w.originDevice.UpdateValue(100, "basic_switch", vdcdapi.UndefinedType)
+	} else {
+		w.originDevice.UpdateValue(0, "basic_switch", vdcdapi.UndefinedType)
+	}
+	w.originDevice.UpdateValue(vdcdapi.ScaleToPercent(float32(state.Bri), 255), "brightness", vdcdapi.BrightnessType)
+
+	if len(state.Seg) > 0 && len(state.Seg[0].Col) > 0 && len(state.Seg[0].Col[0]) >= 3 {
+		col := state.Seg[0].Col[0]
+		hue, saturation := rgbToHueSat(col[0], col[1], col[2])
+		w.originDevice.UpdateValue(hue, "hue", vdcdapi.HueType)
+		w.originDevice.UpdateValue(saturation, "saturation", vdcdapi.SaturationType)
+	}
+}
+
+// RecallScene applies the mapped WLED preset
+func (w *WledDevice) RecallScene(preset string) {
+	id, err := strconv.Atoi(preset)
+	if err != nil {
+		log.WithError(err).WithField("Preset", preset).Error("Invalid WLED preset id")
+		return
+	}
+
+	w.postState(map[string]interface{}{"ps": id})
+}
+
+// Move dims with relative brightness steps while the dS button is held, direction 0 stops
+func (w *WledDevice) Move(direction int) {
+	switch {
+	case direction > 0:
+		w.startMove(func() { w.postState(map[string]interface{}{"bri": fmt.Sprintf("~%d", wledMoveStep)}) })
+	case direction < 0:
+		w.startMove(func() { w.postState(map[string]interface{}{"bri": fmt.Sprintf("~-%d", wledMoveStep)}) })
+	default:
+		w.stopMove()
+	}
+}
+
+// playEffectAction turns the light on and plays the WLED effect given by the "effect" param
+func (w *WledDevice) playEffectAction(device *vdcdapi.Device, params map[string]interface{}) error {
+	effect, err := vdcdapi.ParamFloat(params, "effect", 0)
+	if err != nil {
+		return err
+	}
+
+	return w.setState(map[string]interface{}{
+		"on":  true,
+		"seg": []map[string]interface{}{{"fx": int(effect)}},
+	})
+}
+
+// postState posts a partial state to the WLED JSON API
+func (w *WledDevice) postState(body map[string]interface{}) {
+	if err := w.setState(body); err != nil {
+		log.WithError(err).Error("Failed to set WLED state")
+	}
+}
+
+// setState posts a partial state to the WLED JSON API and returns the result
+func (w *WledDevice) setState(body map[string]interface{}) error {
+	url := fmt.Sprintf("http://%s/json/state", w.IPAddress)
+	jsonBody, _ := json.Marshal(body)
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.WithError(err).Warn("WLED state response close failed")
+		}
+	}()
+	_, _ = io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("WLED returned status %s", resp.Status)
+	}
+
+	return nil
+}
+
 // containsWledService checks if the mDNS name contains _wled._tcp
 func containsWledService(name string) bool {
 	return strings.Contains(name, "_wled._tcp")
@@ -0,0 +1,53 @@
+package discovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWledStaticHosts(t *testing.T) {
+	bridge := newTestBridge(t)
+
+	var infoRequests atomic.Int32
+	wled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/json/info" {
+			http.NotFound(w, r)
+			return
+		}
+		infoRequests.Add(1)
+		_, _ = w.Write([]byte(`{"ver": "0.14.0", "mac": "a0b765a1b2c3", "brand": "WLED", "product": "FOSS"}`))
+	}))
+	defer wled.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	discovery := new(WledDevice)
+	discovery.vdcdClient = bridge.vdcdClient
+	discovery.SetStaticHosts([]string{strings.TrimPrefix(wled.URL, "http://"), strings.TrimPrefix(unreachable.URL, "http://")})
+
+	for run := 0; run < 3; run++ {
+		discovered := make(map[string]bool)
+		discovery.addStaticHosts(discovered)
+
+		// the unreachable host is not added under its ip
+		if len(discovered) != 1 || !discovered["a0b765a1b2c3"] {
+			t.Fatalf("run %d: expected only the MAC of the reachable host discovered, got %v", run, discovered)
+		}
+	}
+
+	device := bridge.vdcd.AssertInit(t, "a0b765a1b2c3")
+	if device.ModelName != "FOSS" || device.ModelVersion != "0.14.0" {
+		t.Errorf("unexpected model %s %s", device.ModelName, device.ModelVersion)
+	}
+
+	if devices := bridge.vdcdClient.GetDevices(); len(devices) != 1 {
+		t.Errorf("expected a single device, got %d", len(devices))
+	}
+	if requests := infoRequests.Load(); requests != 1 {
+		t.Errorf("expected the bridged host queried once, got %d", requests)
+	}
+}
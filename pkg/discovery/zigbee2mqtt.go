@@ -3,13 +3,36 @@ package discovery
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"sync"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
 	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
 )
 
+// Brightness change per second while dimming with a held dS button (0-254 scale)
+const z2mBrightnessMoveRate = 60
+
+// Access flag of exposed features which can be set
+const z2mAccessSet = 2
+
+// Default base topic of Zigbee2MQTT
+const defaultZigbee2MQTTBaseTopic = "zigbee2mqtt"
+
+// Exposed binary features reported as dS binary inputs, the order defines the input index
+var z2mBinaryInputs = []struct {
+	property  string
+	inputType vdcdapi.InputType
+}{
+	{"contact", vdcdapi.WindowClosedInput},
+	{"occupancy", vdcdapi.PresenceInput},
+	{"tamper", vdcdapi.NoSystemFunctionInput},
+	{"battery_low", vdcdapi.DeviceLowBatteryInput},
+}
+
 type Zigbee2MQTTDevice struct {
 	GenericDevice
 	discoverySubscribed bool
@@ -19,10 +42,27 @@ type Zigbee2MQTTDevice struct {
 
 	IsDevice bool
 	IsGroup  bool
+	IsCover  bool
+
+	reaper deviceReaper
+
+	// Thermostatic radiator valves are either controlled by the valve position
+	// or by a setpoint within the range of the device
+	IsHeatingValve   bool
+	valveProperty    string
+	setpointProperty string
+	setpointMin      float32
+	setpointMax      float32
+
+	// fan_mode values used as speed levels, slowest first
+	fanModes []string
 
 	Topic        string
 	FriendlyName string
 
+	// topic prefix of Zigbee2MQTT, "zigbee2mqtt" unless configured otherwise
+	baseTopic string
+
 	// For when there are multiple buttons on one device
 	// action is the identifier to get the correct device
 	actionID     int
@@ -35,7 +75,14 @@ type Zigbee2MQTTDevice struct {
 // The second subscribe would overwrite the registered callback function
 type MQTTProxy struct {
 	mqttClient mqtt.Client
-	receivers  map[string][]mqtt.MessageHandler
+	receivers  map[string][]mqttProxyReceiver
+	mu         sync.Mutex
+}
+
+// mqttProxyReceiver is a callback registered by the owner, so it can be removed again
+type mqttProxyReceiver struct {
+	owner    interface{}
+	callback mqtt.MessageHandler
 }
 
 type Z2MEndpoint struct {
@@ -110,28 +157,40 @@ type Z2MGroup struct {
 }
 
 type Z2MDeviceData struct {
-	Battery           *int     `json:"battery,omitempty"`
-	BatteryLow        *bool    `json:"battery_low,omitempty"`
-	Humidity          *float32 `json:"humidity,omitempty"`
-	LinkQuality       *int     `json:"linkquality,omitempty"`
-	PowerOutageCount  *int     `json:"power_outage_count,omitempty"`
-	Pressure          *float32 `json:"pressure,omitempty"`
-	Temperature       *float32 `json:"temperature,omitempty"`
-	DeviceTemperature *float32 `json:"device_temperature,omitempty"`
-	Voltage           *float32 `json:"voltage,omitempty"`
-	Contact           *bool    `json:"contact,omitempty"`
-	TriggerCount      *int     `json:"trigger_count,omitempty"`
-	Action            *string  `json:"action,omitempty"`
-	OperationMode     *string  `json:"operation_mode,omitempty"`
-	Sensitivity       *string  `json:"sensitivity,omitempty"`
-	Tamper            *bool    `json:"tamper,omitempty"`
-	KeepTime          *int     `json:"keep_time,omitempty"`
-	Brightness        *float32 `json:"brightness,omitempty"`
-	PowerOnBehaviour  *string  `json:"power_on_behaviour,omitempty"`
-	State             *string  `json:"state,omitempty"`
-	UpdateAvailable   *bool    `json:"update_available,omitempty"`
-	ColorMode         *string  `json:"color_mode,omitempty"`
-	ColorTemp         *int     `json:"color_temp,omitempty"`
+	Battery           *int       `json:"battery,omitempty"`
+	BatteryLow        *bool      `json:"battery_low,omitempty"`
+	Humidity          *float32   `json:"humidity,omitempty"`
+	LinkQuality       *int       `json:"linkquality,omitempty"`
+	PowerOutageCount  *int       `json:"power_outage_count,omitempty"`
+	Pressure          *float32   `json:"pressure,omitempty"`
+	Temperature       *float32   `json:"temperature,omitempty"`
+	DeviceTemperature *float32   `json:"device_temperature,omitempty"`
+	Voltage           *float32   `json:"voltage,omitempty"`
+	Contact           *bool      `json:"contact,omitempty"`
+	Occupancy         *bool      `json:"occupancy,omitempty"`
+	Position          *float32   `json:"position,omitempty"`
+	Tilt              *float32   `json:"tilt,omitempty"`
+	LocalTemperature  *float32   `json:"local_temperature,omitempty"`
+	PiHeatingDemand   *float32   `json:"pi_heating_demand,omitempty"`
+	ValvePosition     *float32   `json:"valve_position,omitempty"`
+	FanMode           *string    `json:"fan_mode,omitempty"`
+	TriggerCount      *int       `json:"trigger_count,omitempty"`
+	Action            *string    `json:"action,omitempty"`
+	OperationMode     *string    `json:"operation_mode,omitempty"`
+	Sensitivity       *string    `json:"sensitivity,omitempty"`
+	Tamper            *bool      `json:"tamper,omitempty"`
+	KeepTime          *int       `json:"keep_time,omitempty"`
+	Brightness        *float32   `json:"brightness,omitempty"`
+	PowerOnBehaviour  *string    `json:"power_on_behaviour,omitempty"`
+	State             *string    `json:"state,omitempty"`
+	UpdateAvailable   *bool      `json:"update_available,omitempty"`
+	ColorMode         *string    `json:"color_mode,omitempty"`
+	ColorTemp         *int       `json:"color_temp,omitempty"`
+	Update            *Z2MUpdate `json:"update,omitempty"`
+}
+
+type Z2MUpdate struct {
+	State string `json:"state"` // idle, available, updating
 }
 
 func (e *Zigbee2MQTTDevice) NewZigbee2MQTT(vdcdClient *vdcdapi.Client, mqttClient mqtt.Client, device *vdcdapi.Device) {
@@ -153,6 +212,11 @@ func (e *Zigbee2MQTTDevice) NewZigbee2MQTT(vdcdClient *vdcdapi.Client, mqttClien
 		}
 
 		device.ModelName = fmt.Sprintf("%s %s %s", e.z2MDevice.Definition.Vendor, e.z2MDevice.ModelID, e.z2MDevice.Definition.Model)
+
+		device.AddProperty("updateAvailable", vdcdapi.Property{Readonly: true, Type: "boolean"})
+		if _, ok := findZ2MFeature(e.z2MDevice.Definition.Exposes, "battery"); ok {
+			device.AddState("batteryLevel", vdcdapi.State{Description: "Battery level", Type: "numeric", SiUnit: "percent", Min: 0, Max: 100, Resolution: 1})
+		}
 	}
 
 	if e.IsGroup {
@@ -166,6 +230,8 @@ func (e *Zigbee2MQTTDevice) NewZigbee2MQTT(vdcdClient *vdcdapi.Client, mqttClien
 	e.FriendlyName = e.getFriendlyName()
 	e.configureCallbacks()
 	device.SetName(e.FriendlyName)
+	device.SetSource("zigbee2mqtt", e.z2MDevice.FriendlyName)
+	device.SetRemoveCB(e.vcdcRemoveCallback())
 
 	log.WithFields(log.Fields{
 		"FriendlyName": e.FriendlyName,
@@ -182,12 +248,11 @@ func (e *Zigbee2MQTTDevice) CreateButtonDevice(z2mDevice Z2MDevice, actionID int
 		"ActionPrefix": actionPrefix,
 	}).Info("Create Z2M ButtonDevice")
 
-	zigbee2mqttdevice := new(Zigbee2MQTTDevice)
+	zigbee2mqttdevice := e.newZigbee2MQTTDevice()
 	zigbee2mqttdevice.z2MDevice = z2mDevice
 	zigbee2mqttdevice.IsDevice = true
 	zigbee2mqttdevice.actionID = actionID
 	zigbee2mqttdevice.actionPrefix = actionPrefix
-	zigbee2mqttdevice.mqttProxy = e.mqttProxy
 
 	device := new(vdcdapi.Device)
 	device.SetChannelMessageCB(zigbee2mqttdevice.vcdcChannelCallback())
@@ -226,10 +291,9 @@ func (e *Zigbee2MQTTDevice) CreateLightDevice(z2mDevice Z2MDevice) {
 		"Friendly Name": z2mDevice.FriendlyName,
 	}).Info("Create Z2M Light Device")
 
-	zigbee2mqttdevice := new(Zigbee2MQTTDevice)
+	zigbee2mqttdevice := e.newZigbee2MQTTDevice()
 	zigbee2mqttdevice.z2MDevice = z2mDevice
 	zigbee2mqttdevice.IsDevice = true
-	zigbee2mqttdevice.mqttProxy = e.mqttProxy
 
 	device := new(vdcdapi.Device)
 	device.SetChannelMessageCB(zigbee2mqttdevice.vcdcChannelCallback())
@@ -262,6 +326,131 @@ func (e *Zigbee2MQTTDevice) CreateLightDevice(z2mDevice Z2MDevice) {
 		device.NewCTLightDevice(e.vdcdClient, zigbee2mqttdevice.z2MDevice.IEEEAddress)
 	}
 
+	if hasBrighness {
+		device.Move = true
+		device.SetMoveMessageCB(zigbee2mqttdevice.vcdcMoveCallback())
+	}
+
+	device.Sync = true
+	device.SetSyncMessageCB(zigbee2mqttdevice.vcdcSyncCallback())
+	device.SceneCommands = true
+	device.SetSceneCommandCB(sceneCommandCallback(zigbee2mqttdevice.RecallScene))
+
+	if zigbee2mqttdevice.identifyPayload() != "" {
+		device.AddAction("identify", vdcdapi.Action{Description: "Identify"}, zigbee2mqttdevice.identifyAction)
+	}
+
+	_, notfounderr := e.vdcdClient.GetDeviceByUniqueId(zigbee2mqttdevice.getUniqueId())
+	if notfounderr != nil {
+		zigbee2mqttdevice.NewZigbee2MQTT(e.vdcdClient, e.mqttClient, device)
+	}
+
+}
+
+func (e *Zigbee2MQTTDevice) CreateCoverDevice(z2mDevice Z2MDevice) {
+
+	log.WithFields(log.Fields{
+		"IEEEAddress":   z2mDevice.IEEEAddress,
+		"Friendly Name": z2mDevice.FriendlyName,
+	}).Info("Create Z2M Cover Device")
+
+	zigbee2mqttdevice := e.newZigbee2MQTTDevice()
+	zigbee2mqttdevice.z2MDevice = z2mDevice
+	zigbee2mqttdevice.IsDevice = true
+	zigbee2mqttdevice.IsCover = true
+
+	_, hasTilt := findZ2MFeature(z2mDevice.Definition.Exposes, "tilt")
+
+	device := new(vdcdapi.Device)
+	device.NewShadowDevice(e.vdcdClient, zigbee2mqttdevice.z2MDevice.IEEEAddress, hasTilt)
+	device.SetChannelMessageCB(zigbee2mqttdevice.vcdcChannelCallback())
+	device.SetMoveMessageCB(zigbee2mqttdevice.vcdcMoveCallback())
+	device.SetSyncMessageCB(zigbee2mqttdevice.vcdcSyncCallback())
+	device.Sync = true
+	device.SourceDevice = zigbee2mqttdevice
+	zigbee2mqttdevice.originDevice = device
+
+	_, notfounderr := e.vdcdClient.GetDeviceByUniqueId(zigbee2mqttdevice.getUniqueId())
+	if notfounderr != nil {
+		zigbee2mqttdevice.NewZigbee2MQTT(e.vdcdClient, e.mqttClient, device)
+	}
+
+}
+
+func (e *Zigbee2MQTTDevice) CreateHeatingValveDevice(z2mDevice Z2MDevice) {
+
+	log.WithFields(log.Fields{
+		"IEEEAddress":   z2mDevice.IEEEAddress,
+		"Friendly Name": z2mDevice.FriendlyName,
+	}).Info("Create Z2M Heating Valve Device")
+
+	zigbee2mqttdevice := e.newZigbee2MQTTDevice()
+	zigbee2mqttdevice.z2MDevice = z2mDevice
+	zigbee2mqttdevice.IsDevice = true
+	zigbee2mqttdevice.IsHeatingValve = true
+
+	// Prefer a writable valve position, fall back to the heating setpoint
+	if feature, ok := findZ2MFeature(z2mDevice.Definition.Exposes, "valve_position"); ok && feature.Access&z2mAccessSet != 0 {
+		zigbee2mqttdevice.valveProperty = feature.Property
+	}
+	for _, property := range []string{"current_heating_setpoint", "occupied_heating_setpoint"} {
+		if feature, ok := findZ2MFeature(z2mDevice.Definition.Exposes, property); ok {
+			zigbee2mqttdevice.setpointProperty = feature.Property
+			zigbee2mqttdevice.setpointMin = float32(feature.ValueMin)
+			zigbee2mqttdevice.setpointMax = float32(feature.ValueMax)
+			break
+		}
+	}
+	if zigbee2mqttdevice.setpointMax <= zigbee2mqttdevice.setpointMin {
+		zigbee2mqttdevice.setpointMin = 5
+		zigbee2mqttdevice.setpointMax = 30
+	}
+
+	device := new(vdcdapi.Device)
+	device.NewHeatingValveDevice(e.vdcdClient, zigbee2mqttdevice.z2MDevice.IEEEAddress)
+	device.SetChannelMessageCB(zigbee2mqttdevice.vcdcChannelCallback())
+	device.SetControlMessageCB(zigbee2mqttdevice.vcdcControlCallback())
+	device.SourceDevice = zigbee2mqttdevice
+	zigbee2mqttdevice.originDevice = device
+
+	_, notfounderr := e.vdcdClient.GetDeviceByUniqueId(zigbee2mqttdevice.getUniqueId())
+	if notfounderr != nil {
+		zigbee2mqttdevice.NewZigbee2MQTT(e.vdcdClient, e.mqttClient, device)
+	}
+
+}
+
+func (e *Zigbee2MQTTDevice) CreateFanDevice(z2mDevice Z2MDevice) {
+
+	log.WithFields(log.Fields{
+		"IEEEAddress":   z2mDevice.IEEEAddress,
+		"Friendly Name": z2mDevice.FriendlyName,
+	}).Info("Create Z2M Fan Device")
+
+	zigbee2mqttdevice := e.newZigbee2MQTTDevice()
+	zigbee2mqttdevice.z2MDevice = z2mDevice
+	zigbee2mqttdevice.IsDevice = true
+
+	fanMode, _ := findZ2MFeature(z2mDevice.Definition.Exposes, "fan_mode")
+	for _, mode := range []string{"low", "medium", "high"} {
+		for _, value := range fanMode.Values {
+			if value == mode {
+				zigbee2mqttdevice.fanModes = append(zigbee2mqttdevice.fanModes, mode)
+			}
+		}
+	}
+	if len(zigbee2mqttdevice.fanModes) == 0 {
+		zigbee2mqttdevice.fanModes = []string{"on"}
+	}
+
+	device := new(vdcdapi.Device)
+	device.NewVentilationDevice(e.vdcdClient, zigbee2mqttdevice.z2MDevice.IEEEAddress, false)
+	device.SetChannelMessageCB(zigbee2mqttdevice.vcdcChannelCallback())
+	device.SetSyncMessageCB(zigbee2mqttdevice.vcdcSyncCallback())
+	device.Sync = true
+	device.SourceDevice = zigbee2mqttdevice
+	zigbee2mqttdevice.originDevice = device
+
 	_, notfounderr := e.vdcdClient.GetDeviceByUniqueId(zigbee2mqttdevice.getUniqueId())
 	if notfounderr != nil {
 		zigbee2mqttdevice.NewZigbee2MQTT(e.vdcdClient, e.mqttClient, device)
@@ -269,6 +458,62 @@ func (e *Zigbee2MQTTDevice) CreateLightDevice(z2mDevice Z2MDevice) {
 
 }
 
+// hasZ2MFeature checks if the device exposes the property
+func hasZ2MFeature(features []Z2MFeatures, property string) bool {
+	_, ok := findZ2MFeature(features, property)
+	return ok
+}
+
+// hasZ2MExposeType checks if the device exposes a feature of the given type, e.g. light or cover
+func hasZ2MExposeType(features []Z2MFeatures, featureType string) bool {
+	for _, feature := range features {
+		if feature.Type == featureType {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Zigbee2MQTTDevice) CreateInputDevice(z2mDevice Z2MDevice) {
+
+	log.WithFields(log.Fields{
+		"IEEEAddress":   z2mDevice.IEEEAddress,
+		"Friendly Name": z2mDevice.FriendlyName,
+	}).Info("Create Z2M Input Device")
+
+	zigbee2mqttdevice := e.newZigbee2MQTTDevice()
+	zigbee2mqttdevice.z2MDevice = z2mDevice
+	zigbee2mqttdevice.IsDevice = true
+
+	device := new(vdcdapi.Device)
+	device.NewInputDevice(e.vdcdClient, zigbee2mqttdevice.z2MDevice.IEEEAddress)
+	device.SetChannelMessageCB(zigbee2mqttdevice.vcdcChannelCallback())
+	device.SourceDevice = zigbee2mqttdevice
+	zigbee2mqttdevice.originDevice = device
+
+	for _, binaryInput := range z2mBinaryInputs {
+		if _, ok := findZ2MFeature(z2mDevice.Definition.Exposes, binaryInput.property); ok {
+			device.AddInput(newBinaryInput(binaryInput.property, binaryInput.inputType, binaryInput.property))
+		}
+	}
+
+	_, notfounderr := e.vdcdClient.GetDeviceByUniqueId(zigbee2mqttdevice.getUniqueId())
+	if notfounderr != nil {
+		zigbee2mqttdevice.NewZigbee2MQTT(e.vdcdClient, e.mqttClient, device)
+	}
+
+}
+
+// hasZ2MBinaryInputs checks if the device exposes features reported as binary inputs
+func hasZ2MBinaryInputs(z2mDevice Z2MDevice) bool {
+	for _, binaryInput := range z2mBinaryInputs {
+		if _, ok := findZ2MFeature(z2mDevice.Definition.Exposes, binaryInput.property); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *Zigbee2MQTTDevice) getUniqueId() string {
 	var uniqueID string
 
@@ -305,6 +550,28 @@ func (e *Zigbee2MQTTDevice) getFriendlyName() string {
 	return friendlyName
 }
 
+// SetBaseTopic sets the base topic configured in Zigbee2MQTT, before the discovery is started
+func (e *Zigbee2MQTTDevice) SetBaseTopic(baseTopic string) {
+	e.baseTopic = strings.Trim(baseTopic, "/")
+}
+
+// mqttTopic returns the topic below the base topic, e.g. zigbee2mqtt/<friendly name>/set
+func (e *Zigbee2MQTTDevice) mqttTopic(levels ...string) string {
+	baseTopic := e.baseTopic
+	if baseTopic == "" {
+		baseTopic = defaultZigbee2MQTTBaseTopic
+	}
+	return strings.Join(append([]string{baseTopic}, levels...), "/")
+}
+
+// newZigbee2MQTTDevice creates a device or group sharing the MQTT proxy and base topic of the discovery
+func (e *Zigbee2MQTTDevice) newZigbee2MQTTDevice() *Zigbee2MQTTDevice {
+	zigbee2mqttdevice := new(Zigbee2MQTTDevice)
+	zigbee2mqttdevice.mqttProxy = e.mqttProxy
+	zigbee2mqttdevice.baseTopic = e.baseTopic
+	return zigbee2mqttdevice
+}
+
 func (e *Zigbee2MQTTDevice) StartDiscovery(vdcdClient *vdcdapi.Client, mqttClient mqtt.Client) {
 	e.mqttClient = mqttClient
 	e.vdcdClient = vdcdClient
@@ -321,7 +588,7 @@ func (e *Zigbee2MQTTDevice) StartDiscovery(vdcdClient *vdcdapi.Client, mqttClien
 	}
 
 	log.Info(("Starting Zigbee2MQTT Device discovery"))
-	e.subscribeMqttTopic("zigbee2mqtt/bridge/#", e.mqttDiscoverCallback())
+	e.subscribeMqttTopic(e.mqttTopic("bridge", "#"), e.mqttDiscoverCallback())
 	e.TriggerDiscovery()
 }
 
@@ -329,8 +596,8 @@ func (e *Zigbee2MQTTDevice) TriggerDiscovery() {
 	if e.mqttClient == nil {
 		return
 	}
-	e.publishMqttCommand("zigbee2mqtt/bridge/request/devices", "")
-	e.publishMqttCommand("zigbee2mqtt/bridge/request/groups", "")
+	e.publishMqttCommand(e.mqttTopic("bridge", "request", "devices"), "")
+	e.publishMqttCommand(e.mqttTopic("bridge", "request", "groups"), "")
 }
 
 func (e *Zigbee2MQTTDevice) mqttDiscoverCallback() mqtt.MessageHandler {
@@ -345,6 +612,9 @@ func (e *Zigbee2MQTTDevice) mqttDiscoverCallback() mqtt.MessageHandler {
 			var z2Mdevices []Z2MDevice
 			if err := json.Unmarshal([]byte(msg.Payload()), &z2Mdevices); err != nil {
 				log.WithError(err).Error("Failed to Unmarshal Z2MDevice")
+			} else if msg.Topic() == e.mqttTopic("bridge", "devices") {
+				// The complete list of paired devices, all others are gone
+				defer e.reapDevices(z2Mdevices)
 			}
 
 			for _, z2mdevice := range z2Mdevices {
@@ -386,6 +656,18 @@ func (e *Zigbee2MQTTDevice) mqttDiscoverCallback() mqtt.MessageHandler {
 					e.CreateLightDevice(z2mdevice)
 				case "LED1650R5": // TRADFRI bulb GU10, white, 400 lm
 					e.CreateLightDevice(z2mdevice)
+				default:
+					// Covers, contact, occupancy and similar sensors are detected by their exposes
+					switch {
+					case hasZ2MExposeType(z2mdevice.Definition.Exposes, "cover"):
+						e.CreateCoverDevice(z2mdevice)
+					case hasZ2MExposeType(z2mdevice.Definition.Exposes, "climate"):
+						e.CreateHeatingValveDevice(z2mdevice)
+					case hasZ2MFeature(z2mdevice.Definition.Exposes, "fan_mode"):
+						e.CreateFanDevice(z2mdevice)
+					case hasZ2MBinaryInputs(z2mdevice):
+						e.CreateInputDevice(z2mdevice)
+					}
 				}
 			}
 		}
@@ -405,7 +687,7 @@ func (e *Zigbee2MQTTDevice) mqttDiscoverCallback() mqtt.MessageHandler {
 					"Friendly Name": group.FriendlyName,
 				}).Info("Found new Zigbee2MQTT Group")
 
-				zigbee2mqttdevice := new(Zigbee2MQTTDevice)
+				zigbee2mqttdevice := e.newZigbee2MQTTDevice()
 				zigbee2mqttdevice.z2MGroup = group
 				zigbee2mqttdevice.IsGroup = true
 
@@ -424,6 +706,28 @@ func (e *Zigbee2MQTTDevice) mqttDiscoverCallback() mqtt.MessageHandler {
 	return f
 }
 
+// reapDevices schedules the removal of devices no longer paired with
+// Zigbee2MQTT and cancels it for devices which are paired again
+func (e *Zigbee2MQTTDevice) reapDevices(z2mDevices []Z2MDevice) {
+	paired := make(map[string]bool)
+	for _, z2mDevice := range z2mDevices {
+		paired[z2mDevice.IEEEAddress] = true
+	}
+
+	for _, device := range e.vdcdClient.GetDevices() {
+		zigbee2mqttdevice, ok := device.SourceDevice.(*Zigbee2MQTTDevice)
+		if !ok || !zigbee2mqttdevice.IsDevice {
+			continue
+		}
+
+		if paired[zigbee2mqttdevice.z2MDevice.IEEEAddress] {
+			e.reaper.seen(device.Tag)
+		} else {
+			e.reaper.gone(e.vdcdClient, device.Tag)
+		}
+	}
+}
+
 func (e *Zigbee2MQTTDevice) configureCallbacks() {
 
 	log.WithFields(log.Fields{
@@ -432,10 +736,10 @@ func (e *Zigbee2MQTTDevice) configureCallbacks() {
 	}).Debug("Subscribe to MQTT topic")
 
 	// Add callback
-	topic := fmt.Sprintf("zigbee2mqtt/%s", e.Topic)
-	e.mqttProxy.subscribeMqttTopic(topic, e.mqttCallback())
-	topicAction := fmt.Sprintf("zigbee2mqtt/%s/action", e.Topic)
-	e.mqttProxy.subscribeMqttTopic(topicAction, e.mqttActionCallback())
+	topic := e.mqttTopic(e.Topic)
+	e.mqttProxy.subscribeMqttTopic(topic, e, e.mqttCallback())
+	topicAction := e.mqttTopic(e.Topic, "action")
+	e.mqttProxy.subscribeMqttTopic(topicAction, e, e.mqttActionCallback())
 
 }
 
@@ -456,8 +760,7 @@ func (e *Zigbee2MQTTDevice) mqttCallback() mqtt.MessageHandler {
 		}
 
 		if deviceData.Brightness != nil {
-			b := *deviceData.Brightness / 254 * 100
-			e.originDevice.UpdateValue(float32(b), "brightness", vdcdapi.BrightnessType)
+			e.originDevice.UpdateValue(vdcdapi.ScaleToPercent(float32(*deviceData.Brightness), 254), "brightness", vdcdapi.BrightnessType)
 		}
 
 		if deviceData.State != nil {
@@ -472,11 +775,82 @@ func (e *Zigbee2MQTTDevice) mqttCallback() mqtt.MessageHandler {
 			e.originDevice.UpdateValue(float32(*deviceData.ColorTemp), "colortemp", vdcdapi.ColorTemperatureType)
 		}
 
+		if deviceData.LocalTemperature != nil {
+			e.originDevice.UpdateSensorValue(*deviceData.LocalTemperature, fmt.Sprintf("%s-temperature", e.originDevice.UniqueID))
+		}
+
+		if deviceData.ValvePosition != nil {
+			e.originDevice.UpdateValue(*deviceData.ValvePosition, "heatingPower", vdcdapi.HeatingPowerType)
+		} else if deviceData.PiHeatingDemand != nil {
+			e.originDevice.UpdateValue(*deviceData.PiHeatingDemand, "heatingPower", vdcdapi.HeatingPowerType)
+		}
+
+		if deviceData.FanMode != nil && len(e.fanModes) > 0 {
+			for i, mode := range e.fanModes {
+				if mode == *deviceData.FanMode {
+					e.originDevice.UpdateValue(speedToIntensity(i+1, len(e.fanModes)), "airflowIntensity", vdcdapi.AirflowIntesityType)
+				}
+			}
+			if *deviceData.FanMode == "off" {
+				e.originDevice.UpdateValue(0, "airflowIntensity", vdcdapi.AirflowIntesityType)
+			}
+		}
+
+		if deviceData.Position != nil {
+			e.originDevice.UpdateValue(*deviceData.Position, "shadePositionOutside", vdcdapi.BlindsShadePositionType)
+		}
+
+		if deviceData.Tilt != nil {
+			e.originDevice.UpdateValue(*deviceData.Tilt, "shadeOpeningAngleOutside", vdcdapi.BlindShadeAngleType)
+		}
+
+		// contact is true when closed, like the dS window closed input
+		if deviceData.Contact != nil {
+			e.originDevice.UpdateInputValue(boolToInputValue(*deviceData.Contact), "contact")
+		}
+
+		if deviceData.Occupancy != nil {
+			e.originDevice.UpdateInputValue(boolToInputValue(*deviceData.Occupancy), "occupancy")
+		}
+
+		if deviceData.Tamper != nil {
+			e.originDevice.UpdateInputValue(boolToInputValue(*deviceData.Tamper), "tamper")
+		}
+
+		if deviceData.BatteryLow != nil {
+			e.originDevice.UpdateInputValue(boolToInputValue(*deviceData.BatteryLow), "battery_low")
+		}
+
+		if deviceData.UpdateAvailable != nil {
+			e.setProperty("updateAvailable", *deviceData.UpdateAvailable)
+		}
+
+		if deviceData.Update != nil {
+			e.setProperty("updateAvailable", deviceData.Update.State == "available")
+		}
+
+		if deviceData.Battery != nil {
+			if err := e.originDevice.PushState("batteryLevel", *deviceData.Battery); err != nil {
+				log.WithError(err).WithField("FriendlyName", e.FriendlyName).Warn("Failed to push battery level")
+			}
+		}
+
+		e.notifyState()
+
 	}
 
 	return f
 }
 
+func (e *Zigbee2MQTTDevice) setProperty(name string, value interface{}) {
+	if err := e.originDevice.SetProperty(name, value); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"FriendlyName": e.FriendlyName,
+			"Property":     name,
+		}).Warn("Failed to update property")
+	}
+}
+
 // MQTT Callback from zigbee2mqtt device
 // This is called when a devices emits an action
 func (e *Zigbee2MQTTDevice) mqttActionCallback() mqtt.MessageHandler {
@@ -499,18 +873,18 @@ func (e *Zigbee2MQTTDevice) mqttActionCallback() mqtt.MessageHandler {
 
 			switch action {
 			case "hold":
-				e.vdcdClient.SendButtonMessage(1, e.originDevice.Tag, 0)
+				e.sendButtonEvent(1)
 			case "release":
-				e.vdcdClient.SendButtonMessage(0, e.originDevice.Tag, 0)
+				e.sendButtonEvent(0)
 			case "single":
 			case "click":
-				e.vdcdClient.SendButtonMessage(float32(-vdcdapi.CT_DC_TIP_1X), e.originDevice.Tag, 0)
+				e.sendButtonEvent(float32(-vdcdapi.CT_DC_TIP_1X))
 			case "double":
-				e.vdcdClient.SendButtonMessage(float32(-vdcdapi.CT_DC_TIP_2X), e.originDevice.Tag, 0)
+				e.sendButtonEvent(float32(-vdcdapi.CT_DC_TIP_2X))
 			case "triple":
-				e.vdcdClient.SendButtonMessage(float32(-vdcdapi.CT_DC_TIP_3X), e.originDevice.Tag, 0)
+				e.sendButtonEvent(float32(-vdcdapi.CT_DC_TIP_3X))
 			default:
-				e.vdcdClient.SendButtonMessage(float32(-vdcdapi.CT_DC_TIP_1X), e.originDevice.Tag, 0)
+				e.sendButtonEvent(float32(-vdcdapi.CT_DC_TIP_1X))
 
 			}
 
@@ -531,6 +905,125 @@ func (e *Zigbee2MQTTDevice) vcdcChannelCallback() func(message *vdcdapi.GenericV
 	return f
 }
 
+func (e *Zigbee2MQTTDevice) vcdcRemoveCallback() func(device *vdcdapi.Device) {
+
+	f := func(device *vdcdapi.Device) {
+		log.Debugf("vcdcRemoveCallBack called for Device %s\n", device.UniqueID)
+		e.stopMove()
+		e.mqttProxy.unsubscribeOwner(e)
+	}
+
+	return f
+}
+
+func (e *Zigbee2MQTTDevice) vcdcControlCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.Debugf("vcdcControlCallBack called for Device %s\n", device.UniqueID)
+		if message.Name == "heatingLevel" {
+			e.SetHeatingLevel(message.Value)
+		}
+	}
+
+	return f
+}
+
+func (e *Zigbee2MQTTDevice) vcdcMoveCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.WithField("Device", device.UniqueID).Debug("vcdcMoveCallBack called")
+		e.Move(message.Direction)
+	}
+
+	return f
+}
+
+func (e *Zigbee2MQTTDevice) vcdcSyncCallback() func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+
+	f := func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		log.WithField("Device", device.UniqueID).Debug("vcdcSyncCallBack called")
+		e.Sync()
+	}
+
+	return f
+}
+
+// Sync requests the current state with /get and waits until it is published
+func (e *Zigbee2MQTTDevice) Sync() {
+	e.awaitState(func() { e.publishMqttCommand(e.mqttTopic(e.Topic, "get"), `{"state": ""}`) })
+}
+
+// RecallScene recalls the mapped Zigbee scene id with scene_recall
+func (e *Zigbee2MQTTDevice) RecallScene(sceneID string) {
+	id, err := strconv.Atoi(sceneID)
+	if err != nil {
+		log.WithError(err).WithField("Scene", sceneID).Error("Invalid Zigbee2MQTT scene id")
+		return
+	}
+
+	e.publishMqttCommand(e.mqttTopic(e.Topic, "set"), fmt.Sprintf(`{"scene_recall": %d}`, id))
+}
+
+// identifyPayload returns the /set payload to flash the device, or an empty
+// string when the device exposes neither identify nor a blink effect
+func (e *Zigbee2MQTTDevice) identifyPayload() string {
+	if _, ok := findZ2MFeature(e.z2MDevice.Definition.Exposes, "identify"); ok {
+		return `{"identify": "identify"}`
+	}
+
+	if effect, ok := findZ2MFeature(e.z2MDevice.Definition.Exposes, "effect"); ok {
+		for _, value := range effect.Values {
+			if value == "blink" {
+				return `{"effect": "blink"}`
+			}
+		}
+	}
+
+	return ""
+}
+
+// identifyAction flashes the device so it can be found
+func (e *Zigbee2MQTTDevice) identifyAction(device *vdcdapi.Device, params map[string]interface{}) error {
+	return e.publishMqtt(e.mqttTopic(e.Topic, "set"), e.identifyPayload())
+}
+
+// findZ2MFeature searches the exposed features and their sub features for the property
+func findZ2MFeature(features []Z2MFeatures, property string) (Z2MFeatures, bool) {
+	for _, feature := range features {
+		if feature.Property == property {
+			return feature, true
+		}
+		if found, ok := findZ2MFeature(feature.Features, property); ok {
+			return found, true
+		}
+	}
+
+	return Z2MFeatures{}, false
+}
+
+// Move starts or stops dimming with the native brightness_move command,
+// covers are opened or closed until the stop
+func (e *Zigbee2MQTTDevice) Move(direction int) {
+	var payload string
+
+	switch {
+	case e.IsCover && direction > 0:
+		payload = `{"state": "OPEN"}`
+	case e.IsCover && direction < 0:
+		payload = `{"state": "CLOSE"}`
+	case e.IsCover:
+		payload = `{"state": "STOP"}`
+	case direction > 0:
+		payload = fmt.Sprintf(`{"brightness_move": %d}`, z2mBrightnessMoveRate)
+	case direction < 0:
+		payload = fmt.Sprintf(`{"brightness_move": %d}`, -z2mBrightnessMoveRate)
+	default:
+		payload = `{"brightness_move": "stop"}`
+	}
+
+	e.publishMqttCommand(e.mqttTopic(e.Topic, "set"), payload)
+}
+
 // Apply update from dss to shelly
 func (e *Zigbee2MQTTDevice) SetValue(value float32, channelName string, channelType vdcdapi.ChannelTypeType) {
 
@@ -539,7 +1032,7 @@ func (e *Zigbee2MQTTDevice) SetValue(value float32, channelName string, channelT
 		"ChannelName":  channelName}).Infof("Set Value to %f \n", value)
 
 	// Also sync the state with originDevice
-	e.originDevice.SetValue(value, channelName)
+	value = e.originDevice.SetValue(value, channelName)
 
 	switch channelName {
 	case "basic_switch":
@@ -555,33 +1048,72 @@ func (e *Zigbee2MQTTDevice) SetValue(value float32, channelName string, channelT
 	case "colortemp":
 		e.SetColorTemp(value)
 
+	case "heatingPower":
+		e.SetHeatingLevel(value)
+
+	case "airflowIntensity":
+		e.SetFanSpeed(value)
+
+	case "shadePositionOutside":
+		e.publishMqttCommand(e.mqttTopic(e.Topic, "set", "position"), int(math.Round(float64(value))))
+
+	case "shadeOpeningAngleOutside":
+		e.publishMqttCommand(e.mqttTopic(e.Topic, "set", "tilt"), int(math.Round(float64(value))))
+
 	}
 
 }
 
+// SetFanSpeed sets the fan_mode matching the airflow intensity
+func (e *Zigbee2MQTTDevice) SetFanSpeed(intensity float32) {
+	mode := "off"
+	if speed := intensityToSpeed(intensity, len(e.fanModes)); speed > 0 {
+		mode = e.fanModes[speed-1]
+	}
+
+	e.publishMqttCommand(e.mqttTopic(e.Topic, "set", "fan_mode"), mode)
+}
+
+// SetHeatingLevel applies the heating level of the dS room temperature controller
+// to the valve position, or maps it to the heating setpoint of the TRV
+func (e *Zigbee2MQTTDevice) SetHeatingLevel(level float32) {
+	if e.valveProperty != "" {
+		e.publishMqttCommand(e.mqttTopic(e.Topic, "set", e.valveProperty), int(math.Round(float64(heatingLevelToValve(level)))))
+		return
+	}
+
+	if e.setpointProperty != "" {
+		e.publishMqttCommand(e.mqttTopic(e.Topic, "set", e.setpointProperty), heatingLevelToSetpoint(level, e.setpointMin, e.setpointMax))
+	}
+}
+
 func (e *Zigbee2MQTTDevice) TurnOn() {
-	e.publishMqttCommand("zigbee2mqtt/"+e.Topic+"/set/state", "on")
+	e.publishMqttCommand(e.mqttTopic(e.Topic, "set", "state"), "on")
 }
 
 func (e *Zigbee2MQTTDevice) TurnOff() {
-	e.publishMqttCommand("zigbee2mqtt/"+e.Topic+"/set/state", "off")
+	e.publishMqttCommand(e.mqttTopic(e.Topic, "set", "state"), "off")
 }
 
 func (e *Zigbee2MQTTDevice) SetBrightness(brightness float32) {
-	b := brightness / 100 * 254
-	e.publishMqttCommand("zigbee2mqtt/"+e.Topic+"/set/brightness", b)
+	b := vdcdapi.PercentToScale(brightness, 254)
+	e.publishMqttCommand(e.mqttTopic(e.Topic, "set", "brightness"), b)
 }
 
+// SetColorTemp sets the color temperature, zigbee2mqtt uses mired as the vdcd does
 func (e *Zigbee2MQTTDevice) SetColorTemp(ct float32) {
-	e.publishMqttCommand("zigbee2mqtt/"+e.Topic+"/set/color_temp", ct)
+	e.publishMqttCommand(e.mqttTopic(e.Topic, "set", "color_temp"), int(ct))
 }
 
-func (p *MQTTProxy) subscribeMqttTopic(topic string, callback mqtt.MessageHandler) {
+func (p *MQTTProxy) subscribeMqttTopic(topic string, owner interface{}, callback mqtt.MessageHandler) {
 
 	strippedTopic := strings.ReplaceAll(topic, "/#", "")
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	if p.receivers == nil {
-		p.receivers = make(map[string][]mqtt.MessageHandler)
+		p.receivers = make(map[string][]mqttProxyReceiver)
 	}
 
 	if len(p.receivers[strippedTopic]) == 0 {
@@ -600,7 +1132,39 @@ func (p *MQTTProxy) subscribeMqttTopic(topic string, callback mqtt.MessageHandle
 	log.WithFields(log.Fields{
 		"Topic": topic,
 	}).Debug("Append new Callback Receiver for MQTT topic")
-	p.receivers[strippedTopic] = append(p.receivers[strippedTopic], callback)
+	p.receivers[strippedTopic] = append(p.receivers[strippedTopic], mqttProxyReceiver{owner, callback})
+
+}
+
+// unsubscribeOwner removes all callbacks of the owner, topics without
+// receivers left are unsubscribed
+func (p *MQTTProxy) unsubscribeOwner(owner interface{}) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for topic, receivers := range p.receivers {
+		var remaining []mqttProxyReceiver
+		for _, receiver := range receivers {
+			if receiver.owner != owner {
+				remaining = append(remaining, receiver)
+			}
+		}
+
+		if len(remaining) > 0 {
+			p.receivers[topic] = remaining
+			continue
+		}
+
+		delete(p.receivers, topic)
+
+		log.WithFields(log.Fields{
+			"Topic": topic,
+		}).Debug("MQTT Proxy Unsubscribe from topic")
+		if token := p.mqttClient.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+			log.Error("MQTT Proxy unsubscribe failed: ", token.Error())
+		}
+	}
 
 }
 
@@ -608,14 +1172,18 @@ func (p *MQTTProxy) callback() mqtt.MessageHandler {
 
 	var f mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 
+		p.mu.Lock()
+		receivers := p.receivers[msg.Topic()]
+		p.mu.Unlock()
+
 		log.WithFields(log.Fields{
 			"Topic":      msg.Topic(),
-			"# Receiver": len(p.receivers[msg.Topic()]),
+			"# Receiver": len(receivers),
 		}).Debug("MQTT Message received on MQTT Proxy -> Forward to all Callbacks")
 
 		// Forward message to all receiver suvscribed to this topic
-		for _, receiver := range p.receivers[msg.Topic()] {
-			receiver(client, msg)
+		for _, receiver := range receivers {
+			receiver.callback(client, msg)
 		}
 	}
 	return f
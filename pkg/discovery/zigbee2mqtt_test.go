@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/splattner/vdcd-bridge/pkg/mqtttest"
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+)
+
+func TestZigbee2MQTTCTLight(t *testing.T) {
+	bridge := newTestBridge(t)
+
+	zigbee2mqtt := mqtttest.NewZigbee2MQTT(bridge.broker)
+	zigbee2mqtt.AddLight("0x000d6ffffe1a2b01", "Bedroom", "LED2101G4", true)
+
+	new(Zigbee2MQTTDevice).StartDiscovery(bridge.vdcdClient, bridge.mqttClient)
+
+	device := bridge.vdcd.AssertInit(t, "0x000d6ffffe1a2b01")
+	if device.Name != "Bedroom" {
+		t.Errorf("unexpected device %s", device.Name)
+	}
+	if device.Output != vdcdapi.CtLightOutput {
+		t.Errorf("expected a ct light output, got %s", device.Output)
+	}
+
+	state := func(property string) interface{} { return zigbee2mqtt.State("Bedroom")[property] }
+
+	bridge.sendChannel(t, "0x000d6ffffe1a2b01", "basic_switch", 100)
+	eventually(t, "the light to switch on", func() bool { return state("state") == "ON" })
+
+	// brightness in percent, 0-254 for Zigbee2MQTT
+	bridge.sendChannel(t, "0x000d6ffffe1a2b01", "brightness", 50)
+	eventually(t, "the brightness at 127", func() bool { return state("brightness") == float64(127) })
+
+	// mired for both
+	bridge.sendChannel(t, "0x000d6ffffe1a2b01", "colortemp", 300)
+	eventually(t, "the color temperature at 300", func() bool { return state("color_temp") == float64(300) })
+
+	bridge.sync(t, "0x000d6ffffe1a2b01")
+	bridge.assertValue(t, "0x000d6ffffe1a2b01", "brightness", 50)
+	bridge.assertValue(t, "0x000d6ffffe1a2b01", "colortemp", 300)
+
+	// changed with the Zigbee2MQTT frontend
+	zigbee2mqtt.SetState("Bedroom", map[string]interface{}{"brightness": 254, "color_temp": 454})
+	bridge.vdcd.AssertChannel(t, "0x000d6ffffe1a2b01", "brightness", 100)
+	bridge.vdcd.AssertChannel(t, "0x000d6ffffe1a2b01", "colortemp", 454)
+
+	bridge.sendChannel(t, "0x000d6ffffe1a2b01", "basic_switch", 0)
+	eventually(t, "the light to switch off", func() bool { return state("state") == "OFF" })
+}
+
+func TestZigbee2MQTTRemoval(t *testing.T) {
+	bridge := newTestBridge(t)
+
+	zigbee2mqtt := mqtttest.NewZigbee2MQTT(bridge.broker)
+	zigbee2mqtt.AddLight("0x000d6ffffe1a2b02", "Hallway", "LED1623G12", false)
+	zigbee2mqtt.AddLight("0x000d6ffffe1a2b03", "Stairs", "LED1623G12", false)
+
+	new(Zigbee2MQTTDevice).StartDiscovery(bridge.vdcdClient, bridge.mqttClient)
+
+	device := bridge.vdcd.AssertInit(t, "0x000d6ffffe1a2b02")
+	if device.Output != vdcdapi.LightOutput {
+		t.Errorf("expected a light output, got %s", device.Output)
+	}
+	bridge.vdcd.AssertInit(t, "0x000d6ffffe1a2b03")
+
+	zigbee2mqtt.RemoveDevice("Hallway")
+	bridge.assertRemoved(t, "0x000d6ffffe1a2b02")
+
+	// the device still paired is kept
+	if _, err := bridge.vdcdClient.GetDeviceByTag("0x000d6ffffe1a2b03"); err != nil {
+		t.Fatalf("paired device removed: %s", err)
+	}
+	bridge.sendChannel(t, "0x000d6ffffe1a2b03", "brightness", 20)
+	eventually(t, "the brightness at 51", func() bool { return zigbee2mqtt.State("Stairs")["brightness"] == float64(51) })
+}
@@ -0,0 +1,482 @@
+// Package mqtttest provides an in-process MQTT broker and simulated Tasmota,
+// Shelly and Zigbee2MQTT devices, for tests of the MQTT based discovery backends
+// without a real broker or real devices.
+package mqtttest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT control packet types
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// Message is a message published to the broker
+type Message struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
+}
+
+// Broker is a minimal MQTT 3.1/3.1.1 broker. Messages are delivered with QoS 0,
+// retained messages are kept and sent to new subscribers.
+type Broker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+	retained map[string][]byte
+	handlers []handler
+
+	// all messages published by clients and simulators
+	messages []Message
+	changed  chan struct{}
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// handler is an in-process subscription, used by the simulators
+type handler struct {
+	filter   string
+	callback func(topic string, payload []byte)
+}
+
+type session struct {
+	conn net.Conn
+
+	mu            sync.Mutex
+	w             *bufio.Writer
+	subscriptions map[string]struct{}
+}
+
+// NewBroker starts a broker listening on a random local port
+func NewBroker() (*Broker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	b := &Broker{
+		listener: listener,
+		sessions: make(map[*session]struct{}),
+		retained: make(map[string][]byte),
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	b.wg.Add(1)
+	go b.accept()
+
+	return b, nil
+}
+
+// URL returns the broker url for mqtt.ClientOptions.AddBroker
+func (b *Broker) URL() string {
+	return fmt.Sprintf("tcp://%s", b.listener.Addr().String())
+}
+
+// Close stops the broker and closes all client connections
+func (b *Broker) Close() {
+	close(b.done)
+	b.listener.Close()
+
+	b.mu.Lock()
+	for s := range b.sessions {
+		s.conn.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+}
+
+// Publish publishes a message to all subscribers, as a device would
+func (b *Broker) Publish(topic string, payload []byte, retained bool) {
+	b.route(Message{Topic: topic, Payload: payload, Retained: retained})
+}
+
+// Subscribe calls the callback for every message matching the topic filter,
+// wildcards + and # are supported
+func (b *Broker) Subscribe(filter string, callback func(topic string, payload []byte)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler{filter: filter, callback: callback})
+}
+
+// Messages returns all messages published so far
+func (b *Broker) Messages() []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	messages := make([]Message, len(b.messages))
+	copy(messages, b.messages)
+	return messages
+}
+
+// Reset forgets all messages published so far, retained messages are kept
+func (b *Broker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages = nil
+}
+
+// WaitFor waits until a message matching the topic filter and payload was published,
+// an empty payload matches any payload
+func (b *Broker) WaitFor(timeout time.Duration, filter string, payload string) (Message, bool) {
+	deadline := time.After(timeout)
+
+	for {
+		b.mu.Lock()
+		changed := b.changed
+		for _, message := range b.messages {
+			if topicMatches(filter, message.Topic) && (payload == "" || string(message.Payload) == payload) {
+				b.mu.Unlock()
+				return message, true
+			}
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return Message{}, false
+		}
+	}
+}
+
+func (b *Broker) route(message Message) {
+	b.mu.Lock()
+	b.messages = append(b.messages, message)
+	close(b.changed)
+	b.changed = make(chan struct{})
+
+	if message.Retained {
+		if len(message.Payload) == 0 {
+			delete(b.retained, message.Topic)
+		} else {
+			b.retained[message.Topic] = message.Payload
+		}
+	}
+
+	var receivers []*session
+	for s := range b.sessions {
+		if s.subscribed(message.Topic) {
+			receivers = append(receivers, s)
+		}
+	}
+
+	var callbacks []func(topic string, payload []byte)
+	for _, h := range b.handlers {
+		if topicMatches(h.filter, message.Topic) {
+			callbacks = append(callbacks, h.callback)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, s := range receivers {
+		// messages are forwarded with retain unset, only the initial delivery is retained
+		s.publish(message.Topic, message.Payload, false)
+	}
+
+	for _, callback := range callbacks {
+		callback(message.Topic, message.Payload)
+	}
+}
+
+func (b *Broker) accept() {
+	defer b.wg.Done()
+
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			select {
+			case <-b.done:
+				return
+			default:
+			}
+			continue
+		}
+
+		s := &session{
+			conn:          conn,
+			w:             bufio.NewWriter(conn),
+			subscriptions: make(map[string]struct{}),
+		}
+
+		b.mu.Lock()
+		b.sessions[s] = struct{}{}
+		b.mu.Unlock()
+
+		b.wg.Add(1)
+		go b.serve(s)
+	}
+}
+
+func (b *Broker) serve(s *session) {
+	defer b.wg.Done()
+	defer func() {
+		b.mu.Lock()
+		delete(b.sessions, s)
+		b.mu.Unlock()
+		s.conn.Close()
+	}()
+
+	r := bufio.NewReader(s.conn)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case packetConnect:
+			s.write(packetConnack<<4, []byte{0, 0})
+
+		case packetPublish:
+			message, packetID, qos, err := parsePublish(header, body)
+			if err != nil {
+				return
+			}
+			switch qos {
+			case 1:
+				s.write(packetPuback<<4, packetID)
+			case 2:
+				s.write(packetPubrec<<4, packetID)
+			}
+			b.route(message)
+
+		case packetPubrel:
+			s.write(packetPubcomp<<4, body[:2])
+
+		case packetSubscribe:
+			filters, err := parseTopics(body[2:], true)
+			if err != nil {
+				return
+			}
+
+			// all subscriptions are granted with QoS 0
+			s.mu.Lock()
+			for _, filter := range filters {
+				s.subscriptions[filter] = struct{}{}
+			}
+			s.mu.Unlock()
+			s.write(packetSuback<<4, append(body[:2:2], make([]byte, len(filters))...))
+
+			b.sendRetained(s, filters)
+
+		case packetUnsubscribe:
+			filters, err := parseTopics(body[2:], false)
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			for _, filter := range filters {
+				delete(s.subscriptions, filter)
+			}
+			s.mu.Unlock()
+			s.write(packetUnsuback<<4, body[:2])
+
+		case packetPingreq:
+			s.write(packetPingresp<<4, nil)
+
+		case packetDisconnect:
+			return
+		}
+	}
+}
+
+// sendRetained sends the retained messages matching the new subscriptions
+func (b *Broker) sendRetained(s *session, filters []string) {
+	b.mu.Lock()
+	var retained []Message
+	for topic, payload := range b.retained {
+		for _, filter := range filters {
+			if topicMatches(filter, topic) {
+				retained = append(retained, Message{Topic: topic, Payload: payload, Retained: true})
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	for _, message := range retained {
+		s.publish(message.Topic, message.Payload, true)
+	}
+}
+
+func (s *session) subscribed(topic string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for filter := range s.subscriptions {
+		if topicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *session) publish(topic string, payload []byte, retained bool) {
+	header := byte(packetPublish << 4)
+	if retained {
+		header |= 1
+	}
+
+	body := appendString(nil, topic)
+	body = append(body, payload...)
+	s.write(header, body)
+}
+
+func (s *session) write(header byte, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	packet := []byte{header}
+	packet = appendLength(packet, len(body))
+	packet = append(packet, body...)
+
+	if _, err := s.w.Write(packet); err == nil {
+		s.w.Flush()
+	}
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := 0
+	for multiplier := 1; ; multiplier *= 128 {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&127) * multiplier
+		if digit&128 == 0 {
+			break
+		}
+		if multiplier > 128*128*128 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header, body, nil
+}
+
+func parsePublish(header byte, body []byte) (Message, []byte, int, error) {
+	qos := int(header>>1) & 3
+
+	topic, rest, err := readString(body)
+	if err != nil {
+		return Message{}, nil, 0, err
+	}
+
+	var packetID []byte
+	if qos > 0 {
+		if len(rest) < 2 {
+			return Message{}, nil, 0, errors.New("missing packet id")
+		}
+		packetID, rest = rest[:2], rest[2:]
+	}
+
+	return Message{Topic: topic, Payload: rest, Retained: header&1 == 1}, packetID, qos, nil
+}
+
+// parseTopics reads the topic filters of a (un)subscribe, subscribe filters are followed by the QoS
+func parseTopics(body []byte, withQoS bool) ([]string, error) {
+	var filters []string
+	for len(body) > 0 {
+		filter, rest, err := readString(body)
+		if err != nil {
+			return nil, err
+		}
+		if withQoS {
+			if len(rest) < 1 {
+				return nil, errors.New("missing qos")
+			}
+			rest = rest[1:]
+		}
+		filters = append(filters, filter)
+		body = rest
+	}
+	return filters, nil
+}
+
+func readString(body []byte) (string, []byte, error) {
+	if len(body) < 2 {
+		return "", nil, errors.New("missing string length")
+	}
+	length := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+length {
+		return "", nil, errors.New("string exceeds packet")
+	}
+	return string(body[2 : 2+length]), body[2+length:], nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendLength(b []byte, length int) []byte {
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 128
+		}
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
+
+// topicMatches checks the topic against a filter with + and # wildcards
+func topicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
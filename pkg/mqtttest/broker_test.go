@@ -0,0 +1,165 @@
+package mqtttest_test
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/splattner/vdcd-bridge/pkg/mqtttest"
+)
+
+const timeout = 2 * time.Second
+
+func newBroker(t *testing.T) *mqtttest.Broker {
+	t.Helper()
+
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("failed to start broker: %s", err)
+	}
+	t.Cleanup(broker.Close)
+
+	return broker
+}
+
+// connect connects a paho client to the broker, it is disconnected when the test ends
+func connect(t *testing.T, broker *mqtttest.Broker, clientID string) mqtt.Client {
+	t.Helper()
+
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.URL()).SetClientID(clientID).SetProtocolVersion(4))
+	if token := client.Connect(); !token.WaitTimeout(timeout) || token.Error() != nil {
+		t.Fatalf("failed to connect %s: %v", clientID, token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+
+	return client
+}
+
+// subscribe subscribes the client to the filter, the received messages are sent to the channel
+func subscribe(t *testing.T, client mqtt.Client, filter string) chan mqtt.Message {
+	t.Helper()
+
+	received := make(chan mqtt.Message, 16)
+	token := client.Subscribe(filter, 0, func(client mqtt.Client, message mqtt.Message) {
+		received <- message
+	})
+	if !token.WaitTimeout(timeout) || token.Error() != nil {
+		t.Fatalf("failed to subscribe to %s: %v", filter, token.Error())
+	}
+
+	return received
+}
+
+func publish(t *testing.T, client mqtt.Client, topic string, qos byte, retained bool, payload string) {
+	t.Helper()
+
+	token := client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(timeout) || token.Error() != nil {
+		t.Fatalf("failed to publish to %s with QoS %d: %v", topic, qos, token.Error())
+	}
+}
+
+func expectMessage(t *testing.T, received chan mqtt.Message, topic string, payload string, retained bool) {
+	t.Helper()
+
+	select {
+	case message := <-received:
+		if message.Topic() != topic || string(message.Payload()) != payload || message.Retained() != retained {
+			t.Fatalf("expected %s %q (retained %t), got %s %q (retained %t)", topic, payload, retained, message.Topic(), message.Payload(), message.Retained())
+		}
+	case <-time.After(timeout):
+		t.Fatalf("no message received on %s", topic)
+	}
+}
+
+func expectNoMessage(t *testing.T, received chan mqtt.Message) {
+	t.Helper()
+
+	select {
+	case message := <-received:
+		t.Fatalf("unexpected message %s %q", message.Topic(), message.Payload())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRetainedMessagesAreSentToNewSubscribers(t *testing.T) {
+	broker := newBroker(t)
+	publisher := connect(t, broker, "publisher")
+
+	publish(t, publisher, "tasmota/discovery/AABBCC/config", 0, true, `{"t":"sonoff"}`)
+	publish(t, publisher, "tele/sonoff/STATE", 0, false, `{"POWER":"ON"}`)
+
+	subscriber := connect(t, broker, "subscriber")
+	received := subscribe(t, subscriber, "#")
+	expectMessage(t, received, "tasmota/discovery/AABBCC/config", `{"t":"sonoff"}`, true)
+	expectNoMessage(t, received)
+
+	// forwarded to existing subscriptions without the retain flag
+	publish(t, publisher, "tasmota/discovery/AABBCC/config", 0, true, `{"t":"kitchen"}`)
+	expectMessage(t, received, "tasmota/discovery/AABBCC/config", `{"t":"kitchen"}`, false)
+
+	// an empty retained message clears the retained message
+	publish(t, publisher, "tasmota/discovery/AABBCC/config", 0, true, "")
+	expectMessage(t, received, "tasmota/discovery/AABBCC/config", "", false)
+
+	late := connect(t, broker, "late")
+	expectNoMessage(t, subscribe(t, late, "tasmota/#"))
+}
+
+func TestWildcardSubscriptions(t *testing.T) {
+	broker := newBroker(t)
+	client := connect(t, broker, "client")
+
+	singleLevel := subscribe(t, client, "shellies/+/relay/0")
+	multiLevel := subscribe(t, client, "zigbee2mqtt/#")
+
+	publish(t, client, "shellies/shelly1-1/relay/0", 0, false, "on")
+	publish(t, client, "shellies/shelly1-1/relay/0/command", 0, false, "off")
+	publish(t, client, "zigbee2mqtt/bridge/devices", 0, false, "[]")
+	publish(t, client, "zigbee2mqtt", 0, false, "parent")
+
+	expectMessage(t, singleLevel, "shellies/shelly1-1/relay/0", "on", false)
+	expectNoMessage(t, singleLevel)
+
+	expectMessage(t, multiLevel, "zigbee2mqtt/bridge/devices", "[]", false)
+	expectMessage(t, multiLevel, "zigbee2mqtt", "parent", false)
+
+	// in-process subscriptions of the simulators match the same way
+	commands := make(chan string, 4)
+	broker.Subscribe("cmnd/+/POWER", func(topic string, payload []byte) { commands <- topic })
+
+	publish(t, client, "cmnd/sonoff/POWER", 0, false, "on")
+	publish(t, client, "cmnd/sonoff/Dimmer", 0, false, "50")
+
+	select {
+	case topic := <-commands:
+		if topic != "cmnd/sonoff/POWER" {
+			t.Fatalf("unexpected command %s", topic)
+		}
+	case <-time.After(timeout):
+		t.Fatal("no command received")
+	}
+	if _, ok := broker.WaitFor(timeout, "cmnd/+/Dimmer", "50"); !ok {
+		t.Fatal("dimmer command not recorded")
+	}
+	if len(commands) > 0 {
+		t.Fatalf("unexpected command %s", <-commands)
+	}
+}
+
+func TestPublishWithQoS1And2IsAcknowledged(t *testing.T) {
+	broker := newBroker(t)
+	client := connect(t, broker, "client")
+	received := subscribe(t, client, "test/+")
+
+	// publish only returns once the broker completed the handshake of the QoS
+	publish(t, client, "test/qos1", 1, false, "one")
+	publish(t, client, "test/qos2", 2, false, "two")
+
+	expectMessage(t, received, "test/qos1", "one", false)
+	expectMessage(t, received, "test/qos2", "two", false)
+
+	if _, ok := broker.WaitFor(timeout, "test/qos2", "two"); !ok {
+		t.Fatal("QoS 2 message not recorded")
+	}
+}
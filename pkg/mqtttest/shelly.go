@@ -0,0 +1,154 @@
+package mqtttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Shelly simulates a Shelly Gen1 device with one relay or roller. It announces
+// itself on shellies/announce and answers shellies/<id>/relay/0/command and
+// shellies/<id>/roller/0/command with state echoes, as the firmware does. The
+// update command republishes the state.
+type Shelly struct {
+	broker *Broker
+
+	ID         string
+	Model      string
+	MACAddress string
+	IPAddress  string
+
+	// relay or roller
+	Mode string
+
+	NewFirmware bool
+
+	mu       sync.Mutex
+	on       bool
+	position int
+}
+
+// NewShelly creates a Shelly relay simulator, call Announce to publish its announce message
+func NewShelly(broker *Broker, id string, macAddress string) *Shelly {
+	s := &Shelly{
+		broker:     broker,
+		ID:         id,
+		Model:      "SHSW-1",
+		MACAddress: macAddress,
+		IPAddress:  "192.168.12.216",
+		Mode:       "relay",
+	}
+
+	// the bridge asks all devices to announce themselves
+	broker.Subscribe("shellies/command", s.command)
+	broker.Subscribe(fmt.Sprintf("shellies/%s/command", id), s.command)
+	broker.Subscribe(fmt.Sprintf("shellies/%s/relay/0/command", id), s.relayCommand)
+	broker.Subscribe(fmt.Sprintf("shellies/%s/roller/0/command", id), s.rollerCommand)
+	broker.Subscribe(fmt.Sprintf("shellies/%s/roller/0/command/pos", id), s.rollerCommand)
+
+	return s
+}
+
+// Announce publishes the announce message and the online state
+func (s *Shelly) Announce() {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"id":     s.ID,
+		"model":  s.Model,
+		"mac":    s.MACAddress,
+		"ip":     s.IPAddress,
+		"new_fw": s.NewFirmware,
+		"fw_ver": "20210429-100340/v1.10.4-g3f94cd7",
+		"mode":   s.Mode,
+	})
+
+	s.broker.Publish("shellies/announce", payload, false)
+	s.broker.Publish(fmt.Sprintf("shellies/%s/announce", s.ID), payload, false)
+	s.SetOnline(true)
+}
+
+// SetOnline publishes the retained online state, false is the last will of the device
+func (s *Shelly) SetOnline(online bool) {
+	s.broker.Publish(fmt.Sprintf("shellies/%s/online", s.ID), []byte(strconv.FormatBool(online)), true)
+}
+
+// On returns the relay state
+func (s *Shelly) On() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.on
+}
+
+// Position returns the roller position in percent
+func (s *Shelly) Position() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.position
+}
+
+// SetRelay switches the relay locally, e.g. with the wall switch
+func (s *Shelly) SetRelay(on bool) {
+	s.mu.Lock()
+	s.on = on
+	s.mu.Unlock()
+
+	s.publishRelay()
+}
+
+func (s *Shelly) command(topic string, payload []byte) {
+	switch string(payload) {
+	case "announce":
+		s.Announce()
+	case "update":
+		if s.Mode == "roller" {
+			s.publishPosition()
+		} else {
+			s.publishRelay()
+		}
+	}
+}
+
+func (s *Shelly) relayCommand(topic string, payload []byte) {
+	s.mu.Lock()
+	switch strings.ToLower(string(payload)) {
+	case "on":
+		s.on = true
+	case "off":
+		s.on = false
+	case "toggle":
+		s.on = !s.on
+	}
+	s.mu.Unlock()
+
+	s.publishRelay()
+}
+
+func (s *Shelly) rollerCommand(topic string, payload []byte) {
+	s.mu.Lock()
+	if strings.HasSuffix(topic, "/pos") {
+		s.position = clamp(atoi(string(payload), s.position), 0, 100)
+	} else {
+		switch string(payload) {
+		case "open":
+			s.position = 100
+		case "close":
+			s.position = 0
+		}
+	}
+	s.mu.Unlock()
+
+	s.publishPosition()
+}
+
+func (s *Shelly) publishRelay() {
+	state := "off"
+	if s.On() {
+		state = "on"
+	}
+	s.broker.Publish(fmt.Sprintf("shellies/%s/relay/0", s.ID), []byte(state), false)
+}
+
+func (s *Shelly) publishPosition() {
+	s.broker.Publish(fmt.Sprintf("shellies/%s/roller/0/pos", s.ID), []byte(strconv.Itoa(s.Position())), false)
+}
@@ -0,0 +1,238 @@
+package mqtttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Tasmota simulates a Tasmota device with one relay. It announces itself with
+// the Tasmota discovery protocol and answers cmnd/<topic>/... with state echoes
+// on stat/<topic>/RESULT, as the firmware does.
+type Tasmota struct {
+	broker *Broker
+
+	MACAddress   string
+	Topic        string
+	FriendlyName string
+	Model        string
+	IPAddress    string
+
+	// 0 for a relay, 4 for a RGBW light, see lt_st of the discovery config
+	LightSubtype int
+
+	mu     sync.Mutex
+	power  bool
+	dimmer int
+	hue    int
+	sat    int
+	ct     int
+}
+
+// NewTasmota creates a Tasmota relay simulator, call Announce to publish its discovery config
+func NewTasmota(broker *Broker, macAddress string, topic string, friendlyName string) *Tasmota {
+	t := &Tasmota{
+		broker:       broker,
+		MACAddress:   macAddress,
+		Topic:        topic,
+		FriendlyName: friendlyName,
+		Model:        "Sonoff Basic",
+		IPAddress:    "192.168.12.162",
+		dimmer:       100,
+		ct:           153,
+	}
+
+	broker.Subscribe(fmt.Sprintf("cmnd/%s/+", topic), t.command)
+
+	return t
+}
+
+// Announce publishes the retained discovery config and the online state
+func (t *Tasmota) Announce() {
+	relays := []int{1, 0, 0, 0, 0, 0, 0, 0}
+	if t.LightSubtype > 0 {
+		relays[0] = 2
+	}
+
+	config := map[string]interface{}{
+		"ip":    t.IPAddress,
+		"dn":    t.FriendlyName,
+		"fn":    []interface{}{t.FriendlyName, nil, nil, nil, nil, nil, nil, nil},
+		"hn":    strings.ToLower(t.Topic),
+		"mac":   t.MACAddress,
+		"md":    t.Model,
+		"ty":    0,
+		"if":    0,
+		"ofln":  "Offline",
+		"onln":  "Online",
+		"state": []string{"OFF", "ON", "TOGGLE", "HOLD"},
+		"sw":    "9.5.0",
+		"t":     t.Topic,
+		"ft":    "%prefix%/%topic%/",
+		"tp":    []string{"cmnd", "stat", "tele"},
+		"rl":    relays,
+		"swc":   []int{-1, -1, -1, -1, -1, -1, -1, -1},
+		"swn":   []interface{}{nil, nil, nil, nil, nil, nil, nil, nil},
+		"btn":   []int{0, 0, 0, 0, 0, 0, 0, 0},
+		"so":    map[string]int{"4": 0, "11": 0, "13": 0, "17": 1, "20": 0, "30": 0, "68": 0, "73": 0, "82": 0, "114": 0, "117": 0},
+		"lk":    1,
+		"lt_st": t.LightSubtype,
+		"sho":   []int{0, 0, 0, 0},
+		"ver":   1,
+	}
+
+	payload, _ := json.Marshal(config)
+	t.broker.Publish(fmt.Sprintf("tasmota/discovery/%s/config", t.MACAddress), payload, true)
+	t.broker.Publish(fmt.Sprintf("tele/%s/LWT", t.Topic), []byte("Online"), true)
+}
+
+// Remove clears the retained discovery config, as Tasmota does when discovery is disabled
+func (t *Tasmota) Remove() {
+	t.broker.Publish(fmt.Sprintf("tasmota/discovery/%s/config", t.MACAddress), nil, true)
+	t.broker.Publish(fmt.Sprintf("tele/%s/LWT", t.Topic), []byte("Offline"), true)
+}
+
+// Power returns the relay state
+func (t *Tasmota) Power() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.power
+}
+
+// Dimmer returns the brightness in percent
+func (t *Tasmota) Dimmer() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dimmer
+}
+
+// CT returns the color temperature in mired
+func (t *Tasmota) CT() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ct
+}
+
+// SetPower switches the relay locally, e.g. with the button of the device
+func (t *Tasmota) SetPower(on bool) {
+	t.mu.Lock()
+	t.power = on
+	t.mu.Unlock()
+
+	t.publishResult(map[string]interface{}{"POWER": t.powerState()})
+}
+
+// PublishSensor publishes a telemetry message of a SI7021 temperature and humidity sensor
+func (t *Tasmota) PublishSensor(temperature float32, humidity float32) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"Time":     "2021-01-01T00:00:00",
+		"TempUnit": "C",
+		"SI7021":   map[string]float32{"Temperature": temperature, "Humidity": humidity},
+	})
+	t.broker.Publish(fmt.Sprintf("tele/%s/SENSOR", t.Topic), payload, false)
+}
+
+func (t *Tasmota) command(topic string, payload []byte) {
+	command := strings.ToUpper(topic[strings.LastIndex(topic, "/")+1:])
+	value := strings.TrimSpace(string(payload))
+
+	t.mu.Lock()
+	switch command {
+	case "POWER", "POWER1":
+		switch strings.ToLower(value) {
+		case "on", "1":
+			t.power = true
+		case "off", "0":
+			t.power = false
+		case "toggle", "2":
+			t.power = !t.power
+		}
+	case "DIMMER":
+		switch value {
+		case "+":
+			t.dimmer = clamp(t.dimmer+10, 0, 100)
+		case "-":
+			t.dimmer = clamp(t.dimmer-10, 0, 100)
+		default:
+			t.dimmer = clamp(atoi(value, t.dimmer), 0, 100)
+		}
+		t.power = t.dimmer > 0
+	case "HSBCOLOR":
+		if hsb := strings.Split(value, ","); len(hsb) == 3 {
+			t.hue = clamp(atoi(hsb[0], t.hue), 0, 360)
+			t.sat = clamp(atoi(hsb[1], t.sat), 0, 100)
+			t.dimmer = clamp(atoi(hsb[2], t.dimmer), 0, 100)
+		}
+	case "HSBCOLOR1":
+		t.hue = clamp(atoi(value, t.hue), 0, 360)
+	case "HSBCOLOR2":
+		t.sat = clamp(atoi(value, t.sat), 0, 100)
+	case "HSBCOLOR3", "WHITE":
+		t.dimmer = clamp(atoi(value, t.dimmer), 0, 100)
+	case "CT":
+		t.ct = clamp(atoi(value, t.ct), 153, 500)
+	case "STATE", "BACKLOG":
+	default:
+		t.mu.Unlock()
+		return
+	}
+	state := t.state()
+	t.mu.Unlock()
+
+	if command == "STATE" {
+		payload, _ := json.Marshal(state)
+		t.broker.Publish(fmt.Sprintf("stat/%s/STATE", t.Topic), payload, false)
+		return
+	}
+
+	t.publishResult(state)
+}
+
+// state returns the light state as reported by RESULT and STATE, called with mu held
+func (t *Tasmota) state() map[string]interface{} {
+	state := map[string]interface{}{"POWER": t.powerStateLocked()}
+	if t.LightSubtype > 0 {
+		state["Dimmer"] = t.dimmer
+		state["HSBColor"] = fmt.Sprintf("%d,%d,%d", t.hue, t.sat, t.dimmer)
+		state["CT"] = t.ct
+	}
+	return state
+}
+
+func (t *Tasmota) publishResult(result map[string]interface{}) {
+	payload, _ := json.Marshal(result)
+	t.broker.Publish(fmt.Sprintf("stat/%s/RESULT", t.Topic), payload, false)
+}
+
+func (t *Tasmota) powerState() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.powerStateLocked()
+}
+
+func (t *Tasmota) powerStateLocked() string {
+	if t.power {
+		return "ON"
+	}
+	return "OFF"
+}
+
+func atoi(value string, fallback int) int {
+	if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+		return int(math.Round(f))
+	}
+	return fallback
+}
+
+func clamp(value int, min int, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
@@ -0,0 +1,236 @@
+package mqtttest
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// Zigbee2MQTT simulates a Zigbee2MQTT bridge. The paired devices are published
+// retained on zigbee2mqtt/bridge/devices, zigbee2mqtt/<name>/set and
+// zigbee2mqtt/<name>/set/<property> update the device state which is echoed on
+// zigbee2mqtt/<name>, as Zigbee2MQTT does.
+type Zigbee2MQTT struct {
+	broker *Broker
+
+	mu      sync.Mutex
+	devices []map[string]interface{}
+	groups  []map[string]interface{}
+	states  map[string]map[string]interface{}
+}
+
+// NewZigbee2MQTT creates a Zigbee2MQTT bridge simulator without paired devices
+func NewZigbee2MQTT(broker *Broker) *Zigbee2MQTT {
+	z := &Zigbee2MQTT{
+		broker: broker,
+		states: make(map[string]map[string]interface{}),
+	}
+
+	broker.Subscribe("zigbee2mqtt/bridge/request/+", z.bridgeRequest)
+	broker.Subscribe("zigbee2mqtt/+/set", z.set)
+	broker.Subscribe("zigbee2mqtt/+/set/+", z.set)
+	broker.Subscribe("zigbee2mqtt/+/get", z.get)
+
+	return z
+}
+
+// AddDevice pairs a device, given as an entry of zigbee2mqtt/bridge/devices
+// with at least friendly_name and definition, and publishes the device list
+func (z *Zigbee2MQTT) AddDevice(device map[string]interface{}, state map[string]interface{}) {
+	name, _ := device["friendly_name"].(string)
+
+	z.mu.Lock()
+	z.devices = append(z.devices, device)
+	if state == nil {
+		state = make(map[string]interface{})
+	}
+	z.states[name] = state
+	z.mu.Unlock()
+
+	z.PublishDevices()
+}
+
+// AddLight pairs a dimmable light, with colorTemp it also exposes color_temp in mired
+func (z *Zigbee2MQTT) AddLight(ieeeAddress string, friendlyName string, model string, colorTemp bool) {
+	features := []map[string]interface{}{
+		{"name": "state", "property": "state", "type": "binary", "access": 7, "value_on": "ON", "value_off": "OFF", "value_toggle": "TOGGLE"},
+		{"name": "brightness", "property": "brightness", "type": "numeric", "access": 7, "value_min": 0, "value_max": 254},
+	}
+	state := map[string]interface{}{"state": "OFF", "brightness": 254}
+
+	if colorTemp {
+		features = append(features, map[string]interface{}{"name": "color_temp", "property": "color_temp", "type": "numeric", "access": 7, "unit": "mired", "value_min": 250, "value_max": 454})
+		state["color_temp"] = 370
+	}
+
+	z.AddDevice(map[string]interface{}{
+		"ieee_address":        ieeeAddress,
+		"friendly_name":       friendlyName,
+		"type":                "Router",
+		"supported":           true,
+		"interview_completed": true,
+		"power_source":        "Mains (single phase)",
+		"definition": map[string]interface{}{
+			"model":       model,
+			"vendor":      "IKEA",
+			"description": "TRADFRI bulb",
+			"exposes":     []map[string]interface{}{{"type": "light", "features": features}},
+		},
+	}, state)
+}
+
+// RemoveDevice unpairs the device and publishes the device list
+func (z *Zigbee2MQTT) RemoveDevice(friendlyName string) {
+	z.mu.Lock()
+	for i, device := range z.devices {
+		if device["friendly_name"] == friendlyName {
+			z.devices = append(z.devices[:i], z.devices[i+1:]...)
+			break
+		}
+	}
+	delete(z.states, friendlyName)
+	z.mu.Unlock()
+
+	z.PublishDevices()
+}
+
+// AddGroup adds a group, given as an entry of zigbee2mqtt/bridge/groups
+func (z *Zigbee2MQTT) AddGroup(group map[string]interface{}) {
+	z.mu.Lock()
+	z.groups = append(z.groups, group)
+	z.mu.Unlock()
+
+	z.PublishGroups()
+}
+
+// PublishDevices publishes the retained list of paired devices
+func (z *Zigbee2MQTT) PublishDevices() {
+	z.mu.Lock()
+	payload, _ := json.Marshal(z.devices)
+	z.mu.Unlock()
+
+	z.broker.Publish("zigbee2mqtt/bridge/devices", payload, true)
+}
+
+// PublishGroups publishes the retained list of groups
+func (z *Zigbee2MQTT) PublishGroups() {
+	z.mu.Lock()
+	groups := z.groups
+	if groups == nil {
+		groups = []map[string]interface{}{}
+	}
+	payload, _ := json.Marshal(groups)
+	z.mu.Unlock()
+
+	z.broker.Publish("zigbee2mqtt/bridge/groups", payload, true)
+}
+
+// State returns a copy of the state of the device
+func (z *Zigbee2MQTT) State(friendlyName string) map[string]interface{} {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	state := make(map[string]interface{})
+	for key, value := range z.states[friendlyName] {
+		state[key] = value
+	}
+	return state
+}
+
+// SetState changes the state of the device locally, e.g. a sensor reading, and publishes it
+func (z *Zigbee2MQTT) SetState(friendlyName string, update map[string]interface{}) {
+	z.mu.Lock()
+	state, ok := z.states[friendlyName]
+	if ok {
+		for key, value := range update {
+			state[key] = value
+		}
+	}
+	z.mu.Unlock()
+
+	if ok {
+		z.publishState(friendlyName)
+	}
+}
+
+// Action publishes an action of a remote or wireless switch, e.g. "single" or "brightness_up"
+func (z *Zigbee2MQTT) Action(friendlyName string, action string) {
+	payload, _ := json.Marshal(map[string]string{"action": action})
+	z.broker.Publish("zigbee2mqtt/"+friendlyName, payload, false)
+	z.broker.Publish("zigbee2mqtt/"+friendlyName+"/action", []byte(action), false)
+}
+
+func (z *Zigbee2MQTT) bridgeRequest(topic string, payload []byte) {
+	switch {
+	case strings.HasSuffix(topic, "/devices"):
+		z.PublishDevices()
+	case strings.HasSuffix(topic, "/groups"):
+		z.PublishGroups()
+	}
+}
+
+func (z *Zigbee2MQTT) set(topic string, payload []byte) {
+	levels := strings.Split(topic, "/")
+	name := levels[1]
+
+	update := make(map[string]interface{})
+	if len(levels) == 4 {
+		// a single property, the value is not JSON encoded for strings
+		var value interface{}
+		if err := json.Unmarshal(payload, &value); err != nil {
+			value = string(payload)
+		}
+		update[levels[3]] = value
+	} else if err := json.Unmarshal(payload, &update); err != nil {
+		return
+	}
+
+	z.mu.Lock()
+	state, ok := z.states[name]
+	if ok {
+		for key, value := range update {
+			if key == "state" {
+				value = z.switchState(state, value)
+			}
+			state[key] = value
+		}
+	}
+	z.mu.Unlock()
+
+	if ok {
+		z.publishState(name)
+	}
+}
+
+// switchState maps on/off/toggle to the ON/OFF reported by Zigbee2MQTT, called with mu held
+func (z *Zigbee2MQTT) switchState(state map[string]interface{}, value interface{}) interface{} {
+	command, _ := value.(string)
+
+	switch strings.ToUpper(command) {
+	case "ON":
+		return "ON"
+	case "OFF":
+		return "OFF"
+	case "TOGGLE":
+		if state["state"] == "ON" {
+			return "OFF"
+		}
+		return "ON"
+	}
+	return value
+}
+
+func (z *Zigbee2MQTT) get(topic string, payload []byte) {
+	z.publishState(strings.Split(topic, "/")[1])
+}
+
+func (z *Zigbee2MQTT) publishState(friendlyName string) {
+	z.mu.Lock()
+	state, ok := z.states[friendlyName]
+	payload, _ := json.Marshal(state)
+	z.mu.Unlock()
+
+	if ok {
+		z.broker.Publish("zigbee2mqtt/"+friendlyName, payload, false)
+	}
+}
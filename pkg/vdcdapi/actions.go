@@ -0,0 +1,95 @@
+package vdcdapi
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ActionHandler executes an action invoked by the vdcd. The params contain
+// the values as sent by the vdcd, use ParamFloat and ParamString to read them.
+type ActionHandler func(device *Device, params map[string]interface{}) error
+
+// AddAction registers a custom action with its handler. Actions must be added
+// before the device is initialized, they are announced with the init message.
+func (e *Device) AddAction(id string, action Action, handler ActionHandler) {
+	if e.Actions == nil {
+		e.Actions = make(map[string]Action)
+	}
+	e.Actions[id] = action
+	e.setActionHandler(id, handler)
+}
+
+// AddDynamicAction registers a dynamic action with its handler
+func (e *Device) AddDynamicAction(id string, action DynamicAction, handler ActionHandler) {
+	if e.DynamicActions == nil {
+		e.DynamicActions = make(map[string]DynamicAction)
+	}
+	e.DynamicActions[id] = action
+	e.setActionHandler(id, handler)
+}
+
+func (e *Device) setActionHandler(id string, handler ActionHandler) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.action_cbs == nil {
+		e.action_cbs = make(map[string]ActionHandler)
+	}
+	e.action_cbs[id] = handler
+}
+
+// InvokeAction runs the handler registered for the action
+func (e *Device) InvokeAction(id string, params map[string]interface{}) error {
+	e.mu.Lock()
+	handler, ok := e.action_cbs[id]
+	e.mu.Unlock()
+	if !ok {
+		return ErrActionNotFound
+	}
+
+	log.WithFields(log.Fields{
+		"UniqueID": e.UniqueID,
+		"Action":   id,
+		"Params":   params,
+	}).Info("Invoke action")
+
+	return handler(e, params)
+}
+
+// ParamFloat returns the numeric param with the given name, or fallback when it is not set
+func ParamFloat(params map[string]interface{}, name string, fallback float32) (float32, error) {
+	value, ok := params[name]
+	if !ok || value == nil {
+		return fallback, nil
+	}
+
+	switch v := value.(type) {
+	case float64:
+		return float32(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		f, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			return fallback, fmt.Errorf("param %s is not numeric: %w", name, err)
+		}
+		return float32(f), nil
+	}
+
+	return fallback, fmt.Errorf("param %s has unsupported type %T", name, value)
+}
+
+// ParamString returns the param with the given name as string, or fallback when it is not set
+func ParamString(params map[string]interface{}, name string, fallback string) string {
+	value, ok := params[name]
+	if !ok || value == nil {
+		return fallback
+	}
+
+	return fmt.Sprintf("%v", value)
+}
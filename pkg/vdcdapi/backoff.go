@@ -0,0 +1,47 @@
+package vdcdapi
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff configures the delay between connection attempts to the vdcd
+type Backoff struct {
+	// Delay before the first retry
+	InitialInterval time.Duration
+	// Upper bound for the delay between two attempts
+	MaxInterval time.Duration
+	// Factor the delay grows by after every failed attempt
+	Multiplier float64
+	// Randomization factor between 0 and 1 applied to every delay
+	Jitter float64
+	// Maximum number of attempts, 0 retries forever
+	MaxRetries int
+}
+
+// DefaultBackoff returns an exponential backoff with jitter and unlimited retries
+func DefaultBackoff() Backoff {
+	return Backoff{
+		InitialInterval: time.Second,
+		MaxInterval:     time.Minute,
+		Multiplier:      2,
+		Jitter:          0.2,
+		MaxRetries:      0,
+	}
+}
+
+// Delay returns the wait time before the given (zero based) retry attempt
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.InitialInterval) * math.Pow(b.Multiplier, float64(attempt))
+	if b.MaxInterval > 0 && delay > float64(b.MaxInterval) {
+		delay = float64(b.MaxInterval)
+	}
+
+	if b.Jitter > 0 {
+		delta := b.Jitter * delay
+		delay = delay - delta + rand.Float64()*(2*delta)
+	}
+
+	return time.Duration(delay)
+}
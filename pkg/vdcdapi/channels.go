@@ -0,0 +1,108 @@
+package vdcdapi
+
+import (
+	"math"
+)
+
+// Range of the colortemp channel in mired, as expected by the vdcd
+const (
+	MinColorTemperature = 100
+	MaxColorTemperature = 1000
+)
+
+// channelRanges are the value ranges of the vdcd channel types, applied to
+// channels added without an explicit range
+var channelRanges = map[ChannelTypeType]Channel{
+	UndefinedType:                 {Min: 0, Max: 100, Unit: "percent"},
+	BrightnessType:                {Min: 0, Max: 100, Unit: "percent"},
+	HueType:                       {Min: 0, Max: 360, Unit: "degree"},
+	SaturationType:                {Min: 0, Max: 100, Unit: "percent"},
+	ColorTemperatureType:          {Min: MinColorTemperature, Max: MaxColorTemperature, Resolution: 1, Unit: "mired"},
+	XCIEColorType:                 {Min: 0, Max: 1, Resolution: 0.0001},
+	YCIEColorType:                 {Min: 0, Max: 1, Resolution: 0.0001},
+	BlindsShadePositionType:       {Min: 0, Max: 100, Unit: "percent"},
+	CurtainShadePositionType:      {Min: 0, Max: 100, Unit: "percent"},
+	BlindShadeAngleType:           {Min: 0, Max: 100, Unit: "percent"},
+	CurtainsShadeAngleType:        {Min: 0, Max: 100, Unit: "percent"},
+	TransparencyType:              {Min: 0, Max: 100, Unit: "percent"},
+	AirflowIntesityType:           {Min: 0, Max: 100, Unit: "percent"},
+	AirflowDirectionType:          {Min: 0, Max: 2, Resolution: 1},
+	AirflowFlapPositionType:       {Min: 0, Max: 100, Unit: "percent"},
+	VentilationLouverPositionType: {Min: 0, Max: 100, Unit: "percent"},
+	HeatingPowerType:              {Min: 0, Max: 100, Unit: "percent"},
+	CoolingCapacityType:           {Min: 0, Max: 100, Unit: "percent"},
+	AudioVolumeType:               {Min: 0, Max: 100, Unit: "percent"},
+}
+
+// applyDefaultRange sets the range of the channel type when no range is given
+func (c *Channel) applyDefaultRange() {
+	if c.Min != 0 || c.Max != 0 {
+		return
+	}
+
+	if r, ok := channelRanges[c.ChannelType]; ok {
+		c.Min = r.Min
+		c.Max = r.Max
+		c.Resolution = r.Resolution
+		if c.Unit == "" {
+			c.Unit = r.Unit
+		}
+	}
+}
+
+// HasValue reports whether a value was set, by the backend or the vdcd
+func (c *Channel) HasValue() bool {
+	return c.hasValue
+}
+
+// normalize clamps the value to the range of the channel and rounds it to the
+// resolution. The second return value is false when the value was out of range.
+func (c *Channel) normalize(value float32) (float32, bool) {
+	inRange := true
+
+	if c.Min != 0 || c.Max != 0 {
+		if value < c.Min {
+			value = c.Min
+			inRange = false
+		}
+		if value > c.Max {
+			value = c.Max
+			inRange = false
+		}
+	}
+
+	if c.Resolution > 0 {
+		value = float32(math.Round(float64(value/c.Resolution))) * c.Resolution
+	}
+
+	return value, inRange
+}
+
+// KelvinToMired converts a color temperature in Kelvin to mired, the unit of the colortemp channel
+func KelvinToMired(kelvin float32) float32 {
+	if kelvin <= 0 {
+		return 0
+	}
+	return float32(math.Round(1000000 / float64(kelvin)))
+}
+
+// MiredToKelvin converts a color temperature in mired to Kelvin
+func MiredToKelvin(mired float32) float32 {
+	if mired <= 0 {
+		return 0
+	}
+	return float32(math.Round(1000000 / float64(mired)))
+}
+
+// ScaleToPercent converts a backend value between 0 and max, e.g. a brightness of 0-254, to 0-100%
+func ScaleToPercent(value float32, max float32) float32 {
+	if max <= 0 {
+		return 0
+	}
+	return value / max * 100
+}
+
+// PercentToScale converts 0-100% to a backend value between 0 and max, rounded to an integer
+func PercentToScale(percent float32, max float32) float32 {
+	return float32(math.Round(float64(percent / 100 * max)))
+}
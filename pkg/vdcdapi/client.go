@@ -8,13 +8,15 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// DefaultInitDelay is the time added devices are collected before they are announced
+const DefaultInitDelay = 250 * time.Millisecond
+
 type Client struct {
 	conn    net.Conn
 	host    string
@@ -25,28 +27,80 @@ type Client struct {
 	w  *bufio.Writer
 	mu sync.Mutex
 
-	dialRetry int
+	// connected is false while the session to the vdcd is down.
+	// Outgoing messages are dropped in that state, the current device
+	// state is pushed again once the session is resumed.
+	connected bool
+
+	backoff Backoff
+
+	devices deviceRegistry
 
-	devices []*Device
+	// devices added within the init delay are announced with a single init message
+	initDelay   time.Duration
+	initTimer   *time.Timer
+	initTimerMu sync.Mutex
+
+	// init requests waiting for a status reply from the vdcd
+	pending pendingRequests
 
 	modelName  string
 	vendorName string
 
-	interrupt      chan os.Signal
+	// announced with the initvdc message at connect
+	vdcIconName  string
+	vdcConfigURL string
+
+	// scene command to backend scene/preset mappings per device uniqueid
+	sceneMappings map[string]map[string]string
+
+	// name, group, output, ... overrides of the devices announced by the backends
+	overrides []DeviceOverride
+
+	// optional persistence of the known devices and their values
+	store *DeviceStore
+
 	receiveChannel chan string
+	receiveErr     chan error
+
+	// optional recording of all messages exchanged with the vdcd
+	recorder recorder
+
+	// called when a device is added, removed or changed, see SetDeviceChangedCB
+	deviceChangedCB func(device *Device)
 }
 
 func (e *Client) NewCient(host string, port int, modelName string, vendorName string, dryMode bool) {
 	e.host = host
 	e.port = port
-	e.dialRetry = 5
+	e.backoff = DefaultBackoff()
+	e.initDelay = DefaultInitDelay
 
 	e.modelName = modelName
 	e.vendorName = vendorName
 	e.dryMode = dryMode
 }
 
-func (e *Client) Connect() {
+// SetBackoff configures the retry behaviour of Connect
+func (e *Client) SetBackoff(backoff Backoff) {
+	e.backoff = backoff
+}
+
+// SetInitDelay configures how long added devices are collected before they
+// are announced with a single init message, 0 announces every device at once
+func (e *Client) SetInitDelay(delay time.Duration) {
+	e.initDelay = delay
+}
+
+// SetVdcInfo configures the icon and the config URL announced for the vdc
+func (e *Client) SetVdcInfo(iconName string, configURL string) {
+	e.vdcIconName = iconName
+	e.vdcConfigURL = configURL
+}
+
+// Connect dials the vdcd until a connection is established, the configured
+// number of retries is exhausted or the context is canceled.
+func (e *Client) Connect(ctx context.Context) error {
 
 	var connString = e.host + ":" + fmt.Sprint((e.port))
 	var conn net.Conn
@@ -54,61 +108,184 @@ func (e *Client) Connect() {
 
 	log.WithField("vdcd Host", connString).Info("Trying to connect to vdcd")
 
-	for i := 0; i < e.dialRetry; i++ {
+	dialer := net.Dialer{}
+	for attempt := 0; e.backoff.MaxRetries == 0 || attempt < e.backoff.MaxRetries; attempt++ {
 
-		conn, err = net.Dial("tcp", connString)
-
-		if err != nil {
-			log.WithError(err).Warn("Dial failed")
-			time.Sleep(time.Second)
-		} else {
+		conn, err = dialer.DialContext(ctx, "tcp", connString)
+		if err == nil {
 			break
 		}
 
+		delay := e.backoff.Delay(attempt)
+		log.WithError(err).WithField("Retry in", delay).Warn("Dial failed")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
 	}
 
 	if conn == nil {
-		log.WithField("vdcd Host", connString).Error("Failed to connect to vdcd")
-		os.Exit(1)
+		return fmt.Errorf("failed to connect to vdcd %s: %w", connString, err)
 	}
 
 	log.WithField("vdcd Host", connString).Info("Connected to vdcd")
 
+	e.mu.Lock()
 	e.conn = conn
 	e.r = bufio.NewReader(e.conn)
 	e.w = bufio.NewWriter(e.conn)
+	e.connected = true
+	e.mu.Unlock()
+
+	// The vdc is announced before any device, also after a reconnect
+	e.sendInitVdcMessage()
+
+	return nil
+}
+
+// IsConnected reports whether a session to the vdcd is currently established
+func (e *Client) IsConnected() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.connected
+}
+
+// handleDisconnect tears down the current session. The vdcd forgets all
+// devices of a closed connection, so every device has to be initialized again.
+func (e *Client) handleDisconnect() {
+	e.mu.Lock()
+	e.connected = false
+	if e.conn != nil {
+		if err := e.conn.Close(); err != nil {
+			log.WithError(err).Debug("Failed to close broken connection to vdcd")
+		}
+	}
+	e.mu.Unlock()
+
+	e.pending.clear()
+
+	for _, device := range e.devices.snapshot() {
+		device.resetInit()
+	}
+}
+
+// resumeSession re-announces all known devices after a reconnect, their
+// current values are pushed with the init so the dSS matches reality again.
+func (e *Client) resumeSession() {
+	log.WithField("Devices", e.devices.len()).Info("Resuming vdcd session, re-announcing devices")
+
+	e.Initialize()
+}
+
+// pushDeviceState sends the current channel, sensor and input values of the
+// device, e.g. after a sync, values never reported by the backend are left out
+func (e *Client) pushDeviceState(device *Device) {
+	err := device.sendIfInitialized(func() error {
+		return e.sendValues(device, device.values())
+	})
+	if err != nil {
+		log.WithError(err).WithField("UniqueID", device.UniqueID).Debug("Failed to push device state")
+	}
+}
+
+// pushInitState sends the remembered channel, sensor, input, state and property
+// values of a device right after its init, the vdcd only knows the declared defaults
+func (e *Client) pushInitState(device *Device, values deviceValues) {
+	if err := e.sendValues(device, values); err != nil {
+		return
+	}
+
+	if len(values.stateValues) > 0 {
+		if err := e.SendPushNotification(device.Tag, values.stateValues, nil); err != nil {
+			return
+		}
+	}
+
+	for name, value := range values.propertyValues {
+		if err := e.SendUpdatePropertyMessage(device.Tag, name, value); err != nil {
+			return
+		}
+	}
+}
+
+// sendValues sends the channel, sensor and input values known from the backend
+func (e *Client) sendValues(device *Device, values deviceValues) error {
+	for _, channel := range values.channels {
+		if channel.hasValue {
+			if err := e.sendChannelMessage(channel.Value, device.Tag, channel.ChannelName, channel.ChannelType); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, sensor := range values.sensors {
+		if sensor.hasValue {
+			if err := e.SendSensorMessage(sensor.Value, device.Tag, sensor.Id, i); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, input := range values.inputs {
+		if input.hasValue {
+			if err := e.SendInputMessage(input.Value, device.Tag, input.Id, i); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
 func (e *Client) Close() {
 	log.Info("Closing connection from vdcd")
 	e.sendByeMessage()
+
+	e.mu.Lock()
+	e.connected = false
 	if e.conn != nil {
 		if err := e.conn.Close(); err != nil {
 			log.WithError(err).Warn("Failed to close connection from vdcd")
 		}
 	}
+	e.mu.Unlock()
 	log.Info("Connection from vdcd closed")
 }
 
-func (e *Client) ListenWithContext(ctx context.Context) {
+// ListenWithContext processes messages from the vdcd until the context is
+// canceled or the connection is lost and cannot be reestablished.
+func (e *Client) ListenWithContext(ctx context.Context) error {
 	log.Info("Start listening for vdcd messages")
 
 	e.receiveChannel = make(chan string)
+	e.receiveErr = make(chan error, 1)
 	go e.Receive(ctx)
 
 	for {
 		select {
 		case receiveMessage := <-e.receiveChannel:
+			e.recorder.record(DirectionIn, []byte(receiveMessage))
+
 			var msg GenericVDCDMessage
 			err := json.Unmarshal([]byte(receiveMessage), &msg)
-			if err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				// e.g. a string value of setProperty, those are read from the raw message
+				log.WithError(err).Debug("Json Unmarshal of field failed")
+			} else if err != nil {
 				log.WithError(err).Error("Json Unmarshal failed")
 			}
+			msg.raw = []byte(receiveMessage)
 			e.processMessage(&msg)
+		case err := <-e.receiveErr:
+			log.WithError(err).Error("Stop listening for vdcd messages")
+			return err
 		case <-ctx.Done():
 			log.Info("Stop listening for vdcd messages")
 			e.Close()
-			return
+			return nil
 		}
 	}
 }
@@ -129,26 +306,158 @@ func (e *Client) Receive(ctx context.Context) {
 		line, err := e.r.ReadString('\n')
 
 		if err != nil {
-			log.WithError(err).Error("Failed to read")
+			select {
+			case <-ctx.Done():
+				log.Info("Stop receiving vdcd messages")
+				return
+			default:
+			}
 
 			if err == io.EOF {
-				// try to reconnect
-				e.Connect()
-				continue
+				log.Warn("Connection closed by vdcd")
+			} else {
+				log.WithError(err).Error("Failed to read")
 			}
-			return
+
+			// The session is gone, reconnect and announce all devices again
+			e.handleDisconnect()
+			if err := e.Connect(ctx); err != nil {
+				if ctx.Err() == nil {
+					e.receiveErr <- err
+				}
+				return
+			}
+			e.resumeSession()
+			continue
 		}
 		log.Debug("Message received, sending to receiveChannel")
 
-		e.receiveChannel <- line
+		select {
+		case e.receiveChannel <- line:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SetSceneMappings configures the scene command mappings applied to devices
+// when they are added. The map is keyed by device uniqueid, then scene command.
+func (e *Client) SetSceneMappings(mappings map[string]map[string]string) {
+	e.sceneMappings = mappings
+}
+
+// SetDeviceChangedCB sets a callback called when a device is added or removed,
+// or one of its values or its init state changed
+func (e *Client) SetDeviceChangedCB(cb func(device *Device)) {
+	e.deviceChangedCB = cb
+}
+
+// deviceChanged persists the device and notifies the device changed callback
+func (e *Client) deviceChanged(device *Device) {
+	e.remember(device)
+	if e.deviceChangedCB != nil {
+		e.deviceChangedCB(device)
 	}
 }
 
-func (e *Client) AddDevice(device *Device) {
+// AddDevice registers the device and schedules its init, devices added within
+// the init delay are announced together. A device with the same tag or uniqueid
+// and subdevice index as a known device is not added, AddDevice returns false
+// in that case. The device overrides are applied before, ignored devices are
+// not added either.
+func (e *Client) AddDevice(device *Device) bool {
+
+	if !e.applyOverrides(device) {
+		log.WithFields(log.Fields{
+			"UniqueID": device.UniqueID,
+			"Name":     device.Name,
+		}).Debug("Device ignored by override")
+		return false
+	}
 
-	e.devices = append(e.devices, device)
+	for cmd, target := range e.sceneMappings[device.UniqueID] {
+		device.SetSceneMapping(cmd, target)
+	}
 
-	e.Initialize()
+	if existing, added := e.devices.add(device); !added {
+		if existing.restored && !device.restored && keyOf(existing) == keyOf(device) {
+			e.takeOver(existing, device)
+			e.deviceChanged(device)
+			return true
+		}
+
+		log.WithFields(log.Fields{
+			"UniqueID": device.UniqueID,
+			"Tag":      existing.Tag,
+		}).Debug("Device already added")
+		return false
+	}
+
+	e.deviceChanged(device)
+	e.scheduleInit()
+
+	return true
+}
+
+// RemoveDevice says bye for the device with the given tag and forgets it. The
+// callbacks of the device are unregistered, the remove callback lets the
+// backend release its subscriptions.
+func (e *Client) RemoveDevice(tag string) error {
+	device, ok := e.devices.remove(tag)
+	if !ok {
+		return ErrDeviceNotFound
+	}
+
+	log.WithFields(log.Fields{
+		"Name":     device.Name,
+		"UniqueID": device.UniqueID,
+		"Tag":      tag,
+	}).Info("Removing device")
+
+	// The vdcd only knows initialized devices, wait for an init being sent
+	device.sendMu.Lock()
+	if device.InitDone() {
+		e.sendDeviceByeMessage(tag)
+	}
+	device.resetInit()
+	device.sendMu.Unlock()
+
+	if e.store != nil {
+		e.store.remove(tag)
+	}
+
+	e.deviceChanged(device)
+
+	if remove_cb := device.clearCallbacks(); remove_cb != nil {
+		remove_cb(device)
+	}
+
+	return nil
+}
+
+// scheduleInit initializes the pending devices after the init delay, a
+// discovery burst results in a single init message
+func (e *Client) scheduleInit() {
+	if e.initDelay <= 0 {
+		e.Initialize()
+		return
+	}
+
+	e.initTimerMu.Lock()
+	defer e.initTimerMu.Unlock()
+
+	// An init is already scheduled, the device is announced with it
+	if e.initTimer != nil {
+		return
+	}
+
+	e.initTimer = time.AfterFunc(e.initDelay, func() {
+		e.initTimerMu.Lock()
+		e.initTimer = nil
+		e.initTimerMu.Unlock()
+
+		e.Initialize()
+	})
 }
 
 func (e *Client) Initialize() {
@@ -157,49 +466,81 @@ func (e *Client) Initialize() {
 	}
 }
 
+// sentInitMessage announces all devices not yet announced with a single init
+// message. The messages are built under the device lock and sent after it is
+// released, only the send order of the devices is held until their remembered
+// values are pushed.
 func (e *Client) sentInitMessage() {
 	log.Debug("Sending Init Message")
 
 	// Only init devices that are not already init
 	var deviceForInit []*Device
-	for i := 0; i < len(e.devices); i++ {
-
-		// Tag required when multiple devices on same connection
-		if e.devices[i].Tag == "" {
-			e.devices[i].Tag = e.devices[i].UniqueID
-		}
-
-		if e.devices[i].InitDone {
+	var initMessages []json.RawMessage
+	var initValues []deviceValues
+	for _, device := range e.devices.snapshot() {
+		device.sendMu.Lock()
+
+		initMessage, values, ok := device.beginInit()
+		if !ok {
+			device.sendMu.Unlock()
 			continue
 		}
 
-		e.devices[i].SetInitDone()
-		deviceForInit = append(deviceForInit, e.devices[i])
-
+		deviceForInit = append(deviceForInit, device)
+		initMessages = append(initMessages, initMessage)
+		initValues = append(initValues, values)
 	}
 
-	if len(deviceForInit) > 1 {
-		// Array of Init Messages
+	if len(deviceForInit) == 0 {
+		return
+	}
 
-		var initMessages []DeviceInitMessage
+	for i, device := range deviceForInit {
+		e.pending.add(device.Tag, "init", initMessages[i])
+	}
 
-		for i := 0; i < len(deviceForInit); i++ {
-			initMessage := DeviceInitMessage{GenericInitMessageHeader{GenericMessageHeader{MessageType: "init"}, "json"}, *deviceForInit[i]}
-			initMessages = append(initMessages, initMessage)
+	var err error
+	if len(initMessages) > 1 {
+		// Array of Init Messages
+		err = e.sendMessage(initMessages)
+	} else {
+		// Only One Init Message
+		err = e.sendMessage(initMessages[0])
+	}
 
+	if err != nil {
+		resetInitDone(deviceForInit)
+	} else {
+		for i, device := range deviceForInit {
+			e.pushInitState(device, initValues[i])
 		}
-		e.sendMessage(initMessages)
+	}
 
+	for _, device := range deviceForInit {
+		device.sendMu.Unlock()
 	}
 
-	if len(deviceForInit) == 1 {
-		// Only One Init Message
-		initMessage := DeviceInitMessage{GenericInitMessageHeader{GenericMessageHeader{MessageType: "init"}, "json"}, *deviceForInit[0]}
-		e.sendMessage(initMessage)
-	} else {
-		log.Warn("Cannot initialize, no devices added")
+	if err != nil {
 		return
 	}
+
+	for _, device := range deviceForInit {
+		e.deviceChanged(device)
+	}
+}
+
+// resetInitDone marks devices as not initialized when the init message could
+// not be sent, so they are announced again with the next init
+func resetInitDone(devices []*Device) {
+	for _, device := range devices {
+		device.resetInit()
+	}
+}
+
+// InjectMessage processes the message as if it was received from the vdcd,
+// e.g. to set a channel value while troubleshooting a backend
+func (e *Client) InjectMessage(message *GenericVDCDMessage) {
+	e.processMessage(message)
 }
 
 func (e *Client) processMessage(message *GenericVDCDMessage) {
@@ -237,50 +578,142 @@ func (e *Client) processMessage(message *GenericVDCDMessage) {
 
 func (e *Client) processStatusMessage(message *GenericVDCDMessage) {
 	log.Debugf("Status Message. Status: %s, Error Message: %s\n", message.Status, message.ErrorMessage)
+
+	statusErr := statusError(message)
+
+	request, found := e.pending.resolve(message.Tag)
+	if !found {
+		if statusErr != nil {
+			log.WithError(statusErr).WithField("Tag", message.Tag).Error("vdcd reported an error")
+		}
+		return
+	}
+
+	device, err := e.GetDeviceByTag(request.tag)
+	if err != nil {
+		log.WithError(err).WithField("Tag", request.tag).Warn("Status for unknown device")
+		return
+	}
+
+	if statusErr == nil {
+		log.WithFields(log.Fields{
+			"Tag":     request.tag,
+			"Request": request.kind,
+		}).Debug("Request confirmed by vdcd")
+		return
+	}
+
+	if request.kind == "init" {
+		device.SetInitFailed(statusErr)
+		e.deviceChanged(device)
+		e.Log(LogError, fmt.Sprintf("Init of device %s (%s) failed: %s", device.Name, device.UniqueID, statusErr))
+	}
+
+	log.WithError(statusErr).WithFields(log.Fields{
+		"Name":     device.Name,
+		"UniqueID": device.UniqueID,
+		"Tag":      request.tag,
+		"Request":  request.kind,
+		"Message":  request.payload,
+	}).Error("vdcd rejected request")
+}
+
+// getDeviceForMessage returns the device a message from the vdcd is addressed to.
+// With multiple devices on the connection the device is identified by the tag.
+func (e *Client) getDeviceForMessage(message *GenericVDCDMessage) (*Device, error) {
+	if message.Tag == "" {
+		if devices := e.devices.snapshot(); len(devices) == 1 {
+			return devices[0], nil
+		}
+	}
+
+	return e.GetDeviceByTag(message.Tag)
 }
 
 func (e *Client) processChannelMessage(message *GenericVDCDMessage) {
 	log.Debugf("Channel Message. Index: %d, ChannelType: %d, ChannelName: %s, Value: %f, Tag: %s\n", message.Index, message.ChannelType, message.ChannelName, message.Value, message.Tag)
 
-	// Multiple Devices available, identify by Tag
-	if len(e.devices) > 1 {
-		device, err := e.GetDeviceByTag(message.Tag)
-
-		if err != nil {
-			log.Warnf("Device not found by Tag %s\n", message.Tag)
-			return
-		}
+	device, err := e.getDeviceForMessage(message)
+	if err != nil {
+		log.Warnf("Device not found by Tag %s\n", message.Tag)
+		return
+	}
 
-		log.Debugf("Device found by Tag for Channel Message: %s\n", device.UniqueID)
+	log.Debugf("Device found by Tag for Channel Message: %s\n", device.UniqueID)
 
-		if device.channel_cb != nil {
-			log.Debugf("Callback for Device %s set, calling it\n", device.UniqueID)
-			device.channel_cb(message, device)
-		}
-	} else {
-		// Only one device
-		if e.devices[0].channel_cb != nil {
-			log.Debugf("Callback for Device %s set, calling it\n", e.devices[0].UniqueID)
-			e.devices[0].channel_cb(message, e.devices[0])
-		}
+	if cb := device.messageCallback("channel"); cb != nil {
+		log.Debugf("Callback for Device %s set, calling it\n", device.UniqueID)
+		cb(message, device)
 	}
 
+	e.deviceChanged(device)
+
 }
 
 func (e *Client) processMoveMessage(message *GenericVDCDMessage) {
 	log.Debugf("Move Message. Index: %d, Direction: %d, Tag: %s\n", message.Index, message.Direction, message.Tag)
+
+	device, err := e.getDeviceForMessage(message)
+	if err != nil {
+		log.Warnf("Device not found by Tag %s\n", message.Tag)
+		return
+	}
+
+	if cb := device.messageCallback("move"); cb != nil {
+		log.Debugf("Move Callback for Device %s set, calling it\n", device.UniqueID)
+		cb(message, device)
+	}
 }
 
 func (e *Client) processControlMessage(message *GenericVDCDMessage) {
 	log.Debugf("Control Message. Name: %s, Value: %f, Tag: %s\n", message.Name, message.Value, message.Tag)
+
+	device, err := e.getDeviceForMessage(message)
+	if err != nil {
+		log.Warnf("Device not found by Tag %s\n", message.Tag)
+		return
+	}
+
+	if cb := device.messageCallback("control"); cb != nil {
+		log.Debugf("Control Callback for Device %s set, calling it\n", device.UniqueID)
+		cb(message, device)
+	}
 }
 
 func (e *Client) processSyncMessage(message *GenericVDCDMessage) {
 	log.Debugf("Sync Message. Tag: %s\n", message.Tag)
+
+	device, err := e.getDeviceForMessage(message)
+	if err != nil {
+		log.Warnf("Device not found by Tag %s\n", message.Tag)
+		return
+	}
+
+	// Reading back the state may block on the backend, do not stall the receive loop
+	go func() {
+		if cb := device.messageCallback("sync"); cb != nil {
+			log.Debugf("Sync Callback for Device %s set, calling it\n", device.UniqueID)
+			cb(message, device)
+		}
+
+		e.pushDeviceState(device)
+		e.sendSyncedMessage(device.Tag)
+	}()
 }
 
 func (e *Client) processSceneCommandMessage(message *GenericVDCDMessage) {
 	log.Debugf("Scene Command Message. Cmd: %s Tag: %s\n", message.Cmd, message.Tag)
+
+	device, err := e.getDeviceForMessage(message)
+	if err != nil {
+		log.Warnf("Device not found by Tag %s\n", message.Tag)
+		return
+	}
+
+	if cb := device.messageCallback("scenecommand"); cb != nil {
+		log.Debugf("Scene Command Callback for Device %s set, calling it\n", device.UniqueID)
+		cb(message, device)
+	}
 }
 
 func (e *Client) processSetConfigurationMessage(message *GenericVDCDMessage) {
@@ -288,14 +721,49 @@ func (e *Client) processSetConfigurationMessage(message *GenericVDCDMessage) {
 }
 
 func (e *Client) processInvokeActionMessage(message *GenericVDCDMessage) {
-	log.Debugf("Invoke Action Message. Params: %v Tag: %s\n", message.Params, message.Tag)
+	log.Debugf("Invoke Action Message. Action: %s Params: %v Tag: %s\n", message.Action, message.Params, message.Tag)
+
+	device, err := e.getDeviceForMessage(message)
+	if err != nil {
+		log.Warnf("Device not found by Tag %s\n", message.Tag)
+		return
+	}
+
+	// Actions talk to the backend and may take a while, do not stall the receive loop
+	go func() {
+		err := device.InvokeAction(message.Action, message.Params)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"UniqueID": device.UniqueID,
+				"Action":   message.Action,
+			}).Error("Action failed")
+		}
+
+		if !device.NoConfirmaction {
+			e.sendConfirmActionMessage(device.Tag, err)
+		}
+	}()
 }
 
 func (e *Client) processSetPropertyMessage(message *GenericVDCDMessage) {
-	log.Debugf("Set Property Message. Property: %v Value: %f Tag: %s", message.Properties, message.Value, message.Tag)
+	var setProperty SetPropertyMessage
+	if err := json.Unmarshal(message.raw, &setProperty); err != nil {
+		log.WithError(err).Error("Json Unmarshal of Set Property Message failed")
+		return
+	}
+
+	log.Debugf("Set Property Message. Property: %s Value: %v Tag: %s\n", setProperty.PropertyName, setProperty.Value, message.Tag)
+
+	device, err := e.getDeviceForMessage(message)
+	if err != nil {
+		log.Warnf("Device not found by Tag %s\n", message.Tag)
+		return
+	}
+
+	go device.applyProperty(setProperty.PropertyName, setProperty.Value)
 }
 
-func (e *Client) sendMessage(message interface{}) {
+func (e *Client) sendMessage(message interface{}) error {
 
 	payload, err := json.Marshal(message)
 
@@ -303,12 +771,20 @@ func (e *Client) sendMessage(message interface{}) {
 
 	if err != nil {
 		log.WithError(err).Error("Failed to Marshall object")
-		return
+		return err
 	}
 
 	//log.Println("Sending Message: " + string(payload))
 
 	e.mu.Lock()
+	if !e.connected || e.w == nil {
+		// Not connected, drop the message. The current state of all
+		// devices is pushed again when the session is resumed.
+		e.mu.Unlock()
+		log.WithField("Message", string(payload)).Warn("Not connected to vdcd, dropping message")
+		return ErrNotConnected
+	}
+
 	_, err = e.w.WriteString(string(payload))
 
 	if err == nil {
@@ -322,9 +798,12 @@ func (e *Client) sendMessage(message interface{}) {
 
 	if err != nil {
 		log.WithError(err).Error("Send Message failed")
-		return
+		return err
 	}
 
+	e.recorder.record(DirectionOut, payload)
+
+	return nil
 }
 
 func (e *Client) sendByeMessage() {
@@ -332,10 +811,85 @@ func (e *Client) sendByeMessage() {
 
 	byeMessage := GenericDeviceMessage{GenericMessageHeader: GenericMessageHeader{MessageType: "bye"}}
 
-	e.sendMessage(byeMessage)
+	if err := e.sendMessage(byeMessage); err != nil {
+		log.WithError(err).Debug("Failed to send Bye Message")
+	}
+}
+
+// sendDeviceByeMessage disconnects a single device from the vdcd
+func (e *Client) sendDeviceByeMessage(tag string) {
+	byeMessage := GenericTaggedMessage{GenericMessageHeader{MessageType: "bye"}, tag}
+
+	log.Debugf("Send Bye Message for Tag: %s\n", tag)
+	if err := e.sendMessage(byeMessage); err != nil {
+		log.WithError(err).WithField("Tag", tag).Warn("Failed to send Bye Message")
+	}
+}
+
+// sendInitVdcMessage announces the bridge itself as vdc to the vdcd
+func (e *Client) sendInitVdcMessage() {
+	if e.dryMode {
+		return
+	}
+
+	initvdcMessage := InitvdcMessage{
+		GenericMessageHeader: GenericMessageHeader{MessageType: "initvdc"},
+		ModelName:            e.modelName,
+		IconName:             e.vdcIconName,
+		ConfigUrl:            e.vdcConfigURL,
+		Name:                 e.vendorName,
+	}
+
+	log.Debugf("Send Initvdc Message. Model: %s, Icon: %s, Config URL: %s\n", e.modelName, e.vdcIconName, e.vdcConfigURL)
+	if err := e.sendMessage(initvdcMessage); err != nil {
+		log.WithError(err).Warn("Failed to send Initvdc Message")
+	}
+}
+
+// Log writes a message into the vdcd log. Log is meant for events of
+// interest for the dS installer, e.g. a backend is not reachable anymore.
+func (e *Client) Log(level LogLevel, text string) {
+	// Nowhere to log to, the message is in the bridge log anyway
+	if !e.IsConnected() {
+		return
+	}
+
+	logMessage := LogMessage{GenericMessageHeader{MessageType: "log"}, level, text}
+
+	if err := e.sendMessage(logMessage); err != nil {
+		log.WithError(err).Debug("Failed to send Log Message")
+	}
 }
 
-func (e *Client) sendChannelMessage(value float32, tag string, channelName string, channelType ChannelTypeType) {
+// sendSyncedMessage confirms a sync request after all channels have been pushed
+func (e *Client) sendSyncedMessage(tag string) {
+	syncedMessage := GenericTaggedMessage{GenericMessageHeader{MessageType: "synced"}, tag}
+
+	log.Debugf("Send Synced Message for Tag: %s\n", tag)
+	if err := e.sendMessage(syncedMessage); err != nil {
+		log.WithError(err).WithField("Tag", tag).Warn("Failed to send Synced Message")
+	}
+}
+
+// sendConfirmActionMessage reports the result of an invoked action to the vdcd
+func (e *Client) sendConfirmActionMessage(tag string, actionErr error) {
+	confirmMessage := ConfirmActionMessage{GenericMessageHeader: GenericMessageHeader{MessageType: "confirmAction"}, Tag: tag}
+
+	if actionErr != nil {
+		confirmMessage.ErrorCode = 500
+		if errors.Is(actionErr, ErrActionNotFound) {
+			confirmMessage.ErrorCode = 404
+		}
+		confirmMessage.ErrorText = actionErr.Error()
+	}
+
+	log.Debugf("Send Confirm Action Message for Tag: %s\n", tag)
+	if err := e.sendMessage(confirmMessage); err != nil {
+		log.WithError(err).WithField("Tag", tag).Warn("Failed to send Confirm Action Message")
+	}
+}
+
+func (e *Client) sendChannelMessage(value float32, tag string, channelName string, channelType ChannelTypeType) error {
 	channelMessageHeader := GenericMessageHeader{MessageType: "channel"}
 	channelMessageFields := GenericDeviceMessageFields{Tag: tag, ChannelName: channelName, Value: value, ChannelType: channelType}
 	channelMessage := GenericDeviceMessage{channelMessageHeader, channelMessageFields}
@@ -343,14 +897,14 @@ func (e *Client) sendChannelMessage(value float32, tag string, channelName strin
 	payload, err := json.Marshal(channelMessage)
 	if err != nil {
 		log.WithError(err).Error("Failed to Marshall object")
-		return
+		return err
 	}
 
 	log.Debugf("Send Channel Message: %s\n", string(payload))
-	e.sendMessage(channelMessage)
+	return e.sendMessage(channelMessage)
 }
 
-func (e *Client) SendSensorMessage(value float32, tag string, channelName string, index int) {
+func (e *Client) SendSensorMessage(value float32, tag string, channelName string, index int) error {
 	channelMessageHeader := GenericMessageHeader{MessageType: "sensor"}
 	channelMessageFields := GenericDeviceMessageFields{Index: index, Tag: tag, ChannelName: channelName, Value: value}
 	channelMessage := GenericDeviceMessage{channelMessageHeader, channelMessageFields}
@@ -358,14 +912,29 @@ func (e *Client) SendSensorMessage(value float32, tag string, channelName string
 	payload, err := json.Marshal(channelMessage)
 	if err != nil {
 		log.WithError(err).Error("Failed to Marshall object")
-		return
+		return err
 	}
 
 	log.Debugf("Send Sensor Message: %s\n", string(payload))
-	e.sendMessage(channelMessage)
+	return e.sendMessage(channelMessage)
 }
 
-func (e *Client) SendButtonMessage(value float32, tag string, index int) {
+func (e *Client) SendInputMessage(value float32, tag string, inputId string, index int) error {
+	inputMessageHeader := GenericMessageHeader{MessageType: "input"}
+	inputMessageFields := GenericDeviceMessageFields{Index: index, Tag: tag, ChannelName: inputId, Value: value}
+	inputMessage := GenericDeviceMessage{inputMessageHeader, inputMessageFields}
+
+	payload, err := json.Marshal(inputMessage)
+	if err != nil {
+		log.WithError(err).Error("Failed to Marshall object")
+		return err
+	}
+
+	log.Debugf("Send Input Message: %s\n", string(payload))
+	return e.sendMessage(inputMessage)
+}
+
+func (e *Client) SendButtonMessage(value float32, tag string, index int) error {
 	channelMessageHeader := GenericMessageHeader{MessageType: "button"}
 	channelMessageFields := GenericDeviceMessageFields{Index: index, Tag: tag, Value: value}
 	channelMessage := GenericDeviceMessage{channelMessageHeader, channelMessageFields}
@@ -373,77 +942,85 @@ func (e *Client) SendButtonMessage(value float32, tag string, index int) {
 	payload, err := json.Marshal(channelMessage)
 	if err != nil {
 		log.WithError(err).Error("Failed to Marshall object")
-		return
+		return err
 	}
 
 	log.Debugf("Send Button Message: %s\n", string(payload))
-	e.sendMessage(channelMessage)
+	return e.sendMessage(channelMessage)
+}
+
+// SendPushNotification sends state changes and events of a single device
+func (e *Client) SendPushNotification(tag string, stateChange map[string]interface{}, events []string) error {
+	pushMessage := PushNotificationMessage{GenericMessageHeader{MessageType: "pushNotification"}, tag, stateChange, events}
+
+	log.Debugf("Send Push Notification for Tag: %s, States: %v, Events: %v\n", tag, stateChange, events)
+	return e.sendMessage(pushMessage)
+}
+
+// SendUpdatePropertyMessage sends the new value of a single device property
+func (e *Client) SendUpdatePropertyMessage(tag string, name string, value interface{}) error {
+	updateMessage := UpdatePropertyMessage{GenericMessageHeader{MessageType: "updateProperty"}, tag, name, value, true}
 
+	log.Debugf("Send Update Property Message for Tag: %s, Property: %s, Value: %v\n", tag, name, value)
+	return e.sendMessage(updateMessage)
 }
 
+// GetDeviceByUniqueId returns the device with the given uniqueid. Devices
+// restored from the store are not returned until their backend announced them.
 func (e *Client) GetDeviceByUniqueId(uniqueid string) (*Device, error) {
-	for i := 0; i < len(e.devices); i++ {
-		if e.devices[i].UniqueID == uniqueid {
-			return e.devices[i], nil
-		}
+	if device, ok := e.devices.getByUniqueID(uniqueid); ok && !device.restored {
+		return device, nil
 	}
 
-	return nil, errors.New(("Device not found"))
+	return nil, ErrDeviceNotFound
 }
 
 func (e *Client) GetDeviceByUniqueIdAndSubDeviceIndex(uniqueid string, subDeviceIndex int) (*Device, error) {
-	for i := 0; i < len(e.devices); i++ {
-		if e.devices[i].UniqueID == uniqueid && e.devices[i].SubDeviceIndex == fmt.Sprintf("%d", subDeviceIndex) {
-			return e.devices[i], nil
-		}
+	if device, ok := e.devices.getByKey(uniqueid, fmt.Sprintf("%d", subDeviceIndex)); ok && !device.restored {
+		return device, nil
 	}
 
-	return nil, errors.New(("Device not found"))
+	return nil, ErrDeviceNotFound
 }
 
 func (e *Client) GetDeviceByTag(tag string) (*Device, error) {
-	for i := 0; i < len(e.devices); i++ {
-		if e.devices[i].Tag == tag {
-			return e.devices[i], nil
-		}
+	if device, ok := e.devices.getByTag(tag); ok {
+		return device, nil
 	}
 
-	return nil, errors.New(("Device not found"))
+	return nil, ErrDeviceNotFound
 }
 
-// func (e *Client) getDeviceIndex(device Device) (*int, error) {
-// 	for i := 0; i < len(e.devices); i++ {
-// 		if e.devices[i].UniqueID == device.UniqueID {
-// 			return &i, nil
-// 		}
-// 	}
-
-// 	return nil, errors.New(("Device not found"))
-// }
+// GetDevices returns all added devices
+func (e *Client) GetDevices() []*Device {
+	return e.devices.snapshot()
+}
 
 // Send a channel message to the vdcd for the given ChannelName and ChannelType
 func (e *Client) UpdateValue(device *Device, channelName string, channelType ChannelTypeType) {
 
-	value, err := device.GetValue(channelName)
+	// Make sure init is Done for the device, the value is pushed with the init otherwise
+	err := device.sendIfInitialized(func() error {
+		// the latest value, a newer update may have been sent already
+		value, err := device.GetValue(channelName)
+		if err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"Name":        device.Name,
+			"UniqueID":    device.UniqueID,
+			"Channelname": channelName,
+			"Channeltype": channelType,
+		}).Infof("Update value to %f", value)
 
+		return e.sendChannelMessage(value, device.Tag, channelName, channelType)
+	})
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"UniqueID":    device.UniqueID,
 			"ChannelName": channelName,
-		}).Error("Value not found\n")
-	}
-
-	log.WithFields(log.Fields{
-		"Name":        device.Name,
-		"UniqueID":    device.UniqueID,
-		"Channelname": channelName,
-		"Channeltype": channelType,
-		"InitDone":    device.InitDone,
-	}).Infof("Update value to %f", value)
-
-	// Make sure init is Done for the device
-	if device.InitDone {
-		e.sendChannelMessage(value, device.Tag, channelName, channelType)
+		}).Warn("Failed to send channel value")
 	}
 
 }
@@ -0,0 +1,450 @@
+package vdcdapi_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi/vdcdtest"
+)
+
+// recording is a concurrency safe recorder for the messages exchanged with the vdcd
+type recording struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (r *recording) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(p)
+}
+
+// sent returns the messages sent to the vdcd, an array of messages is kept as one
+func (r *recording) sent(t *testing.T) []json.RawMessage {
+	t.Helper()
+
+	r.mu.Lock()
+	messages, err := vdcdapi.ReadRecording(bytes.NewReader(r.buf.Bytes()))
+	r.mu.Unlock()
+	if err != nil {
+		t.Fatalf("invalid recording: %s", err)
+	}
+
+	var sent []json.RawMessage
+	for _, message := range messages {
+		if message.Direction == vdcdapi.DirectionOut {
+			sent = append(sent, message.Message)
+		}
+	}
+	return sent
+}
+
+// startClient connects a client to the vdcd and processes its messages until the test ends
+func startClient(t *testing.T, vdcd *vdcdtest.Server, initDelay time.Duration) *vdcdapi.Client {
+	t.Helper()
+
+	client := new(vdcdapi.Client)
+	client.NewCient(vdcd.Host(), vdcd.Port(), "test", "test", false)
+	client.SetInitDelay(initDelay)
+	client.SetBackoff(vdcdapi.Backoff{InitialInterval: 10 * time.Millisecond, MaxInterval: 50 * time.Millisecond, Multiplier: 2})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := client.Connect(ctx); err != nil {
+		cancel()
+		t.Fatalf("connect failed: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := client.ListenWithContext(ctx); err != nil {
+			t.Errorf("listen failed: %s", err)
+		}
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return client
+}
+
+func newLight(client *vdcdapi.Client, uniqueID string) *vdcdapi.Device {
+	device := new(vdcdapi.Device)
+	device.NewLightDevice(client, uniqueID, true)
+	device.SetName(uniqueID)
+	return device
+}
+
+// eventually waits until the condition holds
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(vdcdtest.DefaultTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestInitBatchesDevicesAddedWithinTheInitDelay(t *testing.T) {
+	vdcd := vdcdtest.NewServer(t)
+	client := startClient(t, vdcd, 100*time.Millisecond)
+
+	recorded := new(recording)
+	client.SetRecorder(recorded)
+
+	first := newLight(client, "light-1")
+	second := newLight(client, "light-2")
+	third := newLight(client, "light-3")
+
+	// a value known before the init is pushed right after it
+	first.SetValue(42, "brightness")
+
+	for _, device := range []*vdcdapi.Device{first, second, third} {
+		if !client.AddDevice(device) {
+			t.Fatalf("device %s not added", device.UniqueID)
+		}
+	}
+
+	for _, device := range []*vdcdapi.Device{first, second, third} {
+		vdcd.AssertInit(t, device.UniqueID)
+	}
+	vdcd.AssertChannel(t, "light-1", "brightness", 42)
+
+	var batches int
+	for _, message := range recorded.sent(t) {
+		var inits []json.RawMessage
+		if json.Unmarshal(message, &inits) == nil {
+			batches++
+			if len(inits) != 3 {
+				t.Errorf("expected the 3 devices in one init message, got %d", len(inits))
+			}
+		}
+	}
+	if batches != 1 {
+		t.Errorf("expected a single init message array, got %d", batches)
+	}
+
+	// a device added again is not announced twice
+	if client.AddDevice(newLight(client, "light-1")) {
+		t.Error("device with a known uniqueid added again")
+	}
+
+	eventually(t, "init confirmed", first.InitDone)
+}
+
+func TestReconnectReannouncesDevices(t *testing.T) {
+	vdcd := vdcdtest.NewServer(t)
+	client := startClient(t, vdcd, 0)
+
+	device := newLight(client, "light-1")
+	client.AddDevice(device)
+	vdcd.AssertInit(t, "light-1")
+
+	device.UpdateValue(70, "brightness", vdcdapi.BrightnessType)
+	vdcd.AssertChannel(t, "light-1", "brightness", 70)
+
+	vdcd.Reset()
+	vdcd.Disconnect()
+
+	if !vdcd.WaitConnected(vdcdtest.DefaultTimeout) {
+		t.Fatal("client did not reconnect")
+	}
+
+	// the vdc, then the device and its last value are announced again
+	vdcd.AssertMessage(t, "initvdc", "")
+	vdcd.AssertInit(t, "light-1")
+	vdcd.AssertChannel(t, "light-1", "brightness", 70)
+
+	eventually(t, "init after reconnect", device.InitDone)
+}
+
+func TestRejectedInitIsRoutedToTheDevice(t *testing.T) {
+	vdcd := vdcdtest.NewServer(t)
+	vdcd.SetInitStatus(func(device *vdcdapi.Device) string {
+		if device.UniqueID == "rejected" {
+			return "invalid device"
+		}
+		return ""
+	})
+	client := startClient(t, vdcd, 50*time.Millisecond)
+
+	rejected := newLight(client, "rejected")
+	accepted := newLight(client, "accepted")
+	client.AddDevice(rejected)
+	client.AddDevice(accepted)
+
+	vdcd.AssertInit(t, "rejected")
+	vdcd.AssertInit(t, "accepted")
+
+	eventually(t, "init of the rejected device failed", func() bool {
+		failed, _ := rejected.InitFailed()
+		return failed
+	})
+
+	_, err := rejected.InitFailed()
+	var protocolErr *vdcdapi.ProtocolError
+	if !errors.As(err, &protocolErr) || protocolErr.Message != "invalid device" {
+		t.Errorf("expected the status error of the vdcd, got %v", err)
+	}
+	if rejected.InitDone() {
+		t.Error("rejected device is initialized")
+	}
+
+	if failed, err := accepted.InitFailed(); failed {
+		t.Errorf("init of the accepted device failed: %v", err)
+	}
+	if !accepted.InitDone() {
+		t.Error("accepted device is not initialized")
+	}
+
+	// values of a rejected device are not sent
+	vdcd.Reset()
+	rejected.UpdateValue(10, "brightness", vdcdapi.BrightnessType)
+	vdcd.AssertNoMessage(t, "channel", "rejected", 100*time.Millisecond)
+}
+
+func TestMessagesAreDispatchedToTheDeviceCallbacks(t *testing.T) {
+	vdcd := vdcdtest.NewServer(t)
+	client := startClient(t, vdcd, 0)
+
+	device := newLight(client, "light-1")
+	device.Move = true
+	device.Sync = true
+	device.SceneCommands = true
+
+	channels := make(chan *vdcdapi.GenericVDCDMessage, 1)
+	moves := make(chan *vdcdapi.GenericVDCDMessage, 1)
+	scenes := make(chan *vdcdapi.GenericVDCDMessage, 1)
+
+	device.SetChannelMessageCB(func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		device.SetValue(message.Value, message.ChannelName)
+		channels <- message
+	})
+	device.SetMoveMessageCB(func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		moves <- message
+	})
+	device.SetSyncMessageCB(func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		// the live state read back from the backend
+		device.SetValue(55, "brightness")
+	})
+	device.SetSceneCommandCB(func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		scenes <- message
+	})
+
+	client.AddDevice(device)
+	vdcd.AssertInit(t, "light-1")
+
+	if err := vdcd.SendChannel("light-1", "brightness", 30); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-channels:
+		if message.ChannelName != "brightness" || message.Value != 30 {
+			t.Errorf("unexpected channel message %+v", message)
+		}
+	case <-time.After(vdcdtest.DefaultTimeout):
+		t.Fatal("channel callback not called")
+	}
+	if value, _ := device.GetValue("brightness"); value != 30 {
+		t.Errorf("expected brightness 30, got %v", value)
+	}
+
+	if err := vdcd.SendMove("light-1", 1, -1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-moves:
+		if message.Direction != -1 || message.Index != 1 {
+			t.Errorf("unexpected move message %+v", message)
+		}
+	case <-time.After(vdcdtest.DefaultTimeout):
+		t.Fatal("move callback not called")
+	}
+
+	if err := vdcd.SendSceneCommand("light-1", "MAX"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-scenes:
+		if message.Cmd != "MAX" {
+			t.Errorf("unexpected scene command %+v", message)
+		}
+	case <-time.After(vdcdtest.DefaultTimeout):
+		t.Fatal("scene command callback not called")
+	}
+
+	// a sync pushes the channels read back from the backend, then confirms
+	vdcd.Reset()
+	if err := vdcd.SendSync("light-1"); err != nil {
+		t.Fatal(err)
+	}
+	vdcd.AssertChannel(t, "light-1", "brightness", 55)
+	vdcd.AssertMessage(t, "synced", "light-1")
+
+	channelIndex, syncedIndex := -1, -1
+	for i, message := range vdcd.Messages() {
+		switch {
+		case message.MessageType == "channel" && message.ID == "brightness" && channelIndex < 0:
+			channelIndex = i
+		case message.MessageType == "synced":
+			syncedIndex = i
+		}
+	}
+	if syncedIndex < channelIndex {
+		t.Error("synced sent before the channel values")
+	}
+}
+
+func TestSetPropertyCallsThePropertyHandler(t *testing.T) {
+	vdcd := vdcdtest.NewServer(t)
+	client := startClient(t, vdcd, 0)
+
+	device := newLight(client, "light-1")
+	device.AddProperty("mode", vdcdapi.Property{Type: "string"})
+
+	applied := make(chan interface{}, 1)
+	device.SetPropertyHandler(func(device *vdcdapi.Device, name string, value interface{}) error {
+		if name != "mode" {
+			return errors.New("unknown property")
+		}
+		applied <- value
+		return nil
+	})
+
+	client.AddDevice(device)
+	vdcd.AssertInit(t, "light-1")
+
+	if err := vdcd.Send(map[string]interface{}{"message": "setProperty", "tag": "light-1", "propertyname": "mode", "value": "eco"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case value := <-applied:
+		if value != "eco" {
+			t.Errorf("expected property value eco, got %v", value)
+		}
+	case <-time.After(vdcdtest.DefaultTimeout):
+		t.Fatal("property handler not called")
+	}
+
+	eventually(t, "property value remembered", func() bool {
+		value, ok := device.GetProperty("mode")
+		return ok && value == "eco"
+	})
+
+	// a value changed by the backend is sent to the vdcd
+	if err := device.SetProperty("mode", "comfort"); err != nil {
+		t.Fatal(err)
+	}
+	message, ok := vdcd.WaitFor(vdcdtest.DefaultTimeout, func(message vdcdtest.Message) bool {
+		return message.MessageType == "updateProperty" && message.Tag == "light-1"
+	})
+	if !ok {
+		t.Fatal("property update not sent")
+	}
+
+	var update vdcdapi.UpdatePropertyMessage
+	if err := json.Unmarshal(message.Raw, &update); err != nil {
+		t.Fatal(err)
+	}
+	if update.Value != "comfort" {
+		t.Errorf("expected property value comfort, got %v", update.Value)
+	}
+}
+
+func TestValuesDoNotOvertakeTheInit(t *testing.T) {
+	vdcd := vdcdtest.NewServer(t)
+	client := startClient(t, vdcd, 0)
+
+	device := newLight(client, "light-1")
+	device.AddSensor(vdcdapi.Sensor{Id: "temperature", SensorType: vdcdapi.TemperatureSensor})
+	device.AddState("operation", vdcdapi.State{Type: "boolean"})
+
+	// the backend reports values while the device is announced
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			for value := 1; value <= 20; value++ {
+				device.UpdateValue(float32(value*i%100), "brightness", vdcdapi.BrightnessType)
+				device.UpdateSensorValue(float32(value), "temperature")
+				_ = device.PushState("operation", value%2 == 0)
+				_ = device.Snapshot()
+			}
+		}(i)
+	}
+
+	close(start)
+	client.AddDevice(device)
+	wg.Wait()
+
+	vdcd.AssertInit(t, "light-1")
+	device.UpdateValue(99, "brightness", vdcdapi.BrightnessType)
+	vdcd.AssertChannel(t, "light-1", "brightness", 99)
+
+	for _, message := range vdcd.Messages() {
+		if message.Tag != "light-1" {
+			continue
+		}
+		if message.MessageType != "init" {
+			t.Fatalf("%s sent before the init: %s", message.MessageType, string(message.Raw))
+		}
+		break
+	}
+}
+
+func TestSyncPushesOnlyValuesReportedByTheBackend(t *testing.T) {
+	vdcd := vdcdtest.NewServer(t)
+	client := startClient(t, vdcd, 0)
+
+	device := newLight(client, "light-1")
+	device.AddInput(vdcdapi.Input{Id: "contact"})
+	device.AddInput(vdcdapi.Input{Id: "tamper"})
+	device.SetSyncMessageCB(func(message *vdcdapi.GenericVDCDMessage, device *vdcdapi.Device) {
+		// the backend only reports the brightness and the contact
+		device.UpdateValue(40, "brightness", vdcdapi.BrightnessType)
+		device.UpdateInputValue(1, "contact")
+	})
+
+	client.AddDevice(device)
+	vdcd.AssertInit(t, "light-1")
+
+	vdcd.Reset()
+	if err := vdcd.SendSync("light-1"); err != nil {
+		t.Fatal(err)
+	}
+	vdcd.AssertMessage(t, "synced", "light-1")
+
+	var channels, inputs []string
+	for _, message := range vdcd.Messages() {
+		switch message.MessageType {
+		case "channel":
+			channels = append(channels, message.ID)
+		case "input":
+			inputs = append(inputs, message.ID)
+		}
+	}
+
+	// pushed with the update and again with the sync
+	if len(channels) != 2 || channels[0] != "brightness" || channels[1] != "brightness" {
+		t.Errorf("expected only the brightness, got channels %v", channels)
+	}
+	if len(inputs) != 2 || inputs[0] != "contact" || inputs[1] != "contact" {
+		t.Errorf("expected only the contact input, got inputs %v", inputs)
+	}
+}
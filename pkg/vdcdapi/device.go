@@ -1,7 +1,9 @@
 package vdcdapi
 
 import (
-	"errors"
+	"encoding/json"
+	"fmt"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -36,6 +38,14 @@ func (e *Device) NewButtonDevice(client *Client, uniqueID string) {
 
 }
 
+// NewInputDevice creates a device without outputs, reporting binary inputs only
+func (e *Device) NewInputDevice(client *Client, uniqueID string) {
+	e.NewDevice(client, uniqueID)
+
+	e.Group = BlackVariableGroup
+	e.ColorClass = BlackColorClassT
+}
+
 func (e *Device) NewLightDevice(client *Client, uniqueID string, dimmable bool) {
 	e.NewBasicSwitchDevice(client, uniqueID)
 
@@ -102,6 +112,105 @@ func (e *Device) NewCTLightDevice(client *Client, uniqueID string) {
 	e.ColorClass = YellowColorClassT
 }
 
+// NewShadowDevice creates a blind or shutter with a position channel (0 = closed, 100 = open)
+// and optionally an angle channel for the slats
+func (e *Device) NewShadowDevice(client *Client, uniqueID string, withAngle bool) {
+	e.NewDevice(client, uniqueID)
+
+	e.Output = ShadowOutput
+	e.EndContacts = true
+	e.Move = true
+
+	positionChannel := new(Channel)
+	positionChannel.ChannelName = "shadePositionOutside"
+	positionChannel.ChannelType = BlindsShadePositionType
+
+	e.AddChannel(*positionChannel)
+
+	if withAngle {
+		angleChannel := new(Channel)
+		angleChannel.ChannelName = "shadeOpeningAngleOutside"
+		angleChannel.ChannelType = BlindShadeAngleType
+
+		e.AddChannel(*angleChannel)
+	}
+
+	e.Group = GreyShadowGroup
+	e.ColorClass = GreyColorClassT
+}
+
+// NewHeatingValveDevice creates a heating valve with a heatingPower channel (0-100%)
+// receiving control values and a sensor for the measured room temperature
+func (e *Device) NewHeatingValveDevice(client *Client, uniqueID string) {
+	e.NewDevice(client, uniqueID)
+
+	e.Output = HeatingValveOutput
+	e.ControlValues = true
+
+	heatingPowerChannel := new(Channel)
+	heatingPowerChannel.ChannelName = "heatingPower"
+	heatingPowerChannel.ChannelType = HeatingPowerType
+
+	e.AddChannel(*heatingPowerChannel)
+
+	temperatureSensor := new(Sensor)
+	temperatureSensor.SensorType = TemperatureSensor
+	temperatureSensor.Usage = RoomSensorUsageType
+	temperatureSensor.Group = int(RoomTemperatureGroup)
+	temperatureSensor.Id = fmt.Sprintf("%s-temperature", uniqueID)
+	temperatureSensor.Resolution = 0.1
+	temperatureSensor.UpdateInterval = 0 // no fixed interval
+
+	e.AddSensor(*temperatureSensor)
+
+	e.Group = BlueHeatingGroup
+	e.ColorClass = BlueColorClassT
+}
+
+// NewVentilationDevice creates a fan or ventilation unit with an airflowIntensity
+// channel (0-100%) and optionally an airflowDirection channel
+// (0 = undefined, 1 = supply, 2 = exhaust)
+func (e *Device) NewVentilationDevice(client *Client, uniqueID string, withDirection bool) {
+	e.NewDevice(client, uniqueID)
+
+	e.Output = VentilationOutput
+
+	intensityChannel := new(Channel)
+	intensityChannel.ChannelName = "airflowIntensity"
+	intensityChannel.ChannelType = AirflowIntesityType
+
+	e.AddChannel(*intensityChannel)
+
+	if withDirection {
+		directionChannel := new(Channel)
+		directionChannel.ChannelName = "airflowDirection"
+		directionChannel.ChannelType = AirflowDirectionType
+
+		e.AddChannel(*directionChannel)
+	}
+
+	e.Group = BlueVentilationGroup
+	e.ColorClass = BlueColorClassT
+}
+
+// NewFanCoilUnitDevice creates a fan coil unit with an airflowIntensity channel
+// (0-100%), receiving the control values of the room temperature controller
+func (e *Device) NewFanCoilUnitDevice(client *Client, uniqueID string) {
+	e.NewDevice(client, uniqueID)
+
+	e.Output = FanCoilUnitOutput
+	e.ControlValues = true
+
+	intensityChannel := new(Channel)
+	intensityChannel.ChannelName = "airflowIntensity"
+	intensityChannel.ChannelType = AirflowIntesityType
+
+	e.AddChannel(*intensityChannel)
+
+	e.Group = BlueHeatingGroup
+	e.ColorClass = BlueColorClassT
+}
+
 func (e *Device) SetName(name string) {
 	e.Name = name
 }
@@ -122,28 +231,50 @@ func (e *Device) AddInput(input Input) {
 	e.Inputs = append(e.Inputs, input)
 }
 
-// Update value from smartdevice to vdcd-bridge Device and send update to dss
+// Update value from smartdevice to vdcd-bridge Device and send update to dss.
+// The value is clamped to the range of the channel, out of range values are flagged.
 func (e *Device) UpdateValue(newValue float32, channelName string, channelType ChannelTypeType) {
 	log.Debugf("Value update from smartdevice to vdcd-bridge Device %s -> send update to dss  Value: %f,  ChannelName: %s\n", e.UniqueID, newValue, channelName)
 
+	e.mu.Lock()
+	changed := false
 	for i := 0; i < len(e.Channels); i++ {
 		if e.Channels[i].ChannelName == channelName {
-			if e.Channels[i].Value != newValue {
-				// only update when changed
-				e.SetValue(newValue, channelName)
-				e.client.UpdateValue(e, channelName, channelType)
-				break
+			value, inRange := e.Channels[i].normalize(newValue)
+			if !inRange {
+				log.WithFields(log.Fields{
+					"UniqueID":    e.UniqueID,
+					"ChannelName": channelName,
+					"Value":       newValue,
+					"Min":         e.Channels[i].Min,
+					"Max":         e.Channels[i].Max,
+					"Unit":        e.Channels[i].Unit,
+				}).Warn("Value from backend out of range, clamped")
 			}
+
+			// only update when changed
+			if e.Channels[i].Value != value {
+				e.setChannelValue(i, value)
+				changed = true
+			}
+			break
 		}
 	}
+	e.mu.Unlock()
 
+	if changed {
+		e.client.UpdateValue(e, channelName, channelType)
+		e.client.deviceChanged(e)
+	}
 }
 
 func (e *Device) ButtonEvent(value float32, id string) {
 
 	for i := 0; i < len(e.Buttons); i++ {
 		if e.Buttons[i].Id == id {
-			e.client.SendButtonMessage(value, e.Tag, i)
+			if err := e.client.SendButtonMessage(value, e.Tag, i); err != nil {
+				log.WithError(err).WithField("UniqueID", e.UniqueID).Warn("Failed to send button event")
+			}
 		}
 	}
 
@@ -151,44 +282,400 @@ func (e *Device) ButtonEvent(value float32, id string) {
 
 func (e *Device) UpdateSensorValue(newValue float32, sensorId string) {
 
+	index := -1
+	e.mu.Lock()
 	for i := 0; i < len(e.Sensors); i++ {
 		if e.Sensors[i].Id == sensorId {
-			e.client.SendSensorMessage(newValue, e.Tag, sensorId, i)
+			// Remember the value, it is pushed with the init and again after a reconnect
+			e.Sensors[i].Value = newValue
+			e.Sensors[i].hasValue = true
+			e.lastUpdate = time.Now()
+			index = i
 			break
 		}
 	}
+	e.mu.Unlock()
+
+	if index < 0 || e.client == nil {
+		return
+	}
+
+	e.client.deviceChanged(e)
+
+	err := e.sendIfInitialized(func() error {
+		// the latest value, a newer update may have been sent already
+		e.mu.Lock()
+		value := e.Sensors[index].Value
+		e.mu.Unlock()
 
+		return e.client.SendSensorMessage(value, e.Tag, sensorId, index)
+	})
+	if err != nil {
+		log.WithError(err).WithField("UniqueID", e.UniqueID).Warn("Failed to send sensor value")
+	}
+}
+
+// HasValue reports whether the backend reported a value for the sensor
+func (s *Sensor) HasValue() bool {
+	return s.hasValue
 }
 
-func (e *Device) SetValue(newValue float32, channelName string) {
+// HasValue reports whether the backend reported a value for the input
+func (i *Input) HasValue() bool {
+	return i.hasValue
+}
+
+// UpdateInputValue sends the new state of a binary input, 1 = active, 0 = inactive
+func (e *Device) UpdateInputValue(newValue float32, inputId string) {
+
+	index := -1
+	e.mu.Lock()
+	for i := 0; i < len(e.Inputs); i++ {
+		if e.Inputs[i].Id == inputId {
+			// only update when changed
+			if e.Inputs[i].hasValue && e.Inputs[i].Value == newValue {
+				break
+			}
+
+			// Remember the value, it is pushed again after a reconnect
+			e.Inputs[i].Value = newValue
+			e.Inputs[i].hasValue = true
+			e.lastUpdate = time.Now()
+			index = i
+			break
+		}
+	}
+	e.mu.Unlock()
+
+	if index < 0 || e.client == nil {
+		return
+	}
+
+	e.client.deviceChanged(e)
+
+	err := e.sendIfInitialized(func() error {
+		// the latest value, a newer update may have been sent already
+		e.mu.Lock()
+		value := e.Inputs[index].Value
+		e.mu.Unlock()
+
+		return e.client.SendInputMessage(value, e.Tag, inputId, index)
+	})
+	if err != nil {
+		log.WithError(err).WithField("UniqueID", e.UniqueID).Warn("Failed to send input value")
+	}
+}
+
+// SetValue sets the value of the channel, clamped to the range and rounded to the
+// resolution of the channel. The value as set is returned.
+func (e *Device) SetValue(newValue float32, channelName string) float32 {
 	log.Debugf("Set value for vdcd-brige Device %s to: %f on ChannelName: %s\n", e.UniqueID, newValue, channelName)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i := 0; i < len(e.Channels); i++ {
+		if e.Channels[i].ChannelName == channelName {
+			newValue, _ = e.Channels[i].normalize(newValue)
+			e.setChannelValue(i, newValue)
+			break
+		}
+	}
+	return newValue
+}
+
+// setChannelValue stores the value of the channel at index, called with mu held
+func (e *Device) setChannelValue(index int, value float32) {
+	e.Channels[index].Value = value
+	e.Channels[index].hasValue = true
+	e.lastUpdate = time.Now()
+}
+
+// SetChannelRange narrows the range of the channel to what the backend
+// supports, e.g. the color temperature range of a light in mired
+func (e *Device) SetChannelRange(channelName string, min float32, max float32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	for i := 0; i < len(e.Channels); i++ {
 		if e.Channels[i].ChannelName == channelName {
-			e.Channels[i].Value = newValue
+			e.Channels[i].Min = min
+			e.Channels[i].Max = max
 			break
 		}
 	}
 }
 
 func (e *Device) GetValue(channelName string) (float32, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	for i := 0; i < len(e.Channels); i++ {
 		if e.Channels[i].ChannelName == channelName {
 			return e.Channels[i].Value, nil
 		}
 	}
 
-	return float32(0), errors.New(("Channel for Device not found"))
+	return float32(0), ErrChannelNotFound
+}
+
+// sendIfInitialized calls send when the device is announced to the vdcd, the
+// value is pushed with the init otherwise. While the init of the device is
+// being sent, it waits for it, so values never overtake the init.
+func (e *Device) sendIfInitialized(send func() error) error {
+	if e.client == nil {
+		return nil
+	}
+
+	e.sendMu.Lock()
+	defer e.sendMu.Unlock()
+
+	if !e.InitDone() {
+		return nil
+	}
+	return send()
+}
+
+// deviceValues is a copy of the values of a device taken under its lock
+type deviceValues struct {
+	channels       []Channel
+	sensors        []Sensor
+	inputs         []Input
+	stateValues    map[string]interface{}
+	propertyValues map[string]interface{}
+}
+
+// values returns a copy of the channel, sensor, input, state and property values
+func (e *Device) values() deviceValues {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.valuesLocked()
+}
+
+// valuesLocked is values, called with mu held
+func (e *Device) valuesLocked() deviceValues {
+	return deviceValues{
+		channels:       append([]Channel(nil), e.Channels...),
+		sensors:        append([]Sensor(nil), e.Sensors...),
+		inputs:         append([]Input(nil), e.Inputs...),
+		stateValues:    copyValues(e.stateValues),
+		propertyValues: copyValues(e.propertyValues),
+	}
+}
+
+// DeviceSnapshot is a consistent copy of the init state and the values of a device
+type DeviceSnapshot struct {
+	InitDone   bool
+	InitFailed bool
+	InitError  error
+	Restored   bool
+	LastUpdate time.Time
+	Channels   []Channel
+	Sensors    []Sensor
+	Inputs     []Input
 }
 
+// Snapshot returns a copy of the init state and the values of the device,
+// taken under the device lock
+func (e *Device) Snapshot() DeviceSnapshot {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return DeviceSnapshot{
+		InitDone:   e.initDone,
+		InitFailed: e.initFailed,
+		InitError:  e.initError,
+		Restored:   e.restored,
+		LastUpdate: e.lastUpdate,
+		Channels:   append([]Channel(nil), e.Channels...),
+		Sensors:    append([]Sensor(nil), e.Sensors...),
+		Inputs:     append([]Input(nil), e.Inputs...),
+	}
+}
+
+// LastUpdate returns the time of the last channel, sensor or input value change
+func (e *Device) LastUpdate() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lastUpdate
+}
+
+// Restored reports whether the device was restored from the store and is not yet announced by its backend
+func (e *Device) Restored() bool {
+	return e.restored
+}
+
+// SetInitDone marks the device as announced to the vdcd
 func (e *Device) SetInitDone() {
-	e.InitDone = true
-	log.Debugf("Init for Device %s done: %t\n", e.UniqueID, e.InitDone)
+	e.mu.Lock()
+	e.initDone = true
+	e.mu.Unlock()
+	log.Debugf("Init for Device %s done\n", e.UniqueID)
+}
+
+// SetInitFailed marks the device as rejected by the vdcd
+func (e *Device) SetInitFailed(err error) {
+	e.mu.Lock()
+	e.initDone = false
+	e.initFailed = true
+	e.initError = err
+	e.mu.Unlock()
+	log.Debugf("Init for Device %s failed: %v\n", e.UniqueID, err)
+}
+
+// resetInit marks the device as not announced, e.g. after the session to the vdcd was lost
+func (e *Device) resetInit() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.initDone = false
+	e.initFailed = false
+	e.initError = nil
+}
+
+// beginInit marks the device as announced unless it already is or the vdcd
+// rejected it. The init message and the values pushed after it are taken in
+// the same step, so they match what the vdcd is told. Called with sendMu held.
+func (e *Device) beginInit() (json.RawMessage, deviceValues, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Do not retry devices the vdcd rejected, until the next session
+	if e.initDone || e.initFailed {
+		return nil, deviceValues{}, false
+	}
+
+	initMessage, err := json.Marshal(DeviceInitMessage{GenericInitMessageHeader{GenericMessageHeader{MessageType: "init"}, "json"}, e})
+	if err != nil {
+		log.WithError(err).WithField("UniqueID", e.UniqueID).Error("Failed to Marshall init message")
+		return nil, deviceValues{}, false
+	}
+
+	e.initDone = true
+	return initMessage, e.valuesLocked(), true
+}
+
+// InitDone reports whether the device is announced to the vdcd
+func (e *Device) InitDone() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.initDone
+}
+
+// InitFailed reports whether the vdcd rejected the device and why
+func (e *Device) InitFailed() (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.initFailed, e.initError
 }
 
 func (e *Device) SetChannelMessageCB(cb func(message *GenericVDCDMessage, device *Device)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.channel_cb = cb
 }
 
+// SetMoveMessageCB registers the callback for "move" messages. The direction
+// of the message is 1 (increase), -1 (decrease) or 0 (stop moving).
+// Only devices initialized with Move set receive move messages.
+func (e *Device) SetMoveMessageCB(cb func(message *GenericVDCDMessage, device *Device)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.move_cb = cb
+}
+
+// SetSyncMessageCB registers the callback for "sync" messages. The callback
+// reads back the live state from the backend and updates the channel values,
+// afterwards all channels are pushed to the vdcd and the sync is confirmed.
+// Only devices initialized with Sync set receive sync messages.
+func (e *Device) SetSyncMessageCB(cb func(message *GenericVDCDMessage, device *Device)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sync_cb = cb
+}
+
+// SetSceneCommandCB registers the callback for "scenecommand" messages, the
+// command name (OFF, ON, MIN, MAX, INC, DEC, STOP, SLOW_OFF, ...) is in message.Cmd.
+// Only devices initialized with SceneCommands set receive scene commands.
+func (e *Device) SetSceneCommandCB(cb func(message *GenericVDCDMessage, device *Device)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.scene_cb = cb
+}
+
+// SetControlMessageCB registers the callback for "control" messages, e.g. the
+// "heatingLevel" (-100 to 100%) of the room temperature controller in message.Value.
+// Only devices initialized with ControlValues set receive control values.
+func (e *Device) SetControlMessageCB(cb func(message *GenericVDCDMessage, device *Device)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.control_cb = cb
+}
+
+// messageCallback returns the callback registered for the message type, nil if none
+func (e *Device) messageCallback(messageType string) func(message *GenericVDCDMessage, device *Device) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch messageType {
+	case "channel":
+		return e.channel_cb
+	case "move":
+		return e.move_cb
+	case "sync":
+		return e.sync_cb
+	case "scenecommand":
+		return e.scene_cb
+	case "control":
+		return e.control_cb
+	}
+	return nil
+}
+
+// SetRemoveCB registers the callback called after the device has been removed
+// from the client, e.g. to unsubscribe the MQTT topics of the device.
+func (e *Device) SetRemoveCB(cb func(device *Device)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.remove_cb = cb
+}
+
+// clearCallbacks unregisters all callbacks, a removed device gets no more
+// messages. The remove callback is returned to be called once.
+func (e *Device) clearCallbacks() func(device *Device) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.channel_cb = nil
+	e.move_cb = nil
+	e.sync_cb = nil
+	e.scene_cb = nil
+	e.control_cb = nil
+	remove_cb := e.remove_cb
+	e.remove_cb = nil
+	e.action_cbs = nil
+	e.property_cb = nil
+
+	return remove_cb
+}
+
+// SetSceneMapping maps a scene command to a backend specific scene or preset
+func (e *Device) SetSceneMapping(cmd string, target string) {
+	if e.SceneMappings == nil {
+		e.SceneMappings = make(map[string]string)
+	}
+	e.SceneMappings[cmd] = target
+}
+
+// GetSceneMapping returns the backend scene or preset mapped to the scene command
+func (e *Device) GetSceneMapping(cmd string) (string, bool) {
+	target, ok := e.SceneMappings[cmd]
+	return target, ok
+}
+
+// AddChannel adds the channel, without a range the range of the channel type is used
 func (e *Device) AddChannel(channel Channel) {
+	channel.applyDefaultRange()
 	e.Channels = append(e.Channels, channel)
 }
@@ -0,0 +1,47 @@
+package vdcdapi
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotConnected is returned when a message is sent while no session to the vdcd is established
+	ErrNotConnected = errors.New("not connected to vdcd")
+
+	// ErrDeviceNotFound is returned by the device lookups when no device matches
+	ErrDeviceNotFound = errors.New("device not found")
+
+	// ErrChannelNotFound is returned when a device has no channel with the given name
+	ErrChannelNotFound = errors.New("channel for device not found")
+
+	// ErrActionNotFound is returned when an invoked action has no handler registered
+	ErrActionNotFound = errors.New("action for device not found")
+)
+
+// ProtocolError is an error reported by the vdcd with a "status" message
+type ProtocolError struct {
+	Code    int
+	Domain  string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Domain != "" {
+		return fmt.Sprintf("vdcd error %d (%s): %s", e.Code, e.Domain, e.Message)
+	}
+	return fmt.Sprintf("vdcd error %d: %s", e.Code, e.Message)
+}
+
+// statusError returns a ProtocolError for a status message reporting an error, nil otherwise
+func statusError(message *GenericVDCDMessage) error {
+	if message.Status == "ok" || (message.Status == "" && message.ErrorCode == 0) {
+		return nil
+	}
+
+	return &ProtocolError{
+		Code:    message.ErrorCode,
+		Domain:  message.ErrorDomain,
+		Message: message.ErrorMessage,
+	}
+}
@@ -0,0 +1,217 @@
+package vdcdapi
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SwitchOutput forces a dimmable or color light to a switch-only device
+const SwitchOutput OutputType = "switch"
+
+// DeviceOverride changes what a backend announces for the matching devices.
+// A device matches by uniqueid, by a glob on uniqueid or name, or by backend
+// and source id, all given match criteria must match.
+type DeviceOverride struct {
+	UniqueID string `json:"uniqueid,omitempty"`
+	Match    string `json:"match,omitempty"`
+	Backend  string `json:"backend,omitempty"`
+	SourceID string `json:"source,omitempty"`
+
+	Name       string         `json:"name,omitempty"`
+	Group      GroupType      `json:"group,omitempty"`
+	ColorClass ColorClassType `json:"colorclass,omitempty"`
+	Output     OutputType     `json:"output,omitempty"`
+	IconName   string         `json:"iconname,omitempty"`
+	Ignore     bool           `json:"ignore,omitempty"`
+}
+
+// dS groups by name, e.g. "joker" for the black group
+var groupNames = map[string]GroupType{
+	"light":       YellowLightGroup,
+	"yellow":      YellowLightGroup,
+	"shadow":      GreyShadowGroup,
+	"grey":        GreyShadowGroup,
+	"heating":     BlueHeatingGroup,
+	"audio":       CyanAudioGroup,
+	"cyan":        CyanAudioGroup,
+	"video":       MagentaVideoGroup,
+	"magenta":     MagentaVideoGroup,
+	"security":    RedSecurityGroup,
+	"red":         RedSecurityGroup,
+	"access":      GreenAccessGroup,
+	"green":       GreenAccessGroup,
+	"joker":       BlackVariableGroup,
+	"black":       BlackVariableGroup,
+	"cooling":     BlueCoolingGroup,
+	"ventilation": BlueVentilationGroup,
+	"windows":     BlueWindowsGroup,
+	"air":         BlueAirGroup,
+}
+
+// color classes by name, e.g. "black" for the joker color class
+var colorClassNames = map[string]ColorClassType{
+	"yellow":  YellowColorClassT,
+	"grey":    GreyColorClassT,
+	"blue":    BlueColorClassT,
+	"cyan":    CyanColorClassT,
+	"magenta": MagentaColorClassT,
+	"red":     RedColorClassT,
+	"green":   GreenColorClassT,
+	"black":   BlackColorClassT,
+	"white":   WhiteColorClassT,
+}
+
+// ParseGroup returns the dS group by name (e.g. "joker", "shadow") or number
+func ParseGroup(name string) (GroupType, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if group, ok := groupNames[name]; ok {
+		return group, true
+	}
+	if group, err := strconv.Atoi(name); err == nil && group > 0 {
+		return GroupType(group), true
+	}
+	return 0, false
+}
+
+// ParseColorClass returns the color class by color name (e.g. "black") or number
+func ParseColorClass(name string) (ColorClassType, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if colorClass, ok := colorClassNames[name]; ok {
+		return colorClass, true
+	}
+	if colorClass, err := strconv.Atoi(name); err == nil && colorClass > 0 && colorClass <= int(WhiteColorClassT) {
+		return ColorClassType(colorClass), true
+	}
+	return 0, false
+}
+
+// GroupColorClass returns the color class of the group, e.g. black for the joker group
+func GroupColorClass(group GroupType) ColorClassType {
+	switch {
+	case group >= YellowLightGroup && group <= BlackVariableGroup:
+		return ColorClassType(group)
+	case group >= BlueCoolingGroup && group <= BlueAirGroup:
+		return BlueColorClassT
+	case group == RoomTemperatureGroup || group == RoomVentilationGroup:
+		return BlueColorClassT
+	}
+	return 0
+}
+
+// SetSource sets the backend and the id of the device in the backend, e.g.
+// "deconz" and "lights/3", overrides can match devices by them
+func (e *Device) SetSource(backend string, sourceID string) {
+	e.Backend = backend
+	e.SourceID = sourceID
+}
+
+// matches reports whether the override applies to the device
+func (o *DeviceOverride) matches(device *Device) bool {
+	if o.UniqueID == "" && o.Match == "" && o.Backend == "" && o.SourceID == "" {
+		return false
+	}
+
+	if o.UniqueID != "" && o.UniqueID != device.UniqueID {
+		return false
+	}
+
+	if o.Match != "" && !globMatch(o.Match, device.UniqueID) && !globMatch(o.Match, device.Name) {
+		return false
+	}
+
+	if o.Backend != "" && !strings.EqualFold(o.Backend, device.Backend) {
+		return false
+	}
+
+	if o.SourceID != "" && o.SourceID != device.SourceID {
+		return false
+	}
+
+	return true
+}
+
+func globMatch(pattern string, value string) bool {
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// apply changes the device as configured, called before the init of the device
+func (o *DeviceOverride) apply(device *Device) {
+	if o.Name != "" {
+		device.SetName(o.Name)
+	}
+
+	if o.Group != 0 {
+		device.Group = o.Group
+		if o.ColorClass == 0 {
+			device.ColorClass = GroupColorClass(o.Group)
+		}
+	}
+
+	if o.ColorClass != 0 {
+		device.ColorClass = o.ColorClass
+	}
+
+	if o.IconName != "" {
+		device.IconName = o.IconName
+	}
+
+	if o.Output == SwitchOutput {
+		device.setSwitchOnly()
+	}
+}
+
+// setSwitchOnly drops all channels except the basic_switch, e.g. for a dimmable
+// light on a relay
+func (e *Device) setSwitchOnly() {
+	var basicChannel *Channel
+	for i := range e.Channels {
+		if e.Channels[i].ChannelName == "basic_switch" {
+			basicChannel = &e.Channels[i]
+		}
+	}
+
+	if basicChannel == nil {
+		log.WithField("UniqueID", e.UniqueID).Warn("Device has no basic_switch channel, cannot switch to switch-only output")
+		return
+	}
+
+	e.Channels = []Channel{*basicChannel}
+	e.Output = BasicOutput
+	e.Move = false
+}
+
+// SetDeviceOverrides configures the overrides applied to devices when they are
+// added. All matching overrides are applied in order, later ones win.
+func (e *Client) SetDeviceOverrides(overrides []DeviceOverride) {
+	e.overrides = overrides
+}
+
+// applyOverrides applies the matching overrides to the device, false if the device is ignored
+func (e *Client) applyOverrides(device *Device) bool {
+	ignored := false
+
+	for i := range e.overrides {
+		override := &e.overrides[i]
+		if !override.matches(device) {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"UniqueID": device.UniqueID,
+			"Name":     device.Name,
+			"Backend":  device.Backend,
+			"SourceID": device.SourceID,
+		}).Debug("Applying device override")
+
+		override.apply(device)
+		if override.Ignore {
+			ignored = true
+		}
+	}
+
+	return !ignored
+}
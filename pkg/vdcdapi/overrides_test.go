@@ -0,0 +1,149 @@
+package vdcdapi
+
+import (
+	"testing"
+)
+
+func newTestDevice(uniqueID string, name string) *Device {
+	device := new(Device)
+	device.NewColorLightDevice(new(Client), uniqueID)
+	device.SetName(name)
+	device.SetSource("deconz", "lights/3")
+	return device
+}
+
+func TestOverrideMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		override DeviceOverride
+		matches  bool
+	}{
+		{"no criteria", DeviceOverride{Name: "Desk"}, false},
+		{"uniqueid", DeviceOverride{UniqueID: "00:17:88:01-0b"}, true},
+		{"other uniqueid", DeviceOverride{UniqueID: "00:17:88:01"}, false},
+		{"glob on uniqueid", DeviceOverride{Match: "00:17:88:*"}, true},
+		{"glob on name", DeviceOverride{Match: "Living *"}, true},
+		{"glob matching neither", DeviceOverride{Match: "Kitchen*"}, false},
+		{"invalid glob", DeviceOverride{Match: "Living ["}, false},
+		{"backend", DeviceOverride{Backend: "deCONZ"}, true},
+		{"backend and source", DeviceOverride{Backend: "deconz", SourceID: "lights/3"}, true},
+		{"other source", DeviceOverride{Backend: "deconz", SourceID: "lights/4"}, false},
+		{"all criteria", DeviceOverride{UniqueID: "00:17:88:01-0b", Match: "Living *", Backend: "deconz", SourceID: "lights/3"}, true},
+		{"glob and other backend", DeviceOverride{Match: "Living *", Backend: "wled"}, false},
+		{"uniqueid and other glob", DeviceOverride{UniqueID: "00:17:88:01-0b", Match: "Kitchen*"}, false},
+	}
+
+	device := newTestDevice("00:17:88:01-0b", "Living Room")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if matches := tt.override.matches(device); matches != tt.matches {
+				t.Errorf("expected match %t, got %t", tt.matches, matches)
+			}
+		})
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides []DeviceOverride
+		added     bool
+		check     func(t *testing.T, device *Device)
+	}{
+		{
+			name:      "no matching override",
+			overrides: []DeviceOverride{{UniqueID: "other", Name: "Other", Ignore: true}},
+			added:     true,
+			check: func(t *testing.T, device *Device) {
+				if device.Name != "Living Room" {
+					t.Errorf("unexpected name %s", device.Name)
+				}
+			},
+		},
+		{
+			name: "later overrides win",
+			overrides: []DeviceOverride{
+				{Match: "Living *", Name: "Sofa", Group: BlackVariableGroup, IconName: "lamp"},
+				{Backend: "deconz", Name: "Reading Lamp"},
+			},
+			added: true,
+			check: func(t *testing.T, device *Device) {
+				if device.Name != "Reading Lamp" || device.IconName != "lamp" {
+					t.Errorf("unexpected name %s, icon %s", device.Name, device.IconName)
+				}
+				if device.Group != BlackVariableGroup || device.ColorClass != BlackColorClassT {
+					t.Errorf("unexpected group %d, color class %d", device.Group, device.ColorClass)
+				}
+			},
+		},
+		{
+			name: "color class of the group replaced",
+			overrides: []DeviceOverride{
+				{UniqueID: "00:17:88:01-0b", Group: GreyShadowGroup},
+				{UniqueID: "00:17:88:01-0b", ColorClass: WhiteColorClassT},
+			},
+			added: true,
+			check: func(t *testing.T, device *Device) {
+				if device.Group != GreyShadowGroup || device.ColorClass != WhiteColorClassT {
+					t.Errorf("unexpected group %d, color class %d", device.Group, device.ColorClass)
+				}
+			},
+		},
+		{
+			name:      "ignore",
+			overrides: []DeviceOverride{{Backend: "deconz", SourceID: "lights/3", Ignore: true}},
+			added:     false,
+		},
+		{
+			name: "ignore not undone by a later override",
+			overrides: []DeviceOverride{
+				{Match: "00:17:88:*", Ignore: true},
+				{UniqueID: "00:17:88:01-0b", Name: "Sofa"},
+			},
+			added: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := new(Client)
+			client.SetDeviceOverrides(tt.overrides)
+
+			device := newTestDevice("00:17:88:01-0b", "Living Room")
+			if added := client.applyOverrides(device); added != tt.added {
+				t.Fatalf("expected added %t, got %t", tt.added, added)
+			}
+			if tt.check != nil {
+				tt.check(t, device)
+			}
+		})
+	}
+}
+
+func TestSetSwitchOnly(t *testing.T) {
+	device := newTestDevice("00:17:88:01-0b", "Living Room")
+	device.Move = true
+	device.SetValue(100, "basic_switch")
+
+	override := DeviceOverride{UniqueID: "00:17:88:01-0b", Output: SwitchOutput}
+	override.apply(device)
+
+	if len(device.Channels) != 1 || device.Channels[0].ChannelName != "basic_switch" {
+		t.Fatalf("expected only the basic_switch channel, got %+v", device.Channels)
+	}
+	if value, err := device.GetValue("basic_switch"); err != nil || value != 100 {
+		t.Errorf("basic_switch value lost: %v (%v)", value, err)
+	}
+	if device.Output != BasicOutput || device.Move {
+		t.Errorf("expected a basic output without move, got %s, move %t", device.Output, device.Move)
+	}
+
+	// a device without basic_switch keeps its channels
+	shadow := new(Device)
+	shadow.NewShadowDevice(new(Client), "shade-1", false)
+	shadow.setSwitchOnly()
+	if shadow.Output != ShadowOutput || !shadow.Move || len(shadow.Channels) == 0 {
+		t.Errorf("shadow device changed: %s, move %t, %d channels", shadow.Output, shadow.Move, len(shadow.Channels))
+	}
+}
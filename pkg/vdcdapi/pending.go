@@ -0,0 +1,91 @@
+package vdcdapi
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A request the vdcd did not answer within this time is not waited for anymore
+const pendingRequestTimeout = 30 * time.Second
+
+// pendingRequest is a message sent to the vdcd which is answered with a "status" message
+type pendingRequest struct {
+	tag     string
+	kind    string
+	payload string
+	sent    time.Time
+}
+
+// pendingRequests keeps track of requests awaiting a status reply, in the order they were sent
+type pendingRequests struct {
+	mu       sync.Mutex
+	requests []pendingRequest
+}
+
+func (p *pendingRequests) add(tag string, kind string, message interface{}) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.WithError(err).Error("Failed to Marshall object")
+	}
+
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire(now)
+	p.requests = append(p.requests, pendingRequest{tag: tag, kind: kind, payload: string(payload), sent: now})
+}
+
+// resolve removes and returns the request a status reply belongs to.
+// Replies carrying a tag are matched by tag. An untagged reply can only be
+// attributed while a single request is outstanding, otherwise it is not.
+func (p *pendingRequests) resolve(tag string) (pendingRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire(time.Now())
+
+	if tag == "" {
+		if len(p.requests) != 1 {
+			log.WithField("Pending", len(p.requests)).Debug("Untagged status reply, cannot tell which request it belongs to")
+			return pendingRequest{}, false
+		}
+		request := p.requests[0]
+		p.requests = nil
+		return request, true
+	}
+
+	for i, request := range p.requests {
+		if request.tag == tag {
+			p.requests = append(p.requests[:i], p.requests[i+1:]...)
+			return request, true
+		}
+	}
+
+	return pendingRequest{}, false
+}
+
+// expire drops the requests sent before the timeout, called with mu held
+func (p *pendingRequests) expire(now time.Time) {
+	kept := p.requests[:0]
+	for _, request := range p.requests {
+		if now.Sub(request.sent) < pendingRequestTimeout {
+			kept = append(kept, request)
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"Tag":     request.tag,
+			"Request": request.kind,
+		}).Debug("No status reply from vdcd, request not waited for anymore")
+	}
+	p.requests = kept
+}
+
+func (p *pendingRequests) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests = nil
+}
@@ -0,0 +1,46 @@
+package vdcdapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUntaggedStatusNeedsASingleOutstandingRequest(t *testing.T) {
+	var pending pendingRequests
+
+	pending.add("light-1", "init", nil)
+	request, found := pending.resolve("")
+	if !found || request.tag != "light-1" {
+		t.Fatalf("expected the single request, got %+v %v", request, found)
+	}
+
+	pending.add("light-1", "init", nil)
+	pending.add("light-2", "init", nil)
+	if request, found := pending.resolve(""); found {
+		t.Fatalf("untagged status attributed to %s with two outstanding requests", request.tag)
+	}
+
+	// both are still waiting for their tagged status
+	for _, tag := range []string{"light-2", "light-1"} {
+		if request, found := pending.resolve(tag); !found || request.tag != tag {
+			t.Errorf("expected request %s, got %+v %v", tag, request, found)
+		}
+	}
+}
+
+func TestStaleRequestsExpire(t *testing.T) {
+	var pending pendingRequests
+
+	pending.add("stale", "init", nil)
+	pending.requests[0].sent = time.Now().Add(-pendingRequestTimeout)
+	pending.add("light-1", "init", nil)
+
+	// the stale request does not count as outstanding anymore
+	request, found := pending.resolve("")
+	if !found || request.tag != "light-1" {
+		t.Fatalf("expected the request light-1, got %+v %v", request, found)
+	}
+	if _, found := pending.resolve("stale"); found {
+		t.Error("stale request not expired")
+	}
+}
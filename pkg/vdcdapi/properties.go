@@ -0,0 +1,151 @@
+package vdcdapi
+
+import (
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PropertyHandler applies a property value set by the vdcd to the backend
+type PropertyHandler func(device *Device, name string, value interface{}) error
+
+// AddState declares a device state. States must be added before the device is initialized.
+func (e *Device) AddState(name string, state State) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.States == nil {
+		e.States = make(map[string]State)
+	}
+	e.States[name] = state
+}
+
+// AddEvent declares a device event. Events must be added before the device is initialized.
+func (e *Device) AddEvent(name string, event Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.Events == nil {
+		e.Events = make(map[string]Event)
+	}
+	e.Events[name] = event
+}
+
+// AddProperty declares a device property. Properties must be added before the device is initialized.
+func (e *Device) AddProperty(name string, property Property) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.Properties == nil {
+		e.Properties = make(map[string]Property)
+	}
+	e.Properties[name] = property
+}
+
+// SetPropertyHandler registers the handler for properties changed from the dS side
+func (e *Device) SetPropertyHandler(handler PropertyHandler) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.property_cb = handler
+}
+
+// PushState sends a new value of a device state to the vdcd
+func (e *Device) PushState(name string, value interface{}) error {
+	if !e.rememberValue(&e.stateValues, name, value) {
+		return nil
+	}
+
+	// Remembered values are pushed with the init
+	return e.sendIfInitialized(func() error {
+		return e.client.SendPushNotification(e.Tag, map[string]interface{}{name: value}, nil)
+	})
+}
+
+// PushEvent sends a device event to the vdcd
+func (e *Device) PushEvent(name string) error {
+	// Events are not remembered, they are only of interest when they happen
+	return e.sendIfInitialized(func() error {
+		return e.client.SendPushNotification(e.Tag, nil, []string{name})
+	})
+}
+
+// SetProperty sends a new value of a device property to the vdcd
+func (e *Device) SetProperty(name string, value interface{}) error {
+	if !e.rememberValue(&e.propertyValues, name, value) {
+		return nil
+	}
+
+	// Remembered values are pushed with the init
+	return e.sendIfInitialized(func() error {
+		return e.client.SendUpdatePropertyMessage(e.Tag, name, value)
+	})
+}
+
+// GetProperty returns the last known value of a device property
+func (e *Device) GetProperty(name string) (interface{}, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	value, ok := e.propertyValues[name]
+	return value, ok
+}
+
+// rememberValue stores the state or property value, false if it did not change
+func (e *Device) rememberValue(values *map[string]interface{}, name string, value interface{}) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if *values == nil {
+		*values = make(map[string]interface{})
+	}
+
+	// only update when changed
+	if last, ok := (*values)[name]; ok && reflect.DeepEqual(last, value) {
+		return false
+	}
+	(*values)[name] = value
+	return true
+}
+
+func copyValues(values map[string]interface{}) map[string]interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+
+	copied := make(map[string]interface{}, len(values))
+	for name, value := range values {
+		copied[name] = value
+	}
+	return copied
+}
+
+// applyProperty runs the property handler for a property set by the vdcd
+func (e *Device) applyProperty(name string, value interface{}) {
+	e.mu.Lock()
+	handler := e.property_cb
+	e.mu.Unlock()
+
+	if handler == nil {
+		log.WithFields(log.Fields{
+			"UniqueID": e.UniqueID,
+			"Property": name,
+		}).Debug("No property handler for Device")
+		return
+	}
+
+	if err := handler(e, name, value); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"UniqueID": e.UniqueID,
+			"Property": name,
+		}).Error("Failed to set property")
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.propertyValues == nil {
+		e.propertyValues = make(map[string]interface{})
+	}
+	e.propertyValues[name] = value
+}
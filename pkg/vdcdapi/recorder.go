@@ -0,0 +1,87 @@
+package vdcdapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Direction of a recorded message
+const (
+	DirectionIn  = "in"  // received from the vdcd
+	DirectionOut = "out" // sent to the vdcd
+)
+
+// RecordedMessage is a single line of a recorded vdcd session
+type RecordedMessage struct {
+	Time      time.Time       `json:"time"`
+	Direction string          `json:"direction"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// recorder writes every message exchanged with the vdcd as JSON line
+type recorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (r *recorder) record(direction string, payload []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.w == nil {
+		return
+	}
+
+	payload = bytes.TrimSpace(payload)
+	if !json.Valid(payload) {
+		// keep what the vdcd sent, even if it is not valid JSON
+		payload, _ = json.Marshal(string(payload))
+	}
+
+	line, err := json.Marshal(RecordedMessage{Time: time.Now(), Direction: direction, Message: payload})
+	if err != nil {
+		log.WithError(err).Error("Failed to Marshall recorded message")
+		return
+	}
+
+	if _, err := r.w.Write(append(line, '\n')); err != nil {
+		log.WithError(err).Warn("Failed to record message")
+	}
+}
+
+// SetRecorder records all messages exchanged with the vdcd to w, one JSON line
+// per message with timestamp and direction. A nil writer stops recording.
+func (e *Client) SetRecorder(w io.Writer) {
+	e.recorder.mu.Lock()
+	defer e.recorder.mu.Unlock()
+	e.recorder.w = w
+}
+
+// ReadRecording reads a session recorded with SetRecorder
+func ReadRecording(r io.Reader) ([]RecordedMessage, error) {
+	var messages []RecordedMessage
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var message RecordedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			return nil, fmt.Errorf("invalid recording in line %d: %w", line, err)
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, scanner.Err()
+}
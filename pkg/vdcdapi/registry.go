@@ -0,0 +1,155 @@
+package vdcdapi
+
+import (
+	"sync"
+)
+
+// deviceKey identifies a device by its uniqueid and subdevice index
+type deviceKey struct {
+	uniqueID       string
+	subDeviceIndex string
+}
+
+func keyOf(device *Device) deviceKey {
+	return deviceKey{device.UniqueID, device.SubDeviceIndex}
+}
+
+// deviceRegistry holds the devices of a client. Devices are added from the
+// discovery goroutines while the receive loop looks them up, so all access
+// is guarded by the lock. The lock only covers the index, the state of a
+// Device is guarded by its own lock, see Device.mu.
+type deviceRegistry struct {
+	mu sync.RWMutex
+
+	// in the order the devices were added
+	devices []*Device
+
+	byTag map[string]*Device
+	byKey map[deviceKey]*Device
+}
+
+// add registers the device unless a device with the same tag or the same
+// uniqueid and subdevice index is already known. The known device is
+// returned in that case.
+func (r *deviceRegistry) add(device *Device) (*Device, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.byTag == nil {
+		r.byTag = make(map[string]*Device)
+		r.byKey = make(map[deviceKey]*Device)
+	}
+
+	// Tag required when multiple devices on same connection
+	if device.Tag == "" {
+		device.Tag = device.UniqueID
+	}
+
+	if existing, ok := r.byKey[keyOf(device)]; ok {
+		return existing, false
+	}
+	if existing, ok := r.byTag[device.Tag]; ok {
+		return existing, false
+	}
+
+	r.devices = append(r.devices, device)
+	r.byTag[device.Tag] = device
+	r.byKey[keyOf(device)] = device
+
+	return device, true
+}
+
+// replace puts device in place of the registered device old, keeping its position
+func (r *deviceRegistry) replace(old *Device, device *Device) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.byTag, old.Tag)
+	delete(r.byKey, keyOf(old))
+	for i, d := range r.devices {
+		if d == old {
+			r.devices[i] = device
+			break
+		}
+	}
+
+	r.byTag[device.Tag] = device
+	r.byKey[keyOf(device)] = device
+}
+
+// remove unregisters the device with the given tag
+func (r *deviceRegistry) remove(tag string) (*Device, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, ok := r.byTag[tag]
+	if !ok {
+		return nil, false
+	}
+
+	delete(r.byTag, tag)
+	delete(r.byKey, keyOf(device))
+	for i, d := range r.devices {
+		if d == device {
+			r.devices = append(r.devices[:i], r.devices[i+1:]...)
+			break
+		}
+	}
+
+	return device, true
+}
+
+// getByTag returns the device with the given tag
+func (r *deviceRegistry) getByTag(tag string) (*Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	device, ok := r.byTag[tag]
+	return device, ok
+}
+
+// getByKey returns the device with the given uniqueid and subdevice index
+func (r *deviceRegistry) getByKey(uniqueID string, subDeviceIndex string) (*Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	device, ok := r.byKey[deviceKey{uniqueID, subDeviceIndex}]
+	return device, ok
+}
+
+// getByUniqueID returns the first added device with the given uniqueid, regardless of the subdevice index
+func (r *deviceRegistry) getByUniqueID(uniqueID string) (*Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if device, ok := r.byKey[deviceKey{uniqueID, ""}]; ok {
+		return device, true
+	}
+
+	for _, device := range r.devices {
+		if device.UniqueID == uniqueID {
+			return device, true
+		}
+	}
+
+	return nil, false
+}
+
+// snapshot returns the devices at the time of the call, safe to iterate
+// while devices are added or removed
+func (r *deviceRegistry) snapshot() []*Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	devices := make([]*Device, len(r.devices))
+	copy(devices, r.devices)
+	return devices
+}
+
+// len returns the number of registered devices
+func (r *deviceRegistry) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.devices)
+}
@@ -0,0 +1,431 @@
+package vdcdapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultStoreFlushInterval is how often changes of the device store are written to disk
+const DefaultStoreFlushInterval = 10 * time.Second
+
+// Stored devices no backend announced for this long are not restored anymore
+const StoredDeviceMaxAge = 30 * 24 * time.Hour
+
+// StoredChannel is a channel of a stored device with its last value
+type StoredChannel struct {
+	ChannelName string          `json:"name"`
+	ChannelType ChannelTypeType `json:"type"`
+	Value       *float32        `json:"value,omitempty"`
+	Min         float32         `json:"min,omitempty"`
+	Max         float32         `json:"max,omitempty"`
+	Resolution  float32         `json:"resolution,omitempty"`
+	Unit        string          `json:"unit,omitempty"`
+}
+
+// StoredDevice is a known device as persisted in the device store
+type StoredDevice struct {
+	// the device as announced with the init message
+	Device   json.RawMessage `json:"device"`
+	Backend  string          `json:"backend,omitempty"`
+	SourceID string          `json:"source,omitempty"`
+
+	Channels []StoredChannel    `json:"channels,omitempty"`
+	Sensors  map[string]float32 `json:"sensors,omitempty"`
+	Inputs   map[string]float32 `json:"inputs,omitempty"`
+
+	LastSeen time.Time `json:"lastseen"`
+}
+
+type storeData struct {
+	Devices   map[string]*StoredDevice `json:"devices"`
+	Overrides []DeviceOverride         `json:"overrides,omitempty"`
+}
+
+// DeviceStore persists the known devices, their last channel, sensor and
+// input values and the device overrides in a JSON file across restarts
+type DeviceStore struct {
+	path string
+
+	mu    sync.Mutex
+	data  storeData
+	dirty bool
+
+	// devices changed since they were last stored, they are only marshaled
+	// when the store is read or saved, not on every change of a value
+	changed map[string]changedDevice
+}
+
+type changedDevice struct {
+	device   *Device
+	lastSeen time.Time
+}
+
+// OpenDeviceStore reads the store from path, a missing file is an empty store
+func OpenDeviceStore(path string) (*DeviceStore, error) {
+	store := &DeviceStore{path: path, changed: make(map[string]changedDevice)}
+	store.data.Devices = make(map[string]*StoredDevice)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &store.data); err != nil {
+		return nil, fmt.Errorf("invalid device store %s: %w", path, err)
+	}
+	if store.data.Devices == nil {
+		store.data.Devices = make(map[string]*StoredDevice)
+	}
+
+	return store, nil
+}
+
+// Devices returns the stored devices
+func (s *DeviceStore) Devices() []StoredDevice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.storeChanged()
+
+	tags := make([]string, 0, len(s.data.Devices))
+	for tag := range s.data.Devices {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	devices := make([]StoredDevice, 0, len(tags))
+	for _, tag := range tags {
+		devices = append(devices, *s.data.Devices[tag])
+	}
+	return devices
+}
+
+// Overrides returns the stored device overrides
+func (s *DeviceStore) Overrides() []DeviceOverride {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]DeviceOverride(nil), s.data.Overrides...)
+}
+
+// SetOverrides replaces the stored device overrides
+func (s *DeviceStore) SetOverrides(overrides []DeviceOverride) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Overrides = append([]DeviceOverride(nil), overrides...)
+	s.dirty = true
+}
+
+// put remembers the device and its current values, they are taken from the
+// device when the store is saved
+func (s *DeviceStore) put(device *Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changed[device.Tag] = changedDevice{device: device, lastSeen: time.Now()}
+	s.dirty = true
+}
+
+// storeChanged takes the values of the changed devices, called with mu held
+func (s *DeviceStore) storeChanged() {
+	for tag, changed := range s.changed {
+		stored, err := newStoredDevice(changed.device, changed.lastSeen)
+		if err != nil {
+			log.WithError(err).WithField("UniqueID", changed.device.UniqueID).Error("Failed to Marshall device for the store")
+			continue
+		}
+		s.data.Devices[tag] = stored
+	}
+	clear(s.changed)
+}
+
+// newStoredDevice copies the device and its current values under the device lock
+func newStoredDevice(device *Device, lastSeen time.Time) (*StoredDevice, error) {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+
+	deviceJSON, err := json.Marshal(device)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &StoredDevice{
+		Device:   deviceJSON,
+		Backend:  device.Backend,
+		SourceID: device.SourceID,
+		LastSeen: lastSeen,
+	}
+
+	for _, channel := range device.Channels {
+		storedChannel := StoredChannel{
+			ChannelName: channel.ChannelName,
+			ChannelType: channel.ChannelType,
+			Min:         channel.Min,
+			Max:         channel.Max,
+			Resolution:  channel.Resolution,
+			Unit:        channel.Unit,
+		}
+		if channel.hasValue {
+			value := channel.Value
+			storedChannel.Value = &value
+		}
+		stored.Channels = append(stored.Channels, storedChannel)
+	}
+
+	for _, sensor := range device.Sensors {
+		if sensor.hasValue {
+			if stored.Sensors == nil {
+				stored.Sensors = make(map[string]float32)
+			}
+			stored.Sensors[sensor.Id] = sensor.Value
+		}
+	}
+
+	for _, input := range device.Inputs {
+		if input.hasValue {
+			if stored.Inputs == nil {
+				stored.Inputs = make(map[string]float32)
+			}
+			stored.Inputs[input.Id] = input.Value
+		}
+	}
+
+	return stored, nil
+}
+
+// remove forgets the device with the given tag
+func (s *DeviceStore) remove(tag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.changed, tag)
+	if _, ok := s.data.Devices[tag]; ok {
+		delete(s.data.Devices, tag)
+		s.dirty = true
+	}
+}
+
+// Save writes the store to disk if it changed. The file is replaced
+// atomically, a crash while writing does not lose the previous state.
+func (s *DeviceStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+	s.storeChanged()
+
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// Run writes the changes to disk every interval until the context is canceled
+func (s *DeviceStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				log.WithError(err).WithField("Path", s.path).Warn("Failed to save device store")
+			}
+		}
+	}
+}
+
+// restore recreates the stored device, without backend until the backend
+// announces it again
+func (s *StoredDevice) restore(client *Client) (*Device, error) {
+	device := new(Device)
+	device.NewDevice(client, "")
+	if err := json.Unmarshal(s.Device, device); err != nil {
+		return nil, err
+	}
+	if device.UniqueID == "" {
+		return nil, fmt.Errorf("stored device without uniqueid")
+	}
+
+	device.Backend = s.Backend
+	device.SourceID = s.SourceID
+	device.restored = true
+	device.lastUpdate = s.LastSeen
+
+	for _, stored := range s.Channels {
+		channel := Channel{
+			ChannelName: stored.ChannelName,
+			ChannelType: stored.ChannelType,
+			Min:         stored.Min,
+			Max:         stored.Max,
+			Resolution:  stored.Resolution,
+			Unit:        stored.Unit,
+		}
+		if stored.Value != nil {
+			channel.Value = *stored.Value
+			channel.hasValue = true
+		}
+		device.Channels = append(device.Channels, channel)
+	}
+
+	for i := range device.Sensors {
+		if value, ok := s.Sensors[device.Sensors[i].Id]; ok {
+			device.Sensors[i].Value = value
+			device.Sensors[i].hasValue = true
+		}
+	}
+
+	for i := range device.Inputs {
+		if value, ok := s.Inputs[device.Inputs[i].Id]; ok {
+			device.Inputs[i].Value = value
+			device.Inputs[i].hasValue = true
+		}
+	}
+
+	return device, nil
+}
+
+// SetStore persists the added devices and their values in the store
+func (e *Client) SetStore(store *DeviceStore) {
+	e.store = store
+}
+
+// RestoreDevices announces the devices of the store with their last values.
+// The restored devices are taken over by the backends once they announce them
+// again, until then the vdcd sees the last known state.
+func (e *Client) RestoreDevices() int {
+	if e.store == nil {
+		return 0
+	}
+
+	restored := 0
+	for _, stored := range e.store.Devices() {
+		device, err := stored.restore(e)
+		if err == nil && time.Since(stored.LastSeen) > StoredDeviceMaxAge {
+			log.WithFields(log.Fields{
+				"UniqueID": device.UniqueID,
+				"LastSeen": stored.LastSeen,
+			}).Info("Forgetting stored device not seen for too long")
+			e.store.remove(device.Tag)
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Warn("Failed to restore stored device")
+			continue
+		}
+
+		if e.AddDevice(device) {
+			restored++
+		}
+	}
+
+	log.WithField("Devices", restored).Info("Restored known devices from the store")
+
+	return restored
+}
+
+// remember stores the device and its current values
+func (e *Client) remember(device *Device) {
+	if e.store == nil || device.restored {
+		return
+	}
+	if registered, ok := e.devices.getByTag(device.Tag); !ok || registered != device {
+		return
+	}
+	e.store.put(device)
+}
+
+// takeOver replaces the restored device with the device announced by the
+// backend. The restored values are kept until the backend reports its own,
+// the device is only announced again when its init changed.
+func (e *Client) takeOver(restored *Device, device *Device) {
+	// Wait for an init of the restored device being sent, the new device is
+	// not announced on its own before its init state is decided
+	restored.sendMu.Lock()
+	device.sendMu.Lock()
+
+	restoredValues := restored.values()
+
+	device.mu.Lock()
+	device.Tag = restored.Tag
+	for _, channel := range restoredValues.channels {
+		for i := range device.Channels {
+			if device.Channels[i].ChannelName == channel.ChannelName && !device.Channels[i].hasValue && channel.hasValue {
+				value, _ := device.Channels[i].normalize(channel.Value)
+				device.setChannelValue(i, value)
+			}
+		}
+	}
+	deviceInit, _ := json.Marshal(device)
+	device.mu.Unlock()
+
+	restored.mu.Lock()
+	restoredInit, _ := json.Marshal(restored)
+	restored.mu.Unlock()
+
+	unchanged := string(restoredInit) == string(deviceInit)
+	announced := restored.InitDone()
+	if announced && unchanged {
+		device.SetInitDone()
+	}
+
+	e.devices.replace(restored, device)
+
+	log.WithFields(log.Fields{
+		"UniqueID":  device.UniqueID,
+		"Tag":       device.Tag,
+		"Unchanged": unchanged,
+	}).Info("Restored device announced by backend")
+
+	if announced && unchanged {
+		e.pushInitState(device, device.values())
+		device.sendMu.Unlock()
+		restored.sendMu.Unlock()
+		return
+	}
+	device.sendMu.Unlock()
+
+	if announced {
+		e.sendDeviceByeMessage(restored.Tag)
+	}
+	restored.resetInit()
+	restored.sendMu.Unlock()
+
+	e.scheduleInit()
+}
@@ -0,0 +1,161 @@
+package vdcdapi_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi/vdcdtest"
+)
+
+// openStore opens the device store at path, it fails the test when the store cannot be read
+func openStore(t *testing.T, path string) *vdcdapi.DeviceStore {
+	t.Helper()
+
+	store, err := vdcdapi.OpenDeviceStore(path)
+	if err != nil {
+		t.Fatalf("open store failed: %s", err)
+	}
+	return store
+}
+
+// storedValue returns the stored value of the channel of the only stored device
+func storedValue(t *testing.T, store *vdcdapi.DeviceStore, channelName string) float32 {
+	t.Helper()
+
+	devices := store.Devices()
+	if len(devices) != 1 {
+		t.Fatalf("expected 1 stored device, got %d", len(devices))
+	}
+	for _, channel := range devices[0].Channels {
+		if channel.ChannelName == channelName && channel.Value != nil {
+			return *channel.Value
+		}
+	}
+	t.Fatalf("no stored value for %s", channelName)
+	return 0
+}
+
+func TestStoreSaveReplacesTheFile(t *testing.T) {
+	vdcd := vdcdtest.NewServer(t)
+	client := startClient(t, vdcd, 0)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "devices.json")
+	store := openStore(t, path)
+	client.SetStore(store)
+
+	device := newLight(client, "light-1")
+	device.SetValue(42, "brightness")
+	client.AddDevice(device)
+	vdcd.AssertInit(t, "light-1")
+
+	if err := store.Save(); err != nil {
+		t.Fatalf("save failed: %s", err)
+	}
+
+	// a reader of the previous file keeps reading it while it is replaced
+	previous, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("store not written: %s", err)
+	}
+	defer previous.Close()
+	previousInfo, err := previous.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device.UpdateValue(80, "brightness", vdcdapi.BrightnessType)
+	if err := store.Save(); err != nil {
+		t.Fatalf("save failed: %s", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(previousInfo, info) {
+		t.Error("store written in place instead of replaced")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+
+	if value := storedValue(t, openStore(t, path), "brightness"); value != 80 {
+		t.Errorf("expected the stored brightness 80, got %v", value)
+	}
+	if after, err := io.ReadAll(previous); err != nil || !bytes.Equal(after, before) {
+		t.Error("previous store changed while it was replaced")
+	}
+}
+
+func TestRestoredDeviceIsTakenOverByTheBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+
+	// the first run stores the device with its last value
+	first := vdcdtest.NewServer(t)
+	client := startClient(t, first, 0)
+	store := openStore(t, path)
+	client.SetStore(store)
+
+	device := newLight(client, "light-1")
+	device.SetValue(42, "brightness")
+	client.AddDevice(device)
+	first.AssertInit(t, "light-1")
+	if err := store.Save(); err != nil {
+		t.Fatalf("save failed: %s", err)
+	}
+
+	// the restart announces it before the backend does
+	vdcd := vdcdtest.NewServer(t)
+	client = startClient(t, vdcd, 0)
+	client.SetStore(openStore(t, path))
+
+	if restored := client.RestoreDevices(); restored != 1 {
+		t.Fatalf("expected 1 restored device, got %d", restored)
+	}
+	vdcd.AssertInit(t, "light-1")
+	vdcd.AssertChannel(t, "light-1", "brightness", 42)
+
+	// hidden from the backends until they announce it
+	if _, err := client.GetDeviceByUniqueId("light-1"); err == nil {
+		t.Error("restored device visible to the backends")
+	}
+	devices := client.GetDevices()
+	if len(devices) != 1 || !devices[0].Restored() {
+		t.Fatalf("expected the restored device, got %v", devices)
+	}
+
+	vdcd.Reset()
+	announced := newLight(client, "light-1")
+	if !client.AddDevice(announced) {
+		t.Fatal("announced device not added")
+	}
+
+	found, err := client.GetDeviceByUniqueId("light-1")
+	if err != nil || found != announced {
+		t.Fatalf("announced device not found: %v", err)
+	}
+	if value, err := announced.GetValue("brightness"); err != nil || value != 42 {
+		t.Errorf("expected the restored brightness 42, got %v (%v)", value, err)
+	}
+
+	// the vdcd already knows the unchanged device
+	vdcd.AssertNoMessage(t, "init", "light-1", 100*time.Millisecond)
+	if devices := client.GetDevices(); len(devices) != 1 || devices[0] != announced {
+		t.Errorf("restored device not replaced: %v", devices)
+	}
+}
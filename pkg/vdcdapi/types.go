@@ -1,5 +1,10 @@
 package vdcdapi
 
+import (
+	"sync"
+	"time"
+)
+
 type ButtonType int
 type ElementType int
 type GroupType int
@@ -144,6 +149,7 @@ const (
 	TimeSensor
 )
 
+// Channel types as defined by digitalSTROM, see channeltype_* in p44vdc dsdefs.h
 const (
 	UndefinedType ChannelTypeType = iota
 	BrightnessType
@@ -156,10 +162,22 @@ const (
 	CurtainShadePositionType
 	BlindShadeAngleType
 	CurtainsShadeAngleType
+	TransparencyType
 	AirflowIntesityType
 	AirflowDirectionType
 	AirflowFlapPositionType
 	VentilationLouverPositionType
+	HeatingPowerType
+	CoolingCapacityType
+	AudioVolumeType
+	PowerStateType
+	AirflowLouverAutoType
+	AirflowIntensityAutoType
+	WaterTemperatureType
+	WaterFlowRateType
+	PowerLevelType
+	VideoStationType
+	VideoInputSourceType
 )
 
 const (
@@ -188,6 +206,17 @@ const (
 	CT_NONE             = 255            ///< no click (for state)
 )
 
+// LogLevel of a vdcd log message, same as the syslog levels
+type LogLevel int
+
+const (
+	LogError   LogLevel = 3
+	LogWarning LogLevel = 4
+	LogNotice  LogLevel = 5
+	LogInfo    LogLevel = 6
+	LogDebug   LogLevel = 7
+)
+
 // Clicktype values for direct click
 const (
 	CT_DC_TIP_1X     ClickType = 1
@@ -208,21 +237,32 @@ type InitvdcMessage struct {
 	Name          string `json:"name,omitempty"`
 }
 
+// LogMessage writes a line into the vdcd log
+type LogMessage struct {
+	GenericMessageHeader
+	Level LogLevel `json:"level"`
+	Text  string   `json:"text"`
+}
+
 type GenericVDCDMessage struct {
 	GenericMessageHeader
 	GenericVCDCMessageFields
-	Status       string              `json:"status"`
-	ErrorCode    int                 `json:"errorcode,omitempty"`
-	ErrorDomain  string              `json:"errordomain,omitempty"`
-	ErrorMessage string              `json:"errormessage,omitempty"`
-	Dimming      bool                `json:"dimming,omitempty"`
-	Direction    int                 `json:"direction,omitempty"`
-	Name         string              `json:"name,omitempty"`
-	Sync         bool                `json:"sync,omitempty"`
-	Cmd          string              `json:"cmd,omitempty"`
-	ConfigId     string              `json:"configid,omitempty"`
-	Params       map[string]Param    `json:"params,omitempty"`
-	Properties   map[string]Property `json:"properties,omitempty"`
+	Status       string                 `json:"status"`
+	ErrorCode    int                    `json:"errorcode,omitempty"`
+	ErrorDomain  string                 `json:"errordomain,omitempty"`
+	ErrorMessage string                 `json:"errormessage,omitempty"`
+	Dimming      bool                   `json:"dimming,omitempty"`
+	Direction    int                    `json:"direction,omitempty"`
+	Name         string                 `json:"name,omitempty"`
+	Sync         bool                   `json:"sync,omitempty"`
+	Cmd          string                 `json:"cmd,omitempty"`
+	ConfigId     string                 `json:"configid,omitempty"`
+	Action       string                 `json:"action,omitempty"`
+	Params       map[string]interface{} `json:"params,omitempty"`
+	Properties   map[string]Property    `json:"properties,omitempty"`
+
+	// raw message as received, for messages with values not fitting the fields above
+	raw []byte
 }
 
 type GenericVCDCMessageFields struct {
@@ -253,6 +293,44 @@ type GenericDeviceMessageFields struct {
 	ChannelType ChannelTypeType `json:"type,omitempty"`
 }
 
+type GenericTaggedMessage struct {
+	GenericMessageHeader
+	Tag string `json:"tag,omitempty"`
+}
+
+// ConfirmActionMessage reports the result of an invoked action back to the vdcd
+type ConfirmActionMessage struct {
+	GenericMessageHeader
+	Tag       string `json:"tag,omitempty"`
+	ErrorCode int    `json:"errorcode,omitempty"`
+	ErrorText string `json:"errortext,omitempty"`
+}
+
+// PushNotificationMessage reports state changes and events of a single device
+type PushNotificationMessage struct {
+	GenericMessageHeader
+	Tag         string                 `json:"tag,omitempty"`
+	StateChange map[string]interface{} `json:"statechange,omitempty"`
+	Events      []string               `json:"events,omitempty"`
+}
+
+// UpdatePropertyMessage reports a new value of a single device property
+type UpdatePropertyMessage struct {
+	GenericMessageHeader
+	Tag          string      `json:"tag,omitempty"`
+	PropertyName string      `json:"propertyname"`
+	Value        interface{} `json:"value"`
+	Push         bool        `json:"push,omitempty"`
+}
+
+// SetPropertyMessage is a property change requested by the vdcd
+type SetPropertyMessage struct {
+	GenericMessageHeader
+	Tag          string      `json:"tag,omitempty"`
+	PropertyName string      `json:"propertyname"`
+	Value        interface{} `json:"value"`
+}
+
 type GenericDeviceMessage struct {
 	GenericMessageHeader
 	GenericDeviceMessageFields
@@ -260,7 +338,7 @@ type GenericDeviceMessage struct {
 
 type DeviceInitMessage struct {
 	GenericInitMessageHeader
-	Device
+	*Device
 }
 
 type Device struct {
@@ -295,25 +373,71 @@ type Device struct {
 	CurrentConfigId        string                    `json:"currentconfigid,omitempty"`
 	Actions                map[string]Action         `json:"actions,omitempty"`
 	DynamicActions         map[string]DynamicAction  `json:"dynamicactions,omitempty"`
-	StandardActions        map[string]StandardAction `json:"standarcactions,omitempty"`
+	StandardActions        map[string]StandardAction `json:"standardactions,omitempty"`
 	AutoAddStandardActions bool                      `json:"autoaddstandardactions,omitempty"`
 	NoConfirmaction        bool                      `json:"noconfirmaction,omitempty"`
 	States                 map[string]State          `json:"states,omitempty"`
 	Events                 map[string]Event          `json:"events,omitempty"`
 	Properties             map[string]Property       `json:"properties,omitempty"`
 
+	// mu guards the init state, the channel, sensor and input values and
+	// ranges, the last update, the state and property values, the declared
+	// states, events and properties and the message callbacks and handlers.
+	// The announced configuration (tag, uniqueid, name, channels, sensors, ...)
+	// is set up before AddDevice and not changed afterwards, it is not locked.
+	mu sync.Mutex
+
+	// sendMu orders the messages of the device, it is held while the init and
+	// the remembered values are sent, so no value overtakes the init.
+	// It is taken before mu, never while holding it.
+	sendMu sync.Mutex
+
 	//value        float32                                           `json:"-"`
 	client       *Client                                           `json:"-"`
 	channel_cb   func(message *GenericVDCDMessage, device *Device) `json:"-"`
-	InitDone     bool                                              `json:"-"`
+	move_cb      func(message *GenericVDCDMessage, device *Device) `json:"-"`
+	sync_cb      func(message *GenericVDCDMessage, device *Device) `json:"-"`
+	scene_cb     func(message *GenericVDCDMessage, device *Device) `json:"-"`
+	control_cb   func(message *GenericVDCDMessage, device *Device) `json:"-"`
+	remove_cb    func(device *Device)                              `json:"-"`
+	action_cbs   map[string]ActionHandler                          `json:"-"`
+	property_cb  PropertyHandler                                   `json:"-"`
 	SourceDevice interface{}                                       `json:"-"`
+	Backend      string                                            `json:"-"`
+	SourceID     string                                            `json:"-"`
 	Channels     []Channel                                         `json:"-"`
+
+	// Scene command (OFF, ON, MIN, MAX, ...) to backend scene/preset
+	SceneMappings map[string]string `json:"-"`
+
+	// Last pushed state and property values, pushed again after init
+	stateValues    map[string]interface{}
+	propertyValues map[string]interface{}
+
+	// init state in the current vdcd session, see SetInitDone and SetInitFailed
+	initDone   bool
+	initFailed bool
+	initError  error
+
+	// restored from the device store, not yet announced by its backend
+	restored bool
+
+	// last change of a channel, sensor or input value
+	lastUpdate time.Time
 }
 
 type Channel struct {
 	ChannelName string
 	ChannelType ChannelTypeType
 	Value       float32
+
+	// Range and resolution of the value in the unit of the vdcd, e.g. mired for colortemp
+	Min        float32
+	Max        float32
+	Resolution float32
+	Unit       string
+
+	hasValue bool
 }
 
 type Button struct {
@@ -335,6 +459,9 @@ type Input struct {
 	UpdateInterval      float32 `json:"updateinterval,omitempty"`
 	AliveSignalInterval float32 `json:"alivesignalinterval,omitempty"`
 	HardwareName        string  `json:"hardwarename,omitempty"`
+
+	Value    float32 `json:"-"`
+	hasValue bool
 }
 
 type Sensor struct {
@@ -349,6 +476,9 @@ type Sensor struct {
 	Min                 float32         `json:"min,omitempty"`
 	Max                 float32         `json:"max,omitempty"`
 	Resolution          float32         `json:"resolution,omitempty"`
+
+	Value    float32 `json:"-"`
+	hasValue bool
 }
 
 type Action struct {
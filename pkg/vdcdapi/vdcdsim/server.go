@@ -0,0 +1,338 @@
+// Package vdcdsim provides an in-process vdcd speaking the external device
+// JSON protocol, to run the bridge and the discovery backends without a live
+// vdcd, e.g. to replay a recorded session. See package vdcdtest for the test helpers.
+package vdcdsim
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+)
+
+// Message is a message received from the bridge
+type Message struct {
+	MessageType string  `json:"message"`
+	Tag         string  `json:"tag,omitempty"`
+	UniqueID    string  `json:"uniqueid,omitempty"`
+	ID          string  `json:"id,omitempty"`
+	Index       int     `json:"index"`
+	Value       float32 `json:"value"`
+
+	// Raw message as received, e.g. to decode an init message with Device
+	Raw json.RawMessage `json:"-"`
+}
+
+// Device decodes the device announced with an init message
+func (m Message) Device() (*vdcdapi.Device, error) {
+	device := new(vdcdapi.Device)
+	err := json.Unmarshal(m.Raw, device)
+	return device, err
+}
+
+// Server is a vdcd accepting a single bridge connection at a time.
+// Received messages are recorded, init messages are confirmed with status ok.
+type Server struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	conn     net.Conn
+	w        *bufio.Writer
+	messages []Message
+
+	// closed and replaced whenever a message is recorded or a bridge connects
+	changed chan struct{}
+
+	// initStatus returns the status error for an init, empty to accept it
+	initStatus func(device *vdcdapi.Device) string
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewServer starts a vdcd listening on a random local port
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Server{
+		listener: listener,
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.accept()
+
+	return s, nil
+}
+
+// Host returns the host to connect the vdcdapi.Client to
+func (s *Server) Host() string {
+	return s.listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+// Port returns the port to connect the vdcdapi.Client to
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// SetInitStatus overrides the reply to init messages, a non empty error
+// message rejects the init of the device
+func (s *Server) SetInitStatus(status func(device *vdcdapi.Device) string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initStatus = status
+}
+
+// Close stops the server and closes the connection to the bridge
+func (s *Server) Close() {
+	close(s.done)
+	s.listener.Close()
+	s.Disconnect()
+	s.wg.Wait()
+}
+
+// Disconnect closes the current connection, the bridge is expected to reconnect
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.w = nil
+	}
+}
+
+// Connected reports whether a bridge is connected
+func (s *Server) Connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn != nil
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			continue
+		}
+
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.conn = conn
+		s.w = bufio.NewWriter(conn)
+		s.notify()
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.receive(conn)
+	}
+}
+
+func (s *Server) receive(conn net.Conn) {
+	defer s.wg.Done()
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if strings.TrimSpace(line) != "" {
+			s.record(strings.TrimSpace(line))
+		}
+		if err != nil {
+			s.mu.Lock()
+			if s.conn == conn {
+				s.conn = nil
+				s.w = nil
+				s.notify()
+			}
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// record parses a line from the bridge, init messages may be sent as an array
+func (s *Server) record(line string) {
+	var raws []json.RawMessage
+	if strings.HasPrefix(line, "[") {
+		if err := json.Unmarshal([]byte(line), &raws); err != nil {
+			return
+		}
+	} else {
+		raws = []json.RawMessage{json.RawMessage(line)}
+	}
+
+	for _, raw := range raws {
+		// e.g. a string value of updateProperty, the other fields are decoded anyway
+		var message Message
+		var typeErr *json.UnmarshalTypeError
+		if err := json.Unmarshal(raw, &message); err != nil && !errors.As(err, &typeErr) {
+			continue
+		}
+		message.Raw = raw
+
+		s.mu.Lock()
+		s.messages = append(s.messages, message)
+		s.notify()
+		initStatus := s.initStatus
+		s.mu.Unlock()
+
+		if message.MessageType == "init" {
+			s.confirmInit(message, initStatus)
+		}
+	}
+}
+
+func (s *Server) confirmInit(message Message, initStatus func(device *vdcdapi.Device) string) {
+	status := map[string]interface{}{"message": "status", "status": "ok", "tag": message.Tag}
+
+	if initStatus != nil {
+		device, _ := message.Device()
+		if errorMessage := initStatus(device); errorMessage != "" {
+			status["status"] = "error"
+			status["errorcode"] = 400
+			status["errormessage"] = errorMessage
+		}
+	}
+
+	// the bridge may already be gone, then there is nobody to confirm to
+	_ = s.Send(status)
+}
+
+// notify wakes up all waiting assertions, called with mu held
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Send sends a message to the connected bridge
+func (s *Server) Send(message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.w == nil {
+		return fmt.Errorf("no bridge connected")
+	}
+
+	if _, err := s.w.Write(append(payload, '\n')); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// SendChannel sets the value of an output channel, as the vdcd does when a scene is called
+func (s *Server) SendChannel(tag string, channelName string, value float32) error {
+	return s.Send(map[string]interface{}{"message": "channel", "tag": tag, "id": channelName, "value": value})
+}
+
+// SendMove starts (direction 1 or -1) or stops (direction 0) dimming of a channel
+func (s *Server) SendMove(tag string, index int, direction int) error {
+	return s.Send(map[string]interface{}{"message": "move", "tag": tag, "index": index, "direction": direction})
+}
+
+// SendSync requests the device to read back its output state, answered with synced
+func (s *Server) SendSync(tag string) error {
+	return s.Send(map[string]interface{}{"message": "sync", "tag": tag})
+}
+
+// SendSceneCommand sends a scene command, e.g. "preset1" or "stop"
+func (s *Server) SendSceneCommand(tag string, cmd string) error {
+	return s.Send(map[string]interface{}{"message": "scenecommand", "tag": tag, "cmd": cmd})
+}
+
+// Messages returns all messages received so far
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]Message, len(s.messages))
+	copy(messages, s.messages)
+	return messages
+}
+
+// MessagesOfType returns all received messages of the type, e.g. "channel"
+func (s *Server) MessagesOfType(messageType string) []Message {
+	var messages []Message
+	for _, message := range s.Messages() {
+		if message.MessageType == messageType {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// Reset forgets all messages received so far
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+}
+
+// WaitFor waits until a message matching the filter was received
+func (s *Server) WaitFor(timeout time.Duration, match func(message Message) bool) (Message, bool) {
+	deadline := time.After(timeout)
+
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		for _, message := range s.messages {
+			if match(message) {
+				s.mu.Unlock()
+				return message, true
+			}
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return Message{}, false
+		}
+	}
+}
+
+// WaitConnected waits until a bridge is connected
+func (s *Server) WaitConnected(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		connected := s.conn != nil
+		s.mu.Unlock()
+
+		if connected {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
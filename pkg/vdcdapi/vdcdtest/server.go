@@ -0,0 +1,116 @@
+// Package vdcdtest provides test helpers around the simulated vdcd of package
+// vdcdsim, for tests of the bridge and the discovery backends without a live vdcd.
+package vdcdtest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi/vdcdsim"
+)
+
+// DefaultTimeout is how long the assertion helpers wait for an expected message
+const DefaultTimeout = 2 * time.Second
+
+// Message is a message received from the bridge
+type Message = vdcdsim.Message
+
+// Server is a simulated vdcd with assertions on the messages received from the bridge
+type Server struct {
+	*vdcdsim.Server
+}
+
+// NewServer starts a simulated vdcd, it is closed when the test ends
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	server, err := vdcdsim.NewServer()
+	if err != nil {
+		t.Fatalf("vdcdtest: %s", err)
+	}
+	t.Cleanup(server.Close)
+
+	return &Server{server}
+}
+
+// AssertInit fails the test when no init for the device uniqueid is received
+func (s *Server) AssertInit(t testing.TB, uniqueID string) *vdcdapi.Device {
+	t.Helper()
+
+	message, ok := s.WaitFor(DefaultTimeout, func(message Message) bool {
+		return message.MessageType == "init" && message.UniqueID == uniqueID
+	})
+	if !ok {
+		t.Fatalf("vdcdtest: no init received for device %s", uniqueID)
+	}
+
+	device, err := message.Device()
+	if err != nil {
+		t.Fatalf("vdcdtest: invalid init for device %s: %s", uniqueID, err)
+	}
+	return device
+}
+
+// AssertChannel fails the test when no channel message with the value is received for the device
+func (s *Server) AssertChannel(t testing.TB, tag string, channelName string, value float32) {
+	t.Helper()
+	s.assertValue(t, "channel", tag, func(message Message) bool { return message.ID == channelName }, channelName, value)
+}
+
+// AssertSensor fails the test when no sensor message with the value is received for the device
+func (s *Server) AssertSensor(t testing.TB, tag string, sensorID string, value float32) {
+	t.Helper()
+	s.assertValue(t, "sensor", tag, func(message Message) bool { return message.ID == sensorID }, sensorID, value)
+}
+
+// AssertButton fails the test when no button message with the value is received for the button index of the device
+func (s *Server) AssertButton(t testing.TB, tag string, index int, value float32) {
+	t.Helper()
+	s.assertValue(t, "button", tag, func(message Message) bool { return message.Index == index }, fmt.Sprint(index), value)
+}
+
+// AssertMessage fails the test when no message of the type is received for the device
+func (s *Server) AssertMessage(t testing.TB, messageType string, tag string) Message {
+	t.Helper()
+
+	message, ok := s.WaitFor(DefaultTimeout, func(message Message) bool {
+		return message.MessageType == messageType && message.Tag == tag
+	})
+	if !ok {
+		t.Fatalf("vdcdtest: no %s message received for %s", messageType, tag)
+	}
+	return message
+}
+
+// AssertNoMessage fails the test when a message of the type is received for the device within the timeout
+func (s *Server) AssertNoMessage(t testing.TB, messageType string, tag string, timeout time.Duration) {
+	t.Helper()
+
+	message, ok := s.WaitFor(timeout, func(message Message) bool {
+		return message.MessageType == messageType && message.Tag == tag
+	})
+	if ok {
+		t.Fatalf("vdcdtest: unexpected %s message for %s: %s", messageType, tag, string(message.Raw))
+	}
+}
+
+func (s *Server) assertValue(t testing.TB, messageType string, tag string, match func(message Message) bool, id string, value float32) {
+	t.Helper()
+
+	_, ok := s.WaitFor(DefaultTimeout, func(message Message) bool {
+		return message.MessageType == messageType && message.Tag == tag && match(message) && message.Value == value
+	})
+	if ok {
+		return
+	}
+
+	var received []string
+	for _, message := range s.MessagesOfType(messageType) {
+		if message.Tag == tag {
+			received = append(received, string(message.Raw))
+		}
+	}
+	t.Fatalf("vdcdtest: no %s message %s=%v received for %s, got: %v", messageType, id, value, tag, received)
+}
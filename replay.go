@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"github.com/splattner/vdcd-bridge/pkg/discovery"
+	"github.com/splattner/vdcd-bridge/pkg/mqtttest"
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+	"github.com/splattner/vdcd-bridge/pkg/vdcdapi/vdcdsim"
+)
+
+// Time to wait for the init of the replayed devices and for the last answers of the bridge
+const replaySettleTime = 2 * time.Second
+
+// runReplay feeds the messages the vdcd sent in a recorded session back into
+// the bridge. The recorded Tasmota, Shelly and Zigbee2MQTT devices are
+// simulated on an in-process MQTT broker and bridged by the discovery backends,
+// so the messages go through the same code as with the real devices.
+func runReplay(args []string) {
+	p := argparse.NewParser("vdcd replay", "Replay a session recorded with --record against simulated backends")
+
+	recording := p.String("f", "file", &argparse.Options{Required: true, Help: "Recorded session (JSONL)"})
+	output := p.String("o", "output", &argparse.Options{Required: false, Help: "Record the replayed session to this file"})
+	speed := p.Float("", "speed", &argparse.Options{Required: false, Help: "Replay speed, 0 replays without delays", Default: 1.0})
+
+	if err := p.Parse(args); err != nil {
+		fmt.Print(p.Usage(err))
+		os.Exit(1)
+	}
+
+	if err := replaySession(*recording, *output, *speed); err != nil {
+		log.WithError(err).Error("Replay failed")
+		os.Exit(1)
+	}
+}
+
+func replaySession(recordingFile string, outputFile string, speed float64) error {
+	file, err := os.Open(recordingFile)
+	if err != nil {
+		return err
+	}
+	messages, err := vdcdapi.ReadRecording(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// the simulated vdcd the bridge connects to
+	vdcd, err := vdcdsim.NewServer()
+	if err != nil {
+		return err
+	}
+	defer vdcd.Close()
+
+	// the simulated MQTT broker the backends and the simulated devices connect to
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		return err
+	}
+	defer broker.Close()
+
+	client := new(vdcdapi.Client)
+	client.NewCient(vdcd.Host(), vdcd.Port(), "replay", "replay", false)
+
+	if outputFile != "" {
+		output, err := os.Create(outputFile)
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+		client.SetRecorder(output)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		return err
+	}
+	go func() {
+		if err := client.ListenWithContext(ctx); err != nil {
+			log.WithError(err).Error("Replay session ended")
+		}
+	}()
+
+	mqttClient := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.URL()).SetClientID("vdcd_replay").SetProtocolVersion(3).SetOrderMatters(false))
+	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("failed to connect to the simulated MQTT broker: %w", token.Error())
+	}
+	defer mqttClient.Disconnect(250)
+
+	recorded := simulateDevices(broker, recordedDevices(messages))
+
+	new(discovery.TasmotaDevice).StartDiscovery(client, mqttClient)
+	new(discovery.ShellyDevice).StartDiscovery(client, mqttClient)
+	new(discovery.Zigbee2MQTTDevice).StartDiscovery(client, mqttClient)
+
+	// the backends may announce the devices with other tags than recorded
+	tags := make(map[string]string)
+	for _, device := range recorded {
+		uniqueID := device.UniqueID
+		message, ok := vdcd.WaitFor(replaySettleTime, func(message vdcdsim.Message) bool {
+			return message.MessageType == "init" && message.UniqueID == uniqueID
+		})
+		if !ok {
+			log.WithField("UniqueID", uniqueID).Warn("Replay device not initialized")
+			continue
+		}
+		tags[device.Tag] = message.Tag
+	}
+
+	log.WithField("Devices", len(tags)).Info("Replay devices initialized, replaying session")
+
+	broker.Reset()
+
+	var previous time.Time
+	for _, message := range messages {
+		if message.Direction != vdcdapi.DirectionIn || isStatusMessage(message.Message) {
+			// status replies are sent by the simulated vdcd itself
+			continue
+		}
+
+		if !previous.IsZero() && speed > 0 {
+			time.Sleep(time.Duration(float64(message.Time.Sub(previous)) / speed))
+		}
+		previous = message.Time
+
+		payload, ok := retag(message.Message, tags)
+		if !ok {
+			log.WithField("Message", string(message.Message)).Debug("Message for a device not replayed, skipped")
+			continue
+		}
+
+		log.WithField("Message", string(payload)).Info("Replay message from vdcd")
+		if err := vdcd.Send(payload); err != nil {
+			return fmt.Errorf("failed to replay message: %w", err)
+		}
+	}
+
+	time.Sleep(replaySettleTime)
+
+	for _, message := range broker.Messages() {
+		log.WithFields(log.Fields{
+			"Topic":   message.Topic,
+			"Payload": string(message.Payload),
+		}).Info("Backend published")
+	}
+
+	for _, message := range vdcd.Messages() {
+		if message.MessageType == "init" {
+			continue
+		}
+		log.WithField("Message", string(message.Raw)).Info("Bridge replied")
+	}
+
+	return nil
+}
+
+// recordedDevices returns the devices announced in the recorded session
+func recordedDevices(messages []vdcdapi.RecordedMessage) []*vdcdapi.Device {
+	var devices []*vdcdapi.Device
+	seen := make(map[string]bool)
+
+	for _, message := range messages {
+		if message.Direction != vdcdapi.DirectionOut {
+			continue
+		}
+
+		// devices are announced with a single init or an array of them
+		var inits []json.RawMessage
+		if json.Unmarshal(message.Message, &inits) != nil {
+			inits = []json.RawMessage{message.Message}
+		}
+
+		for _, init := range inits {
+			if messageType(init) != "init" {
+				continue
+			}
+
+			device := new(vdcdapi.Device)
+			if err := json.Unmarshal(init, device); err != nil || device.UniqueID == "" || seen[device.UniqueID] {
+				continue
+			}
+			seen[device.UniqueID] = true
+
+			devices = append(devices, device)
+		}
+	}
+
+	return devices
+}
+
+// simulateDevices announces a simulated device for every recorded device of
+// a MQTT backend. The backend is told apart by what it announces with the
+// init, devices of other backends are not replayed.
+func simulateDevices(broker *mqtttest.Broker, devices []*vdcdapi.Device) []*vdcdapi.Device {
+	var simulated []*vdcdapi.Device
+	zigbee2mqtt := mqtttest.NewZigbee2MQTT(broker)
+
+	for _, device := range devices {
+		fields := log.Fields{
+			"UniqueID": device.UniqueID,
+			"Name":     device.Name,
+		}
+
+		switch {
+		case hasAction(device, "restart") && (device.Output == vdcdapi.BasicOutput || device.Output == vdcdapi.ColorLightOutput):
+			// Tasmota
+			tasmota := mqtttest.NewTasmota(broker, device.UniqueID, "replay_"+device.UniqueID, device.Name)
+			tasmota.Model = device.ModelName
+			if device.Output == vdcdapi.ColorLightOutput {
+				tasmota.LightSubtype = 4
+			}
+			tasmota.Announce()
+			log.WithFields(fields).Info("Simulating recorded Tasmota device")
+
+		case hasProperty(device, "newFirmware"):
+			// Shelly
+			shelly := mqtttest.NewShelly(broker, device.Name, device.UniqueID)
+			shelly.Model = device.ModelName
+			if device.Output == vdcdapi.ShadowOutput {
+				shelly.Mode = "roller"
+			}
+			shelly.Announce()
+			log.WithFields(fields).Info("Simulating recorded Shelly device")
+
+		case strings.HasPrefix(device.UniqueID, "0x") && (device.Output == vdcdapi.LightOutput || device.Output == vdcdapi.CtLightOutput):
+			// Zigbee2MQTT, devices are identified by their IEEE address. Lights are
+			// bridged by model, a TRADFRI bulb of the same kind stands in for it.
+			model := "LED1623G12"
+			if device.Output == vdcdapi.CtLightOutput {
+				model = "LED2101G4"
+			}
+			zigbee2mqtt.AddLight(device.UniqueID, device.Name, model, device.Output == vdcdapi.CtLightOutput)
+			log.WithFields(fields).Info("Simulating recorded Zigbee2MQTT light")
+
+		default:
+			log.WithFields(fields).Warn("No simulator for recorded device, its messages are not replayed")
+			continue
+		}
+
+		simulated = append(simulated, device)
+	}
+
+	return simulated
+}
+
+// retag replaces the recorded tag of a message by the tag of the replayed
+// device, false if the device is not replayed
+func retag(message json.RawMessage, tags map[string]string) (json.RawMessage, bool) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return message, true
+	}
+
+	recordedTag, ok := fields["tag"].(string)
+	if !ok {
+		// not addressed to a device
+		return message, true
+	}
+
+	tag, ok := tags[recordedTag]
+	if !ok {
+		return nil, false
+	}
+	if tag == recordedTag {
+		return message, true
+	}
+
+	fields["tag"] = tag
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		return nil, false
+	}
+	return payload, true
+}
+
+func hasAction(device *vdcdapi.Device, action string) bool {
+	_, ok := device.Actions[action]
+	return ok
+}
+
+func hasProperty(device *vdcdapi.Device, property string) bool {
+	_, ok := device.Properties[property]
+	return ok
+}
+
+func messageType(message json.RawMessage) string {
+	var header vdcdapi.GenericMessageHeader
+	if json.Unmarshal(message, &header) != nil {
+		return ""
+	}
+	return header.MessageType
+}
+
+func isStatusMessage(message json.RawMessage) bool {
+	return messageType(message) == "status"
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 
 	"sync"
@@ -14,6 +20,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/splattner/vdcd-bridge/pkg/discovery"
 	"github.com/splattner/vdcd-bridge/pkg/vdcdapi"
+	"gopkg.in/yaml.v3"
 )
 
 type VcdcBridgeConfig struct {
@@ -23,14 +30,37 @@ type VcdcBridgeConfig struct {
 	modelName  string
 	vendorName string
 
+	vdcIconName  string
+	vdcConfigURL string
+
 	dryMode bool
 
+	sceneMappingsFile string
+
+	// YAML file with the device overrides
+	overridesFile string
+
+	// JSON file persisting the known devices and their values
+	storeFile string
+
+	// listen address of the admin API and the dashboard, disabled if empty
+	httpListen string
+
+	// JSONL file recording the vdcd session
+	recordFile string
+
 	mqttHost     string
 	mqttUsername string
 	mqttPassword string
 
 	homeassistantURL   string
 	homeassistantToken string
+	homeassistantLabel string
+
+	zigbee2mqttBaseTopic string
+
+	// WLED hosts added in addition to the mDNS discovery
+	wledHosts []string
 
 	deconzHost          string
 	deconzPort          int
@@ -55,10 +85,28 @@ type VcdcBridge struct {
 	cancel     context.CancelFunc
 
 	config VcdcBridgeConfig
+
+	discoveriesMu sync.Mutex
+	discoveries   []*backendDiscovery
+
+	// web UI served with the admin API, nil if the admin API is disabled
+	dashboard *dashboard
 }
 
 const discoveryInterval = 5 * time.Minute
 
+var errBackendNotEnabled = errors.New("backend not enabled")
+
+// backendDiscovery runs the discovery of a backend, at start, periodically and on request
+type backendDiscovery struct {
+	backend string
+	run     func()
+	lastRun time.Time
+
+	// reports the connection of backends with a persistent connection, nil otherwise
+	connected func() bool
+}
+
 func (e *VcdcBridge) NewVcdcBrige(config VcdcBridgeConfig) {
 
 	e.config = config
@@ -66,8 +114,69 @@ func (e *VcdcBridge) NewVcdcBrige(config VcdcBridgeConfig) {
 	e.vdcdClient = new(vdcdapi.Client)
 
 	e.vdcdClient.NewCient(e.config.host, e.config.port, e.config.modelName, e.config.vendorName, e.config.dryMode)
-	e.vdcdClient.Connect()
-	//defer e.vdcdClient.Close()
+	e.vdcdClient.SetVdcInfo(e.config.vdcIconName, e.config.vdcConfigURL)
+
+	if e.config.sceneMappingsFile != "" {
+		sceneMappings, err := loadSceneMappings(e.config.sceneMappingsFile)
+		if err != nil {
+			log.WithError(err).Error("Failed to load scene mappings")
+			os.Exit(1)
+		}
+		e.vdcdClient.SetSceneMappings(sceneMappings)
+	}
+
+	var store *vdcdapi.DeviceStore
+	if e.config.storeFile != "" {
+		var err error
+		store, err = vdcdapi.OpenDeviceStore(e.config.storeFile)
+		if err != nil {
+			log.WithError(err).Error("Failed to open device store")
+			os.Exit(1)
+		}
+		e.vdcdClient.SetStore(store)
+		defer func() {
+			if err := store.Save(); err != nil {
+				log.WithError(err).Error("Failed to save device store")
+			}
+		}()
+	}
+
+	if e.config.overridesFile != "" {
+		overrides, err := loadDeviceOverrides(e.config.overridesFile)
+		if err != nil {
+			log.WithError(err).Error("Failed to load device overrides")
+			os.Exit(1)
+		}
+		e.vdcdClient.SetDeviceOverrides(overrides)
+		if store != nil {
+			store.SetOverrides(overrides)
+		}
+	} else if store != nil {
+		// the overrides of the last run
+		e.vdcdClient.SetDeviceOverrides(store.Overrides())
+	}
+
+	// The dashboard shows the recent messages exchanged with the vdcd
+	var recorders []io.Writer
+	if e.config.httpListen != "" {
+		e.dashboard = newDashboard(e)
+		e.vdcdClient.SetDeviceChangedCB(e.dashboard.deviceChanged)
+		recorders = append(recorders, e.dashboard)
+	}
+
+	if e.config.recordFile != "" {
+		recording, err := os.OpenFile(e.config.recordFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.WithError(err).Error("Failed to open recording file")
+			os.Exit(1)
+		}
+		defer recording.Close()
+		recorders = append(recorders, recording)
+	}
+
+	if len(recorders) > 0 {
+		e.vdcdClient.SetRecorder(io.MultiWriter(recorders...))
+	}
 
 	e.ctx, e.cancel = context.WithCancel(context.Background())
 
@@ -81,6 +190,21 @@ func (e *VcdcBridge) NewVcdcBrige(config VcdcBridgeConfig) {
 		//		e.vdcdClient.Close()
 	}()
 
+	if err := e.vdcdClient.Connect(e.ctx); err != nil {
+		if e.ctx.Err() != nil {
+			return
+		}
+		log.WithError(err).Error("Failed to connect to vdcd")
+		os.Exit(1)
+	}
+
+	// Known devices are announced with their last values until the backends are up
+	if store != nil {
+		e.vdcdClient.RestoreDevices()
+		go store.Run(e.ctx, vdcdapi.DefaultStoreFlushInterval)
+	}
+	//defer e.vdcdClient.Close()
+
 	// Configure MQTT Client if enabled
 	if config.mqttDiscoveryEnabled {
 		log.WithField("Host", config.mqttHost).Info("Create MQTT Client")
@@ -93,10 +217,18 @@ func (e *VcdcBridge) NewVcdcBrige(config VcdcBridgeConfig) {
 		opts.SetOrderMatters(false)
 		opts.SetUsername(config.mqttUsername)
 		opts.SetPassword(config.mqttPassword)
+		opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			log.WithError(err).Warn("MQTT connection lost")
+			e.vdcdClient.Log(vdcdapi.LogWarning, fmt.Sprintf("MQTT connection to %s lost: %s", config.mqttHost, err))
+		})
 
 		e.mqttClient = mqtt.NewClient(opts)
 	}
 
+	if e.config.httpListen != "" {
+		go e.serveAdminAPI(e.config.httpListen)
+	}
+
 	go e.startDiscovery()
 	e.loopVcdcClient()
 
@@ -105,15 +237,6 @@ func (e *VcdcBridge) NewVcdcBrige(config VcdcBridgeConfig) {
 func (e *VcdcBridge) startDiscovery() {
 	log.Debugln("Start startDiscovery")
 
-	var (
-		tasmotaDiscovery  *discovery.TasmotaDevice
-		shellyDiscovery   *discovery.ShellyDevice
-		zigbeeDiscovery   *discovery.Zigbee2MQTTDevice
-		deconzDiscovery   *discovery.DeconzDevice
-		wledDiscovery     *discovery.WledDevice
-		homeassistantDisc *discovery.HomeAssistantDevice
-	)
-
 	if e.config.mqttDiscoveryEnabled {
 
 		log.WithField("Host", e.config.mqttHost).Info("Connecting to MQTT broker")
@@ -130,38 +253,53 @@ func (e *VcdcBridge) startDiscovery() {
 
 		// Tasmota Device Discovery
 		if !e.config.tasmotaDisabled {
-			tasmotaDiscovery = new(discovery.TasmotaDevice)
-			go tasmotaDiscovery.StartDiscovery(e.vdcdClient, e.mqttClient)
+			tasmotaDiscovery := new(discovery.TasmotaDevice)
+			e.addDiscovery("tasmota", func() {
+				tasmotaDiscovery.StartDiscovery(e.vdcdClient, e.mqttClient)
+			}, nil)
 		}
 
 		// Shelly Device Discovery
 		if !e.config.shellyDisabled {
-			shellyDiscovery = new(discovery.ShellyDevice)
-			go shellyDiscovery.StartDiscovery(e.vdcdClient, e.mqttClient)
+			shellyDiscovery := new(discovery.ShellyDevice)
+			e.addDiscovery("shelly", func() {
+				shellyDiscovery.StartDiscovery(e.vdcdClient, e.mqttClient)
+			}, nil)
 		}
 
 		// Zigbee2MQTT Discovery
 		if !e.config.zigbee2mqttDisabled {
-			zigbeeDiscovery = new(discovery.Zigbee2MQTTDevice)
-			go zigbeeDiscovery.StartDiscovery(e.vdcdClient, e.mqttClient)
+			zigbeeDiscovery := new(discovery.Zigbee2MQTTDevice)
+			zigbeeDiscovery.SetBaseTopic(e.config.zigbee2mqttBaseTopic)
+			e.addDiscovery("zigbee2mqtt", func() {
+				zigbeeDiscovery.StartDiscovery(e.vdcdClient, e.mqttClient)
+			}, nil)
 		}
 	}
 
 	if !e.config.deconzDisabled {
-		deconzDiscovery = new(discovery.DeconzDevice)
-		go deconzDiscovery.StartDiscovery(e.vdcdClient, e.config.deconzHost, e.config.deconzPort, e.config.deconcWebSockerPort, e.config.deconzApi, e.config.deconzEnableGroups)
+		deconzDiscovery := new(discovery.DeconzDevice)
+		e.addDiscovery("deconz", func() {
+			deconzDiscovery.StartDiscovery(e.vdcdClient, e.config.deconzHost, e.config.deconzPort, e.config.deconcWebSockerPort, e.config.deconzApi, e.config.deconzEnableGroups)
+		}, deconzDiscovery.WebsocketConnected)
 	}
 
 	// WLED Device Discovery
 	if !e.config.wledDisabled {
-		wledDiscovery = new(discovery.WledDevice)
-		go wledDiscovery.StartDiscovery(e.vdcdClient)
+		wledDiscovery := new(discovery.WledDevice)
+		wledDiscovery.SetStaticHosts(e.config.wledHosts)
+		e.addDiscovery("wled", func() {
+			wledDiscovery.StartDiscovery(e.vdcdClient)
+		}, nil)
 	}
 
 	// Home Assistant Device Discovery
 	if !e.config.homeassistantDisabled {
-		homeassistantDisc = new(discovery.HomeAssistantDevice)
-		go homeassistantDisc.StartDiscovery(e.vdcdClient, e.config.homeassistantURL, e.config.homeassistantToken)
+		homeassistantDisc := new(discovery.HomeAssistantDevice)
+		homeassistantDisc.SetLabel(e.config.homeassistantLabel)
+		e.addDiscovery("homeassistant", func() {
+			homeassistantDisc.StartDiscovery(e.vdcdClient, e.config.homeassistantURL, e.config.homeassistantToken)
+		}, homeassistantDisc.WebsocketConnected)
 	}
 
 	ticker := time.NewTicker(discoveryInterval)
@@ -175,33 +313,150 @@ func (e *VcdcBridge) startDiscovery() {
 		case <-ticker.C:
 			log.WithField("interval", discoveryInterval).Info("Running periodic discovery")
 
-			if !e.config.deconzDisabled && deconzDiscovery != nil {
-				go deconzDiscovery.StartDiscovery(e.vdcdClient, e.config.deconzHost, e.config.deconzPort, e.config.deconcWebSockerPort, e.config.deconzApi, e.config.deconzEnableGroups)
+			for _, backend := range e.discoveryBackends() {
+				e.runDiscovery(backend)
 			}
+		}
+	}
+}
 
-			if !e.config.wledDisabled && wledDiscovery != nil {
-				go wledDiscovery.StartDiscovery(e.vdcdClient)
-			}
+// addDiscovery registers the discovery of a backend and runs it, connected
+// reports the state of its persistent connection if it has one
+func (e *VcdcBridge) addDiscovery(backend string, run func(), connected func() bool) {
+	e.discoveriesMu.Lock()
+	e.discoveries = append(e.discoveries, &backendDiscovery{backend: backend, run: run, connected: connected})
+	e.discoveriesMu.Unlock()
 
-			if !e.config.homeassistantDisabled && homeassistantDisc != nil {
-				go homeassistantDisc.StartDiscovery(e.vdcdClient, e.config.homeassistantURL, e.config.homeassistantToken)
-			}
+	e.runDiscovery(backend)
+}
 
-			if e.config.mqttDiscoveryEnabled {
-				if shellyDiscovery != nil {
-					go shellyDiscovery.StartDiscovery(e.vdcdClient, e.mqttClient)
-				}
-				if zigbeeDiscovery != nil {
-					go zigbeeDiscovery.StartDiscovery(e.vdcdClient, e.mqttClient)
-				}
-				if tasmotaDiscovery != nil {
-					go tasmotaDiscovery.StartDiscovery(e.vdcdClient, e.mqttClient)
-				}
-			}
+// runDiscovery starts the discovery of the backend in the background
+func (e *VcdcBridge) runDiscovery(backend string) error {
+	e.discoveriesMu.Lock()
+	defer e.discoveriesMu.Unlock()
+
+	for _, entry := range e.discoveries {
+		if entry.backend == backend {
+			entry.lastRun = time.Now()
+			go entry.run()
+			return nil
 		}
 	}
+
+	return errBackendNotEnabled
+}
+
+// discoveryBackends returns the backends with enabled discovery
+func (e *VcdcBridge) discoveryBackends() []string {
+	e.discoveriesMu.Lock()
+	defer e.discoveriesMu.Unlock()
+
+	backends := make([]string, 0, len(e.discoveries))
+	for _, entry := range e.discoveries {
+		backends = append(backends, entry.backend)
+	}
+	return backends
+}
+
+// loadSceneMappings reads the scene command mappings from a JSON file, e.g.
+// {"<uniqueid>": {"ON": "3", "OFF": "1"}} with backend specific targets:
+// WLED preset, deconz (group/)scene, Z2M scene id, HA scene entity or Tasmota Backlog.
+func loadSceneMappings(path string) (map[string]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var mappings map[string]map[string]string
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return nil, fmt.Errorf("invalid scene mappings %s: %w", path, err)
+	}
+
+	return mappings, nil
 }
 
 func (e *VcdcBridge) loopVcdcClient() {
-	e.vdcdClient.ListenWithContext(e.ctx)
+	if err := e.vdcdClient.ListenWithContext(e.ctx); err != nil {
+		log.WithError(err).Error("Lost connection to vdcd")
+		os.Exit(1)
+	}
+}
+
+// deviceOverride is an entry of the device overrides file, see vdcdapi.DeviceOverride
+type deviceOverride struct {
+	UniqueID   string `yaml:"uniqueid"`
+	Match      string `yaml:"match"`
+	Backend    string `yaml:"backend"`
+	Source     string `yaml:"source"`
+	Name       string `yaml:"name"`
+	Group      string `yaml:"group"`
+	ColorClass string `yaml:"colorclass"`
+	Output     string `yaml:"output"`
+	Icon       string `yaml:"icon"`
+	Ignore     bool   `yaml:"ignore"`
+}
+
+// loadDeviceOverrides reads the device overrides from a YAML (or JSON) file,
+// a list of match criteria and overrides, see overrides.example.yaml
+func loadDeviceOverrides(path string) ([]vdcdapi.DeviceOverride, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []deviceOverride
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&entries); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid device overrides %s: %w", path, err)
+	}
+
+	overrides := make([]vdcdapi.DeviceOverride, 0, len(entries))
+	for i, entry := range entries {
+		override := vdcdapi.DeviceOverride{
+			UniqueID: strings.TrimSpace(entry.UniqueID),
+			Match:    strings.TrimSpace(entry.Match),
+			Backend:  strings.TrimSpace(entry.Backend),
+			SourceID: strings.TrimSpace(entry.Source),
+			Name:     strings.TrimSpace(entry.Name),
+			IconName: strings.TrimSpace(entry.Icon),
+			Ignore:   entry.Ignore,
+		}
+
+		if override.UniqueID == "" && override.Match == "" && override.Backend == "" && override.SourceID == "" {
+			return nil, fmt.Errorf("invalid device overrides %s: entry %d: one of uniqueid, match, backend or source is required", path, i+1)
+		}
+
+		if _, err := filepath.Match(override.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid device overrides %s: entry %d: match: %w", path, i+1, err)
+		}
+
+		if entry.Group != "" {
+			group, ok := vdcdapi.ParseGroup(entry.Group)
+			if !ok {
+				return nil, fmt.Errorf("invalid device overrides %s: entry %d: group: unknown group %q", path, i+1, entry.Group)
+			}
+			override.Group = group
+		}
+
+		if entry.ColorClass != "" {
+			colorClass, ok := vdcdapi.ParseColorClass(entry.ColorClass)
+			if !ok {
+				return nil, fmt.Errorf("invalid device overrides %s: entry %d: colorclass: unknown color class %q", path, i+1, entry.ColorClass)
+			}
+			override.ColorClass = colorClass
+		}
+
+		switch output := vdcdapi.OutputType(strings.ToLower(strings.TrimSpace(entry.Output))); output {
+		case "":
+		case vdcdapi.SwitchOutput:
+			override.Output = output
+		default:
+			return nil, fmt.Errorf("invalid device overrides %s: entry %d: output: only %q is supported, got %q", path, i+1, vdcdapi.SwitchOutput, entry.Output)
+		}
+
+		overrides = append(overrides, override)
+	}
+
+	return overrides, nil
 }